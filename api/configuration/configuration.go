@@ -4,13 +4,16 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+
+	"github.com/joaoribeirodasilva/mqtt-course/shared/timeseries"
 )
 
 type TLSConf struct {
-	Use  bool   `json:"use"`
-	Root string `json:"root"`
-	Crt  string `json:"ctr"`
-	Key  string `json:"key"`
+	Use      bool   `json:"use"`
+	Insecure bool   `json:"insecure"`
+	Root     string `json:"root"`
+	Crt      string `json:"crt"`
+	Key      string `json:"key"`
 }
 
 type MongoCompressorsConf struct {
@@ -58,8 +61,9 @@ type ServerConf struct {
 }
 
 type Configuration struct {
-	Mongo  MongoConf  `json:"mongodb"`
-	Server ServerConf `json:"server"`
+	Mongo   MongoConf       `json:"mongodb"`
+	Server  ServerConf      `json:"server"`
+	Metrics timeseries.Conf `json:"metrics"`
 }
 
 const (
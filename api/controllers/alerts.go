@@ -0,0 +1,624 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// AlertRule is a condition on the readings of a device evaluated by the
+// consumers, the state is kept by the consumers and can't be changed
+type AlertRule struct {
+	ID        primitive.ObjectID `json:"id" bson:"_id"`
+	UserID    primitive.ObjectID `json:"userId" bson:"userId"`
+	DeviceID  primitive.ObjectID `json:"deviceId" bson:"deviceId"`
+	Name      string             `json:"name" bson:"name"`
+	Type      string             `json:"type" bson:"type"`
+	Sensor    string             `json:"sensor,omitempty" bson:"sensor,omitempty"`
+	Operator  string             `json:"operator,omitempty" bson:"operator,omitempty"`
+	Value     float64            `json:"value" bson:"value"`
+	Duration  int64              `json:"duration" bson:"duration"`
+	Active    bool               `json:"active" bson:"active"`
+	State     *AlertRuleState    `json:"state,omitempty" bson:"state,omitempty"`
+	CreatedAt time.Time          `json:"createdAt" bson:"createdAt"`
+	UpdatedAt time.Time          `json:"updatedAt" bson:"updatedAt"`
+}
+
+// AlertRuleState is the condition of a rule in the last readings
+type AlertRuleState struct {
+	LastOk      *time.Time          `json:"lastOk,omitempty" bson:"lastOk,omitempty"`
+	BreachSince *time.Time          `json:"breachSince,omitempty" bson:"breachSince,omitempty"`
+	BreachLast  *time.Time          `json:"breachLast,omitempty" bson:"breachLast,omitempty"`
+	AlertID     *primitive.ObjectID `json:"alertId,omitempty" bson:"alertId,omitempty"`
+}
+
+// Alert is an alert opened by the consumers and its state changes
+type Alert struct {
+	ID             primitive.ObjectID `json:"id" bson:"_id"`
+	RuleID         primitive.ObjectID `json:"ruleId" bson:"ruleId"`
+	DeviceID       primitive.ObjectID `json:"deviceId" bson:"deviceId"`
+	UserID         primitive.ObjectID `json:"userId" bson:"userId"`
+	Name           string             `json:"name" bson:"name"`
+	Type           string             `json:"type" bson:"type"`
+	Sensor         string             `json:"sensor,omitempty" bson:"sensor,omitempty"`
+	Value          *float64           `json:"value,omitempty" bson:"value,omitempty"`
+	State          string             `json:"state" bson:"state"`
+	Since          time.Time          `json:"since" bson:"since"`
+	OpenedAt       time.Time          `json:"openedAt" bson:"openedAt"`
+	AcknowledgedAt *time.Time         `json:"acknowledgedAt,omitempty" bson:"acknowledgedAt,omitempty"`
+	ResolvedAt     *time.Time         `json:"resolvedAt,omitempty" bson:"resolvedAt,omitempty"`
+	UpdatedAt      time.Time          `json:"updatedAt" bson:"updatedAt"`
+	History        []AlertEvent       `json:"history" bson:"history"`
+}
+
+// AlertEvent is a state change of an alert
+type AlertEvent struct {
+	State  string              `json:"state" bson:"state"`
+	Time   time.Time           `json:"time" bson:"time"`
+	UserID *primitive.ObjectID `json:"userId,omitempty" bson:"userId,omitempty"`
+	Note   string              `json:"note,omitempty" bson:"note,omitempty"`
+}
+
+// AlertNote is the optional note of an acknowledge or resolve
+type AlertNote struct {
+	Note string `json:"note"`
+}
+
+const (
+	alertTypeThreshold = "threshold"
+	alertTypeDoor      = "door"
+	alertTypeNoData    = "noData"
+
+	alertOperatorAbove = "above"
+	alertOperatorBelow = "below"
+
+	alertStateOpen         = "open"
+	alertStateAcknowledged = "acknowledged"
+	alertStateResolved     = "resolved"
+)
+
+func AlertRuleList(c *gin.Context) {
+
+	ptrs, err := mustGetAll(c)
+	if err != nil {
+		return
+	}
+
+	query, err := listQuery(c)
+	if err != nil {
+		return
+	}
+
+	filter := userFilter(ptrs, bson.D{})
+	if deviceID, ok := objectIDQuery(c, "device"); !ok {
+		return
+	} else if deviceID != nil {
+		filter = append(filter, bson.E{Key: "deviceId", Value: deviceID})
+	}
+
+	rules := make([]AlertRule, 0)
+	if err := findPage(ptrs, "alertrules", filter, query, bson.D{{Key: "updatedAt", Value: 1}}, &rules); err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(http.StatusOK, &rules)
+}
+
+func AlertRuleGet(c *gin.Context) {
+
+	ptrs, err := mustGetAll(c)
+	if err != nil {
+		return
+	}
+
+	id := idQuery(c)
+	if id == nil {
+		return
+	}
+
+	rule := &AlertRule{}
+	err = ptrs.Db.GetCollection("alertrules").FindOne(context.TODO(), userFilter(ptrs, bson.D{{Key: "_id", Value: id}})).Decode(rule)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			c.AbortWithStatus(http.StatusNotFound)
+			return
+		}
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(http.StatusOK, rule)
+}
+
+func AlertRuleAdd(c *gin.Context) {
+
+	// get all service pointers from middleware
+	ptrs, err := mustGetAll(c)
+	if err != nil {
+		return
+	}
+
+	rule := &AlertRule{}
+	if err := c.ShouldBind(rule); err != nil {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	if msg := validateAlertRule(rule); msg != "" {
+		c.AbortWithStatusJSON(http.StatusBadRequest, map[string]string{"error": msg})
+		return
+	}
+
+	// the rule belongs to the owner of the device
+	device := ruleDevice(c, ptrs, rule.DeviceID)
+	if device == nil {
+		return
+	}
+
+	now := time.Now().UTC()
+	rule.ID = primitive.NewObjectID()
+	rule.UserID = device.UserID
+	rule.State = nil
+	rule.CreatedAt = now
+	rule.UpdatedAt = now
+
+	if _, err := ptrs.Db.GetCollection("alertrules").InsertOne(context.TODO(), rule); err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(http.StatusCreated, map[string]string{"id": rule.ID.Hex()})
+}
+
+func AlertRuleUpdate(c *gin.Context) {
+
+	// get all service pointers from middleware
+	ptrs, err := mustGetAll(c)
+	if err != nil {
+		return
+	}
+
+	id := idQuery(c)
+	if id == nil {
+		return
+	}
+
+	rule := &AlertRule{}
+	if err := c.ShouldBind(rule); err != nil {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	if msg := validateAlertRule(rule); msg != "" {
+		c.AbortWithStatusJSON(http.StatusBadRequest, map[string]string{"error": msg})
+		return
+	}
+
+	device := ruleDevice(c, ptrs, rule.DeviceID)
+	if device == nil {
+		return
+	}
+
+	// the condition starts over with the new rule
+	update := bson.D{
+		{Key: "$set", Value: bson.D{
+			{Key: "userId", Value: device.UserID},
+			{Key: "deviceId", Value: rule.DeviceID},
+			{Key: "name", Value: rule.Name},
+			{Key: "type", Value: rule.Type},
+			{Key: "sensor", Value: rule.Sensor},
+			{Key: "operator", Value: rule.Operator},
+			{Key: "value", Value: rule.Value},
+			{Key: "duration", Value: rule.Duration},
+			{Key: "active", Value: rule.Active},
+			{Key: "updatedAt", Value: time.Now().UTC()},
+		}},
+		{Key: "$unset", Value: bson.D{{Key: "state", Value: ""}}},
+	}
+
+	before := &AlertRule{}
+	err = ptrs.Db.GetCollection("alertrules").FindOneAndUpdate(context.TODO(), userFilter(ptrs, bson.D{{Key: "_id", Value: id}}), update).Decode(before)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			c.AbortWithStatus(http.StatusNotFound)
+			return
+		}
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	if before.State != nil && before.State.AlertID != nil {
+		if err := resolveAlert(ptrs, *before.State.AlertID, "rule updated"); err != nil {
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+	}
+
+	c.JSON(http.StatusOK, map[string]string{"id": id.Hex()})
+}
+
+func AlertRuleDelete(c *gin.Context) {
+
+	// get all service pointers from middleware
+	ptrs, err := mustGetAll(c)
+	if err != nil {
+		return
+	}
+
+	id := idQuery(c)
+	if id == nil {
+		return
+	}
+
+	rule := &AlertRule{}
+	err = ptrs.Db.GetCollection("alertrules").FindOneAndDelete(context.TODO(), userFilter(ptrs, bson.D{{Key: "_id", Value: id}})).Decode(rule)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			c.AbortWithStatus(http.StatusNotFound)
+			return
+		}
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	// the alerts are kept with their history
+	if rule.State != nil && rule.State.AlertID != nil {
+		if err := resolveAlert(ptrs, *rule.State.AlertID, "rule deleted"); err != nil {
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+	}
+
+	c.Status(http.StatusOK)
+}
+
+// AlertList returns the alerts newest first, optionally
+// of a state, a device or a rule
+func AlertList(c *gin.Context) {
+
+	ptrs, err := mustGetAll(c)
+	if err != nil {
+		return
+	}
+
+	query, err := listQuery(c)
+	if err != nil {
+		return
+	}
+
+	filter := userFilter(ptrs, bson.D{})
+
+	if state := c.Query("state"); state != "" {
+		if state != alertStateOpen && state != alertStateAcknowledged && state != alertStateResolved {
+			c.AbortWithStatusJSON(http.StatusBadRequest, map[string]string{"error": "state parameter must be one of open, acknowledged or resolved"})
+			return
+		}
+		filter = append(filter, bson.E{Key: "state", Value: state})
+	}
+
+	for param, field := range map[string]string{"device": "deviceId", "rule": "ruleId"} {
+		id, ok := objectIDQuery(c, param)
+		if !ok {
+			return
+		}
+		if id != nil {
+			filter = append(filter, bson.E{Key: field, Value: id})
+		}
+	}
+
+	alerts := make([]Alert, 0)
+	if err := findPage(ptrs, "alerts", filter, query, bson.D{{Key: "openedAt", Value: -1}}, &alerts); err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(http.StatusOK, &alerts)
+}
+
+func AlertGet(c *gin.Context) {
+
+	ptrs, err := mustGetAll(c)
+	if err != nil {
+		return
+	}
+
+	id := idQuery(c)
+	if id == nil {
+		return
+	}
+
+	alert := ownedAlert(c, ptrs, *id)
+	if alert == nil {
+		return
+	}
+
+	c.JSON(http.StatusOK, alert)
+}
+
+// AlertAcknowledge acknowledges an open alert, it stays
+// acknowledged until the consumers resolve it
+func AlertAcknowledge(c *gin.Context) {
+
+	ptrs, err := mustGetAll(c)
+	if err != nil {
+		return
+	}
+
+	id := idQuery(c)
+	if id == nil {
+		return
+	}
+
+	alert := ownedAlert(c, ptrs, *id)
+	if alert == nil {
+		return
+	}
+
+	note := alertNote(c)
+	now := time.Now().UTC()
+
+	update := bson.D{
+		{Key: "$set", Value: bson.D{
+			{Key: "state", Value: alertStateAcknowledged},
+			{Key: "acknowledgedAt", Value: now},
+			{Key: "updatedAt", Value: now},
+		}},
+		{Key: "$push", Value: bson.D{{Key: "history", Value: AlertEvent{State: alertStateAcknowledged, Time: now, UserID: &ptrs.User.ID, Note: note}}}},
+	}
+
+	result, err := ptrs.Db.GetCollection("alerts").UpdateOne(context.TODO(), bson.D{{Key: "_id", Value: id}, {Key: "state", Value: alertStateOpen}}, update)
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	// only an open alert can be acknowledged
+	if result.ModifiedCount == 0 {
+		c.AbortWithStatusJSON(http.StatusConflict, map[string]string{"error": fmt.Sprintf("the alert is %s", alert.State)})
+		return
+	}
+
+	c.JSON(http.StatusOK, map[string]string{"id": id.Hex()})
+}
+
+// AlertResolve resolves an open or acknowledged alert, if the
+// condition persists the consumers open a new alert after the
+// rule duration
+func AlertResolve(c *gin.Context) {
+
+	ptrs, err := mustGetAll(c)
+	if err != nil {
+		return
+	}
+
+	id := idQuery(c)
+	if id == nil {
+		return
+	}
+
+	alert := ownedAlert(c, ptrs, *id)
+	if alert == nil {
+		return
+	}
+
+	if alert.State == alertStateResolved {
+		c.AbortWithStatusJSON(http.StatusConflict, map[string]string{"error": "the alert is resolved"})
+		return
+	}
+
+	note := alertNote(c)
+	now := time.Now().UTC()
+
+	update := bson.D{
+		{Key: "$set", Value: bson.D{
+			{Key: "state", Value: alertStateResolved},
+			{Key: "resolvedAt", Value: now},
+			{Key: "updatedAt", Value: now},
+		}},
+		{Key: "$push", Value: bson.D{{Key: "history", Value: AlertEvent{State: alertStateResolved, Time: now, UserID: &ptrs.User.ID, Note: note}}}},
+	}
+
+	filter := bson.D{{Key: "_id", Value: id}, {Key: "state", Value: bson.D{{Key: "$ne", Value: alertStateResolved}}}}
+	result, err := ptrs.Db.GetCollection("alerts").UpdateOne(context.TODO(), filter, update)
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	if result.ModifiedCount == 0 {
+		c.AbortWithStatusJSON(http.StatusConflict, map[string]string{"error": "the alert is resolved"})
+		return
+	}
+
+	if err := releaseAlertRule(ptrs, alert.RuleID, alert.ID); err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(http.StatusOK, map[string]string{"id": id.Hex()})
+}
+
+// validateAlertRule returns why a rule is invalid, empty if it's valid,
+// and clears the fields its type doesn't use
+func validateAlertRule(rule *AlertRule) string {
+
+	if rule.DeviceID.IsZero() {
+		return "deviceId is required"
+	}
+
+	if rule.Duration < 0 {
+		return "duration can't be negative"
+	}
+
+	switch rule.Type {
+	case alertTypeThreshold:
+		if rule.Sensor == "" {
+			return "sensor is required"
+		}
+		if rule.Operator != alertOperatorAbove && rule.Operator != alertOperatorBelow {
+			return "operator must be above or below"
+		}
+	case alertTypeDoor:
+		if rule.Sensor == "" {
+			return "sensor is required"
+		}
+		rule.Operator = ""
+		rule.Value = 0
+	case alertTypeNoData:
+		if rule.Duration == 0 {
+			return "duration is required"
+		}
+		rule.Sensor = ""
+		rule.Operator = ""
+		rule.Value = 0
+	default:
+		return "type must be one of threshold, door or noData"
+	}
+
+	return ""
+}
+
+// ruleDevice returns the device of a rule if the logged user owns it
+func ruleDevice(c *gin.Context, ptrs *Variables, id primitive.ObjectID) *Device {
+
+	device := &Device{}
+	err := ptrs.Db.GetCollection("devices").FindOne(context.TODO(), userFilter(ptrs, bson.D{{Key: "_id", Value: id}})).Decode(device)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			c.AbortWithStatusJSON(http.StatusBadRequest, map[string]string{"error": "device not found"})
+			return nil
+		}
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return nil
+	}
+
+	return device
+}
+
+// ownedAlert returns an alert if the logged user owns it
+func ownedAlert(c *gin.Context, ptrs *Variables, id primitive.ObjectID) *Alert {
+
+	alert := &Alert{}
+	err := ptrs.Db.GetCollection("alerts").FindOne(context.TODO(), userFilter(ptrs, bson.D{{Key: "_id", Value: id}})).Decode(alert)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			c.AbortWithStatus(http.StatusNotFound)
+			return nil
+		}
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return nil
+	}
+
+	return alert
+}
+
+// resolveAlert resolves the open alert of a rule changed or deleted
+func resolveAlert(ptrs *Variables, id primitive.ObjectID, note string) error {
+
+	now := time.Now().UTC()
+
+	filter := bson.D{{Key: "_id", Value: id}, {Key: "state", Value: bson.D{{Key: "$ne", Value: alertStateResolved}}}}
+	update := bson.D{
+		{Key: "$set", Value: bson.D{
+			{Key: "state", Value: alertStateResolved},
+			{Key: "resolvedAt", Value: now},
+			{Key: "updatedAt", Value: now},
+		}},
+		{Key: "$push", Value: bson.D{{Key: "history", Value: AlertEvent{State: alertStateResolved, Time: now, UserID: &ptrs.User.ID, Note: note}}}},
+	}
+
+	_, err := ptrs.Db.GetCollection("alerts").UpdateOne(context.TODO(), filter, update)
+
+	return err
+}
+
+// releaseAlertRule clears the breach of the rule of an alert resolved
+// by a user, so the consumers can open a new one
+func releaseAlertRule(ptrs *Variables, ruleID primitive.ObjectID, alertID primitive.ObjectID) error {
+
+	filter := bson.D{{Key: "_id", Value: ruleID}, {Key: "state.alertId", Value: alertID}}
+	update := bson.D{{Key: "$unset", Value: bson.D{
+		{Key: "state.alertId", Value: ""},
+		{Key: "state.breachSince", Value: ""},
+		{Key: "state.breachLast", Value: ""},
+	}}}
+
+	_, err := ptrs.Db.GetCollection("alertrules").UpdateOne(context.TODO(), filter, update)
+
+	return err
+}
+
+// alertNote returns the optional note in the payload
+func alertNote(c *gin.Context) string {
+
+	note := AlertNote{}
+	if c.Request.ContentLength == 0 {
+		return ""
+	}
+
+	if err := c.ShouldBindJSON(&note); err != nil {
+		return ""
+	}
+
+	return note.Note
+}
+
+// userFilter restricts a filter to the documents of the
+// logged user unless the user is an admin
+func userFilter(ptrs *Variables, filter bson.D) bson.D {
+
+	if ptrs.User.Admin {
+		return filter
+	}
+
+	return append(filter, bson.E{Key: "userId", Value: ptrs.User.ID})
+}
+
+// objectIDQuery parses an optional object id query parameter
+func objectIDQuery(c *gin.Context, name string) (*primitive.ObjectID, bool) {
+
+	strId := c.Query(name)
+	if strId == "" {
+		return nil, true
+	}
+
+	id, err := primitive.ObjectIDFromHex(strId)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("%s parameter must be an id", name)})
+		return nil, false
+	}
+
+	return &id, true
+}
+
+// findPage finds a page of the documents of a collection
+func findPage(ptrs *Variables, collection string, filter bson.D, query *ListQuery, sort bson.D, results interface{}) error {
+
+	if query.Sort != "" {
+		sort = bson.D{{Key: query.Sort, Value: query.Dir}}
+	}
+
+	page := max(query.Page, 1)
+	limit := int64(query.PageSize)
+	skip := int64(page*query.PageSize - query.PageSize)
+	findOptions := options.FindOptions{
+		Limit: &limit,
+		Skip:  &skip,
+		Sort:  sort,
+	}
+
+	cursor, err := ptrs.Db.GetCollection(collection).Find(context.TODO(), filter, &findOptions)
+	if err != nil {
+		return err
+	}
+
+	return cursor.All(context.TODO(), results)
+}
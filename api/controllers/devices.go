@@ -12,11 +12,18 @@ import (
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
+// ClockSkew is the clock offset of a device detected by the consumers
+type ClockSkew struct {
+	Offset     int64     `json:"offset" bson:"offset"`
+	DetectedAt time.Time `json:"detectedAt" bson:"detectedAt"`
+}
+
 type Device struct {
 	ID             primitive.ObjectID `json:"id" bson:"_id"`
 	UserID         primitive.ObjectID `json:"userId" bson:"userId"`
 	Name           string             `json:"name" bson:"name"`
 	LastMetricTime *time.Time         `json:"lastMetricTime" bson:"lastMetricTime"`
+	ClockSkew      *ClockSkew         `json:"clockSkew,omitempty" bson:"clockSkew,omitempty"`
 	Active         bool               `json:"active" bson:"active"`
 	CreatedAt      time.Time          `json:"createdAt" bson:"createdAt"`
 	UpdatedAt      time.Time          `json:"updatedAt" bson:"updatedAt"`
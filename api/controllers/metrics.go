@@ -1,24 +1,148 @@
 package controllers
 
 import (
+	"context"
+	"encoding/base64"
+	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/joaoribeirodasilva/mqtt-course/shared/timeseries"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
-type MetricsQuery struct {
-	DeviceId string    `query:"deviceId"`
-	Start    time.Time `query:"start" time_format:"2006-01-02T15:04:05Z" time_utc:"0"`
-	End      time.Time `query:"start" time_format:"2006-01-02T15:04:05Z" time_utc:"0"`
+// MetricMeta is the device and user of a reading
+type MetricMeta struct {
+	DeviceID primitive.ObjectID `json:"deviceId" bson:"deviceId"`
+	UserID   primitive.ObjectID `json:"userId" bson:"userId"`
+}
+
+// Metric is a device reading as stored by the consumers
+type Metric struct {
+	ID          primitive.ObjectID     `json:"id" bson:"_id"`
+	Meta        MetricMeta             `json:"meta" bson:"meta"`
+	Sequence    uint64                 `json:"sequence,omitempty" bson:"sequence,omitempty"`
+	Sensors     map[string]interface{} `json:"sensors" bson:"sensors"`
+	CollectedAt time.Time              `json:"collectedAt" bson:"collectedAt"`
+	Received    time.Time              `json:"received" bson:"received"`
+	ClockSkewed bool                   `json:"clockSkewed,omitempty" bson:"clockSkewed,omitempty"`
+	Aggregate   *MetricAggregate       `json:"aggregate,omitempty" bson:"aggregate,omitempty"`
+}
+
+// MetricAggregate describes a reading merging count readings of a device
+// whose storage was full, the sensors values are their averages
+type MetricAggregate struct {
+	Count int                `json:"count" bson:"count"`
+	From  time.Time          `json:"from" bson:"from"`
+	To    time.Time          `json:"to" bson:"to"`
+	Min   map[string]float64 `json:"min" bson:"min"`
+	Max   map[string]float64 `json:"max" bson:"max"`
+}
+
+// MetricsPage is a page of the readings of a device, next is the
+// cursor of the following page and it's empty on the last page
+type MetricsPage struct {
+	DeviceID primitive.ObjectID `json:"deviceId"`
+	Start    time.Time          `json:"start"`
+	End      time.Time          `json:"end"`
+	Metrics  []Metric           `json:"metrics"`
+	Next     string             `json:"next,omitempty"`
+}
+
+// SensorStats are the statistics of a numeric sensor in a bucket
+type SensorStats struct {
+	Min   float64 `json:"min" bson:"min"`
+	Max   float64 `json:"max" bson:"max"`
+	Avg   float64 `json:"avg" bson:"avg"`
+	Count int64   `json:"count" bson:"count"`
+}
+
+// DoorStats are the number of openings of a door in a bucket
+// and the time in milliseconds it was open
+type DoorStats struct {
+	Openings int64 `json:"openings"`
+	OpenTime int64 `json:"openTime"`
+}
+
+// MetricsBucket holds the statistics of each sensor in a time bucket
+type MetricsBucket struct {
+	Time    time.Time              `json:"time" bson:"time"`
+	Count   int64                  `json:"count,omitempty" bson:"count,omitempty"`
+	Sensors map[string]SensorStats `json:"sensors" bson:"sensors"`
+	Doors   map[string]DoorStats   `json:"doors,omitempty" bson:"-"`
+}
+
+// Rollup is the hourly or daily statistics of a device kept by the consumers
+type Rollup struct {
+	Time    time.Time                       `bson:"time"`
+	Count   int64                           `bson:"count"`
+	Sensors map[string]RollupStats          `bson:"sensors"`
+	Doors   map[string]map[string]time.Time `bson:"doors"`
+}
+
+// RollupStats are the statistics of a numeric sensor in a rollup
+type RollupStats struct {
+	Min   float64 `bson:"min"`
+	Max   float64 `bson:"max"`
+	Sum   float64 `bson:"sum"`
+	Count int64   `bson:"count"`
+}
+
+// MetricsSeries is the aggregated series of the readings of a device
+type MetricsSeries struct {
+	DeviceID primitive.ObjectID `json:"deviceId"`
+	Start    time.Time          `json:"start"`
+	End      time.Time          `json:"end"`
+	Bucket   string             `json:"bucket"`
+	Series   []MetricsBucket    `json:"series"`
+}
+
+// metricsBucket is the $dateTrunc unit and bin size of a bucket,
+// and the rollups collection of the bucket if there's one
+type metricsBucket struct {
+	unit    string
+	binSize int
+	size    time.Duration
+	rollups string
 }
 
 const (
-	defaultDataFormat = "2006-01-02T15:04:05.000Z"
+	metricsTimeFormat      = time.RFC3339
+	defaultMetricsPageSize = 100
+	maxMetricsPageSize     = 1000
+	maxMetricsBuckets      = 10000
+	defaultMetricsPoints   = 500
+
+	autoResolution = "auto"
+	rawResolution  = "raw"
 )
 
-// MetricsGet
+// the time fields the readings can be queried by
+var metricsTimeFields = map[string]string{
+	"collectedAt": timeseries.TimeField,
+	"received":    timeseries.ReceivedField,
+}
+
+var metricsBuckets = map[string]metricsBucket{
+	"1m": {unit: "minute", binSize: 1, size: time.Minute},
+	"5m": {unit: "minute", binSize: 5, size: 5 * time.Minute},
+	"1h": {unit: "hour", binSize: 1, size: time.Hour, rollups: timeseries.HourlyRollups},
+	"1d": {unit: "day", binSize: 1, size: 24 * time.Hour, rollups: timeseries.DailyRollups},
+}
+
+// the bucket sizes from the finest to the coarsest
+var metricsResolutions = []string{"1m", "5m", "1h", "1d"}
+
+// MetricsGet returns the readings of a device from start (inclusive) to
+// end (exclusive), oldest first, one page at a time. The next page is
+// requested with the cursor returned in next. The range is of the time
+// the readings were collected, or received with time=received.
 func MetricsGet(c *gin.Context) {
 
 	ptrs, err := mustGetAll(c)
@@ -26,50 +150,540 @@ func MetricsGet(c *gin.Context) {
 		return
 	}
 
-	// gets the device id from query string
+	device := ownedDevice(c, ptrs)
+	if device == nil {
+		return
+	}
+
+	start, end, ok := metricsRange(c)
+	if !ok {
+		return
+	}
+
+	timeField, ok := metricsTimeField(c)
+	if !ok {
+		return
+	}
+
+	pageSize := defaultMetricsPageSize
+	if strPageSize := c.Query("ps"); strPageSize != "" {
+		pageSize, err = strconv.Atoi(strPageSize)
+		if err != nil || pageSize <= 0 {
+			c.AbortWithStatusJSON(http.StatusBadRequest, map[string]string{"error": "page size parameter is invalid"})
+			return
+		}
+		if pageSize > maxMetricsPageSize {
+			pageSize = maxMetricsPageSize
+		}
+	}
+
+	filter := metricsFilter(ptrs, device, timeField, start, end)
+
+	// the readings after the last one of the previous page
+	if cursor := c.Query("cursor"); cursor != "" {
+
+		lastTime, lastID, err := decodeMetricsCursor(cursor, timeField)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, map[string]string{"error": "cursor parameter is invalid"})
+			return
+		}
+
+		filter = append(filter, bson.E{Key: "$or", Value: bson.A{
+			bson.D{{Key: timeField, Value: bson.D{{Key: "$gt", Value: lastTime}}}},
+			bson.D{{Key: timeField, Value: lastTime}, {Key: "_id", Value: bson.D{{Key: "$gt", Value: lastID}}}},
+		}})
+	}
+
+	// one more reading to know if there's a next page
+	findOptions := options.Find().
+		SetSort(bson.D{{Key: timeField, Value: 1}, {Key: "_id", Value: 1}}).
+		SetLimit(int64(pageSize + 1))
+
+	cursor, err := ptrs.Db.GetCollection("metrics").Find(context.TODO(), filter, findOptions)
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	page := MetricsPage{
+		DeviceID: device.ID,
+		Start:    start,
+		End:      end,
+		Metrics:  make([]Metric, 0),
+	}
+
+	if err := cursor.All(context.TODO(), &page.Metrics); err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	if len(page.Metrics) > pageSize {
+		page.Metrics = page.Metrics[:pageSize]
+		last := page.Metrics[pageSize-1]
+		lastTime := last.CollectedAt
+		if timeField == timeseries.ReceivedField {
+			lastTime = last.Received
+		}
+		page.Next = encodeMetricsCursor(timeField, lastTime, last.ID)
+	}
+
+	c.JSON(http.StatusOK, &page)
+}
+
+// MetricsSeriesGet returns the min, max, average and count of the numeric
+// sensors of a device from start (inclusive) to end (exclusive) in buckets
+// of 1m, 5m, 1h or 1d, the buckets without readings are omitted. The
+// readings are bucketed by the time they were collected, or received
+// with time=received. The 1h and 1d buckets of the collection time are
+// read from the rollups kept by the consumers, with the doors openings
+// and open time. With auto the resolution is chosen for the range to
+// have at most points buckets.
+func MetricsSeriesGet(c *gin.Context) {
+
+	ptrs, err := mustGetAll(c)
+	if err != nil {
+		return
+	}
+
+	device := ownedDevice(c, ptrs)
+	if device == nil {
+		return
+	}
+
+	start, end, ok := metricsRange(c)
+	if !ok {
+		return
+	}
+
+	timeField, ok := metricsTimeField(c)
+	if !ok {
+		return
+	}
+
+	bucketName := c.Params.ByName("bucket")
+	auto := bucketName == autoResolution
+
+	if auto {
+
+		points := defaultMetricsPoints
+		if strPoints := c.Query("points"); strPoints != "" {
+			points, err = strconv.Atoi(strPoints)
+			if err != nil || points <= 0 || points > maxMetricsBuckets {
+				c.AbortWithStatusJSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("points parameter must be between 1 and %d", maxMetricsBuckets)})
+				return
+			}
+		}
+
+		if bucketName, err = metricsResolution(ptrs, device, timeField, start, end, points); err != nil {
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+	}
+
+	series := MetricsSeries{
+		DeviceID: device.ID,
+		Start:    start,
+		End:      end,
+		Bucket:   bucketName,
+	}
+
+	// the readings are only returned when counted by auto
+	if auto && bucketName == rawResolution {
+
+		if series.Series, err = rawSeries(ptrs, device, timeField, start, end); err != nil {
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		c.JSON(http.StatusOK, &series)
+		return
+	}
+
+	bucket, ok := metricsBuckets[bucketName]
+	if !ok {
+		c.AbortWithStatusJSON(http.StatusBadRequest, map[string]string{"error": "bucket parameter must be one of 1m, 5m, 1h, 1d or auto"})
+		return
+	}
+
+	if end.Sub(start)/bucket.size > maxMetricsBuckets {
+		c.AbortWithStatusJSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("the range has more than %d buckets of %s", maxMetricsBuckets, bucketName)})
+		return
+	}
+
+	// the rollups are only bucketed by the collection time
+	if bucket.rollups != "" && timeField == timeseries.TimeField {
+		series.Series, err = rollupSeries(ptrs, device, bucket, start, end)
+	} else {
+		series.Series, err = aggregateSeries(ptrs, device, timeField, bucket, start, end)
+	}
+
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(http.StatusOK, &series)
+}
+
+// metricsResolution returns the finest resolution with at most points
+// buckets in a range, the readings themselves if there are at most points
+// readings, and 1d if even 1d has more buckets
+func metricsResolution(ptrs *Variables, device *Device, timeField string, start time.Time, end time.Time, points int) (string, error) {
+
+	limit := int64(points + 1)
+	count, err := ptrs.Db.GetCollection("metrics").CountDocuments(context.TODO(), metricsFilter(ptrs, device, timeField, start, end), &options.CountOptions{Limit: &limit})
+	if err != nil {
+		return "", err
+	}
+
+	if count <= int64(points) {
+		return rawResolution, nil
+	}
+
+	for _, name := range metricsResolutions {
+		if end.Sub(start)/metricsBuckets[name].size <= time.Duration(points) {
+			return name, nil
+		}
+	}
+
+	return metricsResolutions[len(metricsResolutions)-1], nil
+}
+
+// rawSeries returns the readings in a range as buckets of one reading
+func rawSeries(ptrs *Variables, device *Device, timeField string, start time.Time, end time.Time) ([]MetricsBucket, error) {
+
+	findOptions := options.Find().SetSort(bson.D{{Key: timeField, Value: 1}, {Key: "_id", Value: 1}})
+
+	cursor, err := ptrs.Db.GetCollection("metrics").Find(context.TODO(), metricsFilter(ptrs, device, timeField, start, end), findOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	metrics := make([]Metric, 0)
+	if err := cursor.All(context.TODO(), &metrics); err != nil {
+		return nil, err
+	}
+
+	series := make([]MetricsBucket, 0, len(metrics))
+	for _, metric := range metrics {
+
+		point := MetricsBucket{
+			Time:    metric.CollectedAt,
+			Count:   1,
+			Sensors: make(map[string]SensorStats),
+		}
+		if timeField == timeseries.ReceivedField {
+			point.Time = metric.Received
+		}
+
+		for name, reading := range metric.Sensors {
+			if value, ok := sensorValue(reading); ok {
+				point.Sensors[name] = SensorStats{Min: value, Max: value, Avg: value, Count: 1}
+			}
+		}
+
+		series = append(series, point)
+	}
+
+	return series, nil
+}
+
+// aggregateSeries computes the buckets of a range from the readings
+func aggregateSeries(ptrs *Variables, device *Device, timeField string, bucket metricsBucket, start time.Time, end time.Time) ([]MetricsBucket, error) {
+
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: metricsFilter(ptrs, device, timeField, start, end)}},
+		// one document per sensor reading in its bucket
+		{{Key: "$project", Value: bson.D{
+			{Key: "time", Value: bson.D{{Key: "$dateTrunc", Value: bson.D{
+				{Key: "date", Value: "$" + timeField},
+				{Key: "unit", Value: bucket.unit},
+				{Key: "binSize", Value: bucket.binSize},
+			}}}},
+			{Key: "sensors", Value: bson.D{{Key: "$objectToArray", Value: "$sensors"}}},
+		}}},
+		{{Key: "$unwind", Value: "$sensors"}},
+		// the numeric sensors report a number or a CurrentValue
+		{{Key: "$project", Value: bson.D{
+			{Key: "time", Value: 1},
+			{Key: "sensor", Value: "$sensors.k"},
+			{Key: "value", Value: bson.D{{Key: "$cond", Value: bson.A{
+				bson.D{{Key: "$isNumber", Value: "$sensors.v"}},
+				"$sensors.v",
+				"$sensors.v.CurrentValue",
+			}}}},
+		}}},
+		{{Key: "$match", Value: bson.D{{Key: "value", Value: bson.D{{Key: "$type", Value: "number"}}}}}},
+		{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: bson.D{{Key: "time", Value: "$time"}, {Key: "sensor", Value: "$sensor"}}},
+			{Key: "min", Value: bson.D{{Key: "$min", Value: "$value"}}},
+			{Key: "max", Value: bson.D{{Key: "$max", Value: "$value"}}},
+			{Key: "avg", Value: bson.D{{Key: "$avg", Value: "$value"}}},
+			{Key: "count", Value: bson.D{{Key: "$sum", Value: 1}}},
+		}}},
+		// one document per bucket with the statistics of each sensor
+		{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: "$_id.time"},
+			{Key: "sensors", Value: bson.D{{Key: "$push", Value: bson.D{
+				{Key: "k", Value: "$_id.sensor"},
+				{Key: "v", Value: bson.D{
+					{Key: "min", Value: "$min"},
+					{Key: "max", Value: "$max"},
+					{Key: "avg", Value: "$avg"},
+					{Key: "count", Value: "$count"},
+				}},
+			}}}},
+		}}},
+		{{Key: "$project", Value: bson.D{
+			{Key: "_id", Value: 0},
+			{Key: "time", Value: "$_id"},
+			{Key: "sensors", Value: bson.D{{Key: "$arrayToObject", Value: "$sensors"}}},
+		}}},
+		{{Key: "$sort", Value: bson.D{{Key: "time", Value: 1}}}},
+	}
+
+	cursor, err := ptrs.Db.GetCollection("metrics").Aggregate(context.TODO(), pipeline)
+	if err != nil {
+		return nil, err
+	}
+
+	series := make([]MetricsBucket, 0)
+	if err := cursor.All(context.TODO(), &series); err != nil {
+		return nil, err
+	}
+
+	return series, nil
+}
+
+// rollupSeries reads the buckets of a range from the rollups, the buckets
+// are whole hours or days so the first one can start before the range
+func rollupSeries(ptrs *Variables, device *Device, bucket metricsBucket, start time.Time, end time.Time) ([]MetricsBucket, error) {
+
+	filter := bson.D{{Key: "deviceId", Value: device.ID}}
+	if !ptrs.User.Admin {
+		filter = append(filter, bson.E{Key: "userId", Value: ptrs.User.ID})
+	}
+	filter = append(filter, bson.E{Key: "time", Value: bson.D{
+		{Key: "$gte", Value: start.Truncate(bucket.size)},
+		{Key: "$lt", Value: end},
+	}})
+
+	cursor, err := ptrs.Db.GetCollection(bucket.rollups).Find(context.TODO(), filter, options.Find().SetSort(bson.D{{Key: "time", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+
+	rollups := make([]Rollup, 0)
+	if err := cursor.All(context.TODO(), &rollups); err != nil {
+		return nil, err
+	}
+
+	series := make([]MetricsBucket, 0, len(rollups))
+	for _, rollup := range rollups {
+
+		point := MetricsBucket{
+			Time:    rollup.Time,
+			Count:   rollup.Count,
+			Sensors: make(map[string]SensorStats),
+		}
+
+		for name, stats := range rollup.Sensors {
+			if stats.Count > 0 {
+				point.Sensors[name] = SensorStats{Min: stats.Min, Max: stats.Max, Avg: stats.Sum / float64(stats.Count), Count: stats.Count}
+			}
+		}
+
+		if len(rollup.Doors) > 0 {
+			point.Doors = make(map[string]DoorStats)
+			for name, openings := range rollup.Doors {
+				point.Doors[name] = doorStats(openings, rollup.Time, rollup.Time.Add(bucket.size))
+			}
+		}
+
+		series = append(series, point)
+	}
+
+	return series, nil
+}
+
+// doorStats counts the openings of a door in a bucket and sums the time it
+// was open, from when it opened or the bucket started to when it was last
+// seen open in the bucket
+func doorStats(openings map[string]time.Time, bucketStart time.Time, bucketEnd time.Time) DoorStats {
+
+	stats := DoorStats{}
+
+	for opening, last := range openings {
+
+		millis, err := strconv.ParseInt(opening, 10, 64)
+		if err != nil {
+			continue
+		}
+
+		openedAt := time.UnixMilli(millis).UTC()
+		if !openedAt.Before(bucketStart) && openedAt.Before(bucketEnd) {
+			stats.Openings++
+		}
+
+		if openedAt.Before(bucketStart) {
+			openedAt = bucketStart
+		}
+		if last.After(openedAt) {
+			stats.OpenTime += last.Sub(openedAt).Milliseconds()
+		}
+	}
+
+	return stats
+}
+
+// sensorValue returns the value of a numeric sensor, a number
+// or an object with the value in CurrentValue
+func sensorValue(reading interface{}) (float64, bool) {
+
+	switch value := reading.(type) {
+	case float64:
+		return value, true
+	case int32:
+		return float64(value), true
+	case int64:
+		return float64(value), true
+	case map[string]interface{}:
+		return sensorValue(value["CurrentValue"])
+	case primitive.M:
+		return sensorValue(value["CurrentValue"])
+	case primitive.D:
+		for _, field := range value {
+			if field.Key == "CurrentValue" {
+				return sensorValue(field.Value)
+			}
+		}
+	}
+
+	return 0, false
+}
+
+// ownedDevice returns the device in the id parameter if it belongs to the
+// logged user, the admin can read any device
+func ownedDevice(c *gin.Context, ptrs *Variables) *Device {
+
 	id := idQuery(c)
 	if id == nil {
-		return
+		return nil
 	}
 
+	filter := bson.D{{Key: "_id", Value: id}, {Key: "userId", Value: ptrs.User.ID}}
+	if ptrs.User.Admin {
+		filter = bson.D{{Key: "_id", Value: id}}
+	}
+
+	device := &Device{}
+	if err := ptrs.Db.GetCollection("devices").FindOne(context.TODO(), filter).Decode(device); err != nil {
+		if err == mongo.ErrNoDocuments {
+			c.AbortWithStatus(http.StatusNotFound)
+			return nil
+		}
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return nil
+	}
+
+	return device
+}
+
+// metricsRange parses the start and end parameters
+func metricsRange(c *gin.Context) (time.Time, time.Time, bool) {
+
 	strStart := c.Params.ByName("start")
 	if strStart == "" {
 		c.AbortWithStatusJSON(http.StatusBadRequest, map[string]string{"error": "start date/time parameter is required"})
-		return
+		return time.Time{}, time.Time{}, false
 	}
 
 	strEnd := c.Params.ByName("end")
 	if strEnd == "" {
 		c.AbortWithStatusJSON(http.StatusBadRequest, map[string]string{"error": "end date/time parameter is required"})
-		return
+		return time.Time{}, time.Time{}, false
 	}
 
-	start, err := time.Parse(defaultDataFormat, strStart)
+	start, err := time.Parse(metricsTimeFormat, strStart)
 	if err != nil {
 		c.AbortWithStatusJSON(http.StatusBadRequest, map[string]string{"error": "start date/time parameter is invalid"})
-		return
+		return time.Time{}, time.Time{}, false
 	}
 
-	end, err := time.Parse(defaultDataFormat, strEnd)
+	end, err := time.Parse(metricsTimeFormat, strEnd)
 	if err != nil {
 		c.AbortWithStatusJSON(http.StatusBadRequest, map[string]string{"error": "end date/time parameter is invalid"})
-		return
+		return time.Time{}, time.Time{}, false
+	}
+
+	if end.Before(start) {
+		start, end = end, start
 	}
 
-	filter := bson.D{{Key: "metrics.deviceId", Value: id}}
+	return start.UTC(), end.UTC(), true
+}
+
+// metricsTimeField returns the time field in the time parameter
+func metricsTimeField(c *gin.Context) (string, bool) {
 
-	if end.Sub(start) < 0 {
-		tempStart := start
-		start = end
-		end = tempStart
+	timeField, ok := metricsTimeFields[c.DefaultQuery("time", "collectedAt")]
+	if !ok {
+		c.AbortWithStatusJSON(http.StatusBadRequest, map[string]string{"error": "time parameter must be collectedAt or received"})
+		return "", false
 	}
 
+	return timeField, true
+}
+
+// metricsFilter filters the readings of a device in a time range, the
+// readings stored while the device belonged to another user are hidden
+func metricsFilter(ptrs *Variables, device *Device, timeField string, start time.Time, end time.Time) bson.D {
+
+	filter := bson.D{{Key: timeseries.MetaField + ".deviceId", Value: device.ID}}
+
 	if !ptrs.User.Admin {
-		filter = append(filter, bson.E{Key: "userId", Value: ptrs.User.ID})
+		filter = append(filter, bson.E{Key: timeseries.MetaField + ".userId", Value: ptrs.User.ID})
 	}
 
-	filter = append(filter, bson.E{Key: "metric.collectedAt", Value: bson.E{Key: "$gte", Value: start}})
-	filter = append(filter, bson.E{Key: "metric.collectedAt", Value: bson.E{Key: "$lte", Value: end}})
+	filter = append(filter, bson.E{Key: timeField, Value: bson.D{
+		{Key: "$gte", Value: start},
+		{Key: "$lt", Value: end},
+	}})
+
+	return filter
+}
+
+// encodeMetricsCursor encodes the time field, time and id of the last reading of a page
+func encodeMetricsCursor(timeField string, last time.Time, id primitive.ObjectID) string {
+
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%s:%d:%s", timeField, last.UnixMilli(), id.Hex())))
+}
+
+// decodeMetricsCursor decodes the time and id of the last reading of a page,
+// the cursor must be of the same time field
+func decodeMetricsCursor(cursor string, timeField string) (time.Time, primitive.ObjectID, error) {
+
+	bytes, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return time.Time{}, primitive.NilObjectID, err
+	}
+
+	parts := strings.Split(string(bytes), ":")
+	if len(parts) != 3 || parts[0] != timeField {
+		return time.Time{}, primitive.NilObjectID, fmt.Errorf("invalid cursor")
+	}
+
+	strTime, strID := parts[1], parts[2]
+
+	millis, err := strconv.ParseInt(strTime, 10, 64)
+	if err != nil {
+		return time.Time{}, primitive.NilObjectID, err
+	}
+
+	id, err := primitive.ObjectIDFromHex(strID)
+	if err != nil {
+		return time.Time{}, primitive.NilObjectID, err
+	}
 
-	c.Status(http.StatusOK)
+	return time.UnixMilli(millis).UTC(), id, nil
 }
@@ -0,0 +1,115 @@
+package controllers
+
+import (
+	"encoding/base64"
+	"strconv"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestMetricsCursor(t *testing.T) {
+
+	id, _ := primitive.ObjectIDFromHex("65ba1f0c2b9e4a6f1c3d5e70")
+	last := time.Date(2024, 1, 31, 10, 0, 1, 0, time.UTC)
+
+	tests := []struct {
+		name      string
+		timeField string
+		last      time.Time
+	}{
+		{"collection time", "collectedAt", last},
+		{"receive time", "received", last},
+		{"milliseconds", "collectedAt", last.Add(123 * time.Millisecond)},
+		{"other time zone", "collectedAt", last.In(time.FixedZone("UTC+1", 3600))},
+		{"before 1970", "collectedAt", time.Date(1969, 12, 31, 23, 59, 59, 0, time.UTC)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			cursor := encodeMetricsCursor(tt.timeField, tt.last, id)
+
+			gotTime, gotID, err := decodeMetricsCursor(cursor, tt.timeField)
+			if err != nil {
+				t.Fatalf("failed to decode cursor %s: %s", cursor, err.Error())
+			}
+			if !gotTime.Equal(tt.last) || gotTime.Location() != time.UTC {
+				t.Errorf("decoded time %s, want %s in UTC", gotTime, tt.last)
+			}
+			if gotID != id {
+				t.Errorf("decoded id %s, want %s", gotID.Hex(), id.Hex())
+			}
+		})
+	}
+}
+
+func TestMetricsCursorInvalid(t *testing.T) {
+
+	id, _ := primitive.ObjectIDFromHex("65ba1f0c2b9e4a6f1c3d5e70")
+	last := time.Date(2024, 1, 31, 10, 0, 1, 0, time.UTC)
+
+	encode := func(s string) string {
+		return base64.RawURLEncoding.EncodeToString([]byte(s))
+	}
+
+	tests := []struct {
+		name   string
+		cursor string
+	}{
+		{"other time field", encodeMetricsCursor("received", last, id)},
+		{"not base64", "not a cursor!"},
+		{"padded base64", base64.URLEncoding.EncodeToString([]byte("collectedAt:1706695201000:65ba1f0c2b9e4a6f1c3d5e70"))},
+		{"missing id", encode("collectedAt:1706695201000")},
+		{"extra part", encode("collectedAt:1706695201000:65ba1f0c2b9e4a6f1c3d5e70:1")},
+		{"invalid time", encode("collectedAt:yesterday:65ba1f0c2b9e4a6f1c3d5e70")},
+		{"invalid id", encode("collectedAt:1706695201000:65ba1f0c")},
+		{"empty", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			if _, _, err := decodeMetricsCursor(tt.cursor, "collectedAt"); err == nil {
+				t.Errorf("cursor %q was accepted", tt.cursor)
+			}
+		})
+	}
+}
+
+func TestDoorStats(t *testing.T) {
+
+	start := time.Date(2024, 1, 31, 10, 0, 0, 0, time.UTC)
+	end := start.Add(time.Hour)
+	opening := func(openedAt time.Time) string {
+		return strconv.FormatInt(openedAt.UnixMilli(), 10)
+	}
+
+	tests := []struct {
+		name         string
+		openings     map[string]time.Time
+		wantOpenings int64
+		wantOpenTime int64
+	}{
+		{"no openings", map[string]time.Time{}, 0, 0},
+		{"opened in the bucket", map[string]time.Time{opening(start.Add(time.Minute)): start.Add(3 * time.Minute)}, 1, 120000},
+		{"opened before the bucket", map[string]time.Time{opening(start.Add(-time.Minute)): start.Add(2 * time.Minute)}, 0, 120000},
+		{"two openings", map[string]time.Time{
+			opening(start.Add(time.Minute)):      start.Add(2 * time.Minute),
+			opening(start.Add(30 * time.Minute)): start.Add(30*time.Minute + 30*time.Second),
+		}, 2, 90000},
+		{"seen open once", map[string]time.Time{opening(start.Add(time.Minute)): start.Add(time.Minute)}, 1, 0},
+		{"invalid opening", map[string]time.Time{"door": start.Add(time.Minute)}, 0, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			stats := doorStats(tt.openings, start, end)
+			if stats.Openings != tt.wantOpenings || stats.OpenTime != tt.wantOpenTime {
+				t.Errorf("%d openings open for %d ms, want %d openings open for %d ms", stats.Openings, stats.OpenTime, tt.wantOpenings, tt.wantOpenTime)
+			}
+		})
+	}
+}
@@ -13,7 +13,7 @@ import (
 	"go.mongodb.org/mongo-driver/mongo/readpref"
 	"go.mongodb.org/mongo-driver/mongo/writeconcern"
 
-	"github.com/joaoribeirodasilva/mqtt-course/api/tls"
+	"github.com/joaoribeirodasilva/mqtt-course/shared/tls"
 )
 
 type Database struct {
@@ -110,7 +110,7 @@ func (d *Database) Connect() error {
 	if d.conf.Mongo.Tls.Use {
 
 		// create the TLS configuration
-		tlsConf := tls.NewTlsConfig(d.conf.Mongo.Tls.Crt, d.conf.Mongo.Tls.Key, d.conf.Mongo.Tls.Root, true)
+		tlsConf := tls.NewTlsConfig(d.conf.Mongo.Tls.Crt, d.conf.Mongo.Tls.Key, d.conf.Mongo.Tls.Root, d.conf.Mongo.Tls.Insecure)
 		if err := tlsConf.Create(); err != nil {
 			return err
 		}
@@ -5,6 +5,7 @@ import (
 
 	"github.com/joaoribeirodasilva/mqtt-course/api/configuration"
 	"github.com/joaoribeirodasilva/mqtt-course/api/database"
+	"github.com/joaoribeirodasilva/mqtt-course/shared/timeseries"
 )
 
 func main() {
@@ -19,6 +20,11 @@ func main() {
 		log.Fatalln(err)
 	}
 
+	// the metrics time series collection, also created by the consumers
+	if err := timeseries.Setup(db.Database, "metrics", conf.Metrics); err != nil {
+		log.Fatalln(err)
+	}
+
 	http := NewServer(conf)
 	router := NewRouter(http.Router, conf, db)
 
@@ -93,6 +93,20 @@ func (r *Router) SetRoutes() {
 	r.gin.DELETE("/issueddevice/:id", r.Variables, r.IsLogged, r.IsAdmin, controllers.IssuedDeviceList)
 
 	// Metrics related
-	r.gin.GET("/metrics/:device/:start/:end", r.Variables, r.IsLogged, r.IsLogged, controllers.Login)
+	r.gin.GET("/metrics/:id/:start/:end", r.Variables, r.IsLogged, controllers.MetricsGet)
+	r.gin.GET("/metrics/:id/:start/:end/:bucket", r.Variables, r.IsLogged, controllers.MetricsSeriesGet)
+
+	// Alerts related
+	r.gin.GET("/alertrules", r.Variables, r.IsLogged, controllers.AlertRuleList)
+	r.gin.GET("/alertrule/:id", r.Variables, r.IsLogged, controllers.AlertRuleGet)
+	r.gin.POST("/alertrule", r.Variables, r.IsLogged, controllers.AlertRuleAdd)
+	r.gin.PUT("/alertrule/:id", r.Variables, r.IsLogged, controllers.AlertRuleUpdate)
+	r.gin.PATCH("/alertrule/:id", r.Variables, r.IsLogged, controllers.AlertRuleUpdate)
+	r.gin.DELETE("/alertrule/:id", r.Variables, r.IsLogged, controllers.AlertRuleDelete)
+
+	r.gin.GET("/alerts", r.Variables, r.IsLogged, controllers.AlertList)
+	r.gin.GET("/alert/:id", r.Variables, r.IsLogged, controllers.AlertGet)
+	r.gin.PATCH("/alert/:id/acknowledge", r.Variables, r.IsLogged, controllers.AlertAcknowledge)
+	r.gin.PATCH("/alert/:id/resolve", r.Variables, r.IsLogged, controllers.AlertResolve)
 
 }
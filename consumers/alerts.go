@@ -0,0 +1,660 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Alerts evaluates the alert rules of the devices, managed with the API,
+// against the readings as they're stored. The consumers of a group receive
+// the readings of a device in any order, so the condition of each rule is
+// kept in the rule state with conditional updates: the last reading within
+// the limits, and since when and until when the readings broke them. An
+// alert opens when the limits were broken for the rule duration and is
+// resolved by the next reading within the limits, a single consumer opens
+// it by setting its id in the rule state. The rules without data are
+// checked periodically since there's no reading to evaluate.
+type Alerts struct {
+	conf     *Configuration
+	db       *Database
+	broker   *MQTTClient
+	mu       sync.RWMutex
+	rules    map[primitive.ObjectID][]*AlertRule
+	cancel   context.CancelFunc
+	finished chan bool
+}
+
+// AlertRule is a condition on the readings of a device
+type AlertRule struct {
+	ID        primitive.ObjectID `json:"id" bson:"_id"`
+	UserID    primitive.ObjectID `json:"userId" bson:"userId"`
+	DeviceID  primitive.ObjectID `json:"deviceId" bson:"deviceId"`
+	Name      string             `json:"name" bson:"name"`
+	Type      string             `json:"type" bson:"type"`
+	Sensor    string             `json:"sensor" bson:"sensor"`
+	Operator  string             `json:"operator" bson:"operator"`
+	Value     float64            `json:"value" bson:"value"`
+	Duration  int64              `json:"duration" bson:"duration"`
+	Active    bool               `json:"active" bson:"active"`
+	UpdatedAt time.Time          `json:"updatedAt" bson:"updatedAt"`
+	State     AlertRuleState     `json:"state" bson:"state"`
+}
+
+// AlertRuleState is the condition of a rule shared by the consumers
+type AlertRuleState struct {
+	LastOk      *time.Time          `json:"lastOk,omitempty" bson:"lastOk,omitempty"`
+	BreachSince *time.Time          `json:"breachSince,omitempty" bson:"breachSince,omitempty"`
+	BreachLast  *time.Time          `json:"breachLast,omitempty" bson:"breachLast,omitempty"`
+	AlertID     *primitive.ObjectID `json:"alertId,omitempty" bson:"alertId,omitempty"`
+}
+
+// AlertModel is an alert of a rule and its state changes
+type AlertModel struct {
+	ID             primitive.ObjectID `json:"id" bson:"_id"`
+	RuleID         primitive.ObjectID `json:"ruleId" bson:"ruleId"`
+	DeviceID       primitive.ObjectID `json:"deviceId" bson:"deviceId"`
+	UserID         primitive.ObjectID `json:"userId" bson:"userId"`
+	Name           string             `json:"name" bson:"name"`
+	Type           string             `json:"type" bson:"type"`
+	Sensor         string             `json:"sensor,omitempty" bson:"sensor,omitempty"`
+	Value          *float64           `json:"value,omitempty" bson:"value,omitempty"`
+	State          string             `json:"state" bson:"state"`
+	Since          time.Time          `json:"since" bson:"since"`
+	OpenedAt       time.Time          `json:"openedAt" bson:"openedAt"`
+	AcknowledgedAt *time.Time         `json:"acknowledgedAt,omitempty" bson:"acknowledgedAt,omitempty"`
+	ResolvedAt     *time.Time         `json:"resolvedAt,omitempty" bson:"resolvedAt,omitempty"`
+	UpdatedAt      time.Time          `json:"updatedAt" bson:"updatedAt"`
+	History        []AlertEvent       `json:"history" bson:"history"`
+}
+
+// AlertEvent is a state change of an alert
+type AlertEvent struct {
+	State  string              `json:"state" bson:"state"`
+	Time   time.Time           `json:"time" bson:"time"`
+	UserID *primitive.ObjectID `json:"userId,omitempty" bson:"userId,omitempty"`
+	Note   string              `json:"note,omitempty" bson:"note,omitempty"`
+}
+
+// ruleBreach is the breach of a rule in a batch of readings
+type ruleBreach struct {
+	first time.Time
+	since time.Time
+	last  time.Time
+	value *float64
+}
+
+const (
+	alertRulesCollection = "alertrules"
+	alertsCollection     = "alerts"
+
+	alertTypeThreshold = "threshold"
+	alertTypeDoor      = "door"
+	alertTypeNoData    = "noData"
+
+	alertOperatorAbove = "above"
+	alertOperatorBelow = "below"
+
+	alertStateOpen     = "open"
+	alertStateResolved = "resolved"
+
+	defaultAlertRulesRefresh = 10000
+	defaultAlertsNoDataCheck = 30000
+)
+
+// NewAlerts creates a new Alerts struct pointer
+func NewAlerts(conf *Configuration, db *Database, broker *MQTTClient) *Alerts {
+
+	a := &Alerts{}
+
+	a.conf = conf
+	a.db = db
+	a.broker = broker
+	a.rules = make(map[primitive.ObjectID][]*AlertRule)
+
+	return a
+}
+
+// Start loads the active rules and starts refreshing them
+// and checking the rules without data
+func (a *Alerts) Start() {
+
+	if a.cancel != nil {
+		return
+	}
+
+	if err := a.load(); err != nil {
+		log.Printf("ERROR: [ALERTS] failed to load alert rules REASON: %s", err.Error())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	a.cancel = cancel
+	a.finished = make(chan bool, 1)
+
+	go func() {
+
+		a.run(ctx)
+
+		a.finished <- true
+	}()
+}
+
+// Stop stops refreshing the rules and checking the rules without data
+func (a *Alerts) Stop() {
+
+	if a.cancel == nil {
+		return
+	}
+
+	a.cancel()
+	<-a.finished
+	a.cancel = nil
+}
+
+// Evaluate evaluates the rules of the devices of the stored readings
+func (a *Alerts) Evaluate(records []MessageModel) {
+
+	if len(records) == 0 {
+		return
+	}
+
+	byDevice := make(map[primitive.ObjectID][]MessageModel)
+	for _, record := range records {
+		byDevice[record.Meta.DeviceID] = append(byDevice[record.Meta.DeviceID], record)
+	}
+
+	a.mu.RLock()
+	rules := make([]*AlertRule, 0)
+	for deviceID := range byDevice {
+		rules = append(rules, a.rules[deviceID]...)
+	}
+	a.mu.RUnlock()
+
+	for _, rule := range rules {
+
+		lastOk, breach := evaluateRule(rule, byDevice[rule.DeviceID])
+
+		if lastOk != nil {
+			a.clear(rule, *lastOk)
+		}
+
+		if breach != nil {
+			a.breach(rule, breach)
+		}
+	}
+}
+
+// evaluateRule returns the time of the last reading within the limits of
+// a rule and the breach of the readings after it
+func evaluateRule(rule *AlertRule, records []MessageModel) (*time.Time, *ruleBreach) {
+
+	var lastOk *time.Time
+	var breach *ruleBreach
+
+	type condition struct {
+		at     time.Time
+		since  time.Time
+		value  *float64
+		broken bool
+	}
+
+	conditions := make([]condition, 0, len(records))
+	for _, record := range records {
+
+		// a skewed clock doesn't tell when the reading was collected, the
+		// times of the reading are shifted by the offset of the device clock
+		at := record.CollectedAt
+		var shift time.Duration
+		if record.ClockSkewed || rule.Type == alertTypeNoData {
+			at = record.Received
+			shift = record.Received.Sub(record.CollectedAt)
+		}
+
+		broken, since, value, ok := ruleCondition(rule, record.Sensors, at, shift)
+		if !ok {
+			continue
+		}
+
+		conditions = append(conditions, condition{at: at, since: since, value: value, broken: broken})
+
+		if !broken && (lastOk == nil || at.After(*lastOk)) {
+			t := at
+			lastOk = &t
+		}
+	}
+
+	for _, c := range conditions {
+
+		if !c.broken || (lastOk != nil && !c.at.After(*lastOk)) {
+			continue
+		}
+
+		if breach == nil {
+			breach = &ruleBreach{first: c.at, since: c.since, last: c.at, value: c.value}
+			continue
+		}
+
+		if c.at.Before(breach.first) {
+			breach.first = c.at
+		}
+		if c.since.Before(breach.since) {
+			breach.since = c.since
+		}
+		if c.at.After(breach.last) {
+			breach.last = c.at
+			breach.value = c.value
+		}
+	}
+
+	return lastOk, breach
+}
+
+// ruleCondition returns if a reading breaks the limits of a rule, since
+// when and the value of the sensor, ok is false when the reading doesn't
+// have the sensor. The device times of the reading, like the door open time,
+// are shifted to the clock of at. Any reading is within the limits of a rule
+// without data.
+func ruleCondition(rule *AlertRule, sensors interface{}, at time.Time, shift time.Duration) (bool, time.Time, *float64, bool) {
+
+	if rule.Type == alertTypeNoData {
+		return false, at, nil, true
+	}
+
+	fields, ok := sensorFields(sensors)
+	if !ok {
+		return false, at, nil, false
+	}
+
+	reading, ok := fields[rule.Sensor]
+	if !ok {
+		return false, at, nil, false
+	}
+
+	switch rule.Type {
+	case alertTypeThreshold:
+
+		value, ok := sensorValue(reading)
+		if !ok {
+			return false, at, nil, false
+		}
+
+		broken := value > rule.Value
+		if rule.Operator == alertOperatorBelow {
+			broken = value < rule.Value
+		}
+
+		return broken, at, &value, true
+
+	case alertTypeDoor:
+
+		door, ok := sensorFields(reading)
+		if !ok {
+			return false, at, nil, false
+		}
+
+		isOpen, ok := door["IsOpen"].(bool)
+		if !ok {
+			return false, at, nil, false
+		}
+
+		// the door is open since it opened
+		since := at
+		if openTime, ok := sensorTime(door["OpenTime"]); ok && openTime.Add(shift).Before(at) {
+			since = openTime.Add(shift)
+		}
+
+		return isOpen, since, nil, true
+	}
+
+	return false, at, nil, false
+}
+
+// clear records a reading within the limits of a rule, the breach before
+// it ends and its alert is resolved
+func (a *Alerts) clear(rule *AlertRule, at time.Time) {
+
+	at = at.UTC()
+
+	// the breach ends if it started before the reading
+	ended := bson.D{{Key: "$lte", Value: bson.A{"$state.breachSince", at}}}
+	keep := func(field string) bson.D {
+		return bson.D{{Key: "$cond", Value: bson.A{ended, "$$REMOVE", "$state." + field}}}
+	}
+
+	update := mongo.Pipeline{
+		{{Key: "$set", Value: bson.D{
+			{Key: "state.lastOk", Value: bson.D{{Key: "$max", Value: bson.A{"$state.lastOk", at}}}},
+			{Key: "state.breachSince", Value: keep("breachSince")},
+			{Key: "state.breachLast", Value: keep("breachLast")},
+			{Key: "state.alertId", Value: keep("alertId")},
+		}}},
+	}
+
+	filter := append(ruleFilter(rule), bson.E{Key: "$or", Value: bson.A{
+		bson.D{{Key: "state.lastOk", Value: bson.D{{Key: "$exists", Value: false}}}},
+		bson.D{{Key: "state.lastOk", Value: bson.D{{Key: "$lt", Value: at}}}},
+	}})
+
+	before := AlertRule{}
+	err := a.db.GetCollection(alertRulesCollection).FindOneAndUpdate(context.TODO(), filter, update).Decode(&before)
+	if err != nil {
+		if err != mongo.ErrNoDocuments {
+			log.Printf("ERROR: [ALERTS] failed to update rule %s REASON: %s", rule.ID.Hex(), err.Error())
+		}
+		return
+	}
+
+	state := before.State
+	if !okResolves(state, at) {
+		return
+	}
+
+	a.resolve(*state.AlertID, at)
+}
+
+// breach records the readings breaking the limits of a rule and
+// opens an alert if they broke them for the rule duration
+func (a *Alerts) breach(rule *AlertRule, breach *ruleBreach) {
+
+	// the readings before the last one within the limits
+	// were seen by another consumer
+	filter := append(ruleFilter(rule), bson.E{Key: "$or", Value: bson.A{
+		bson.D{{Key: "state.lastOk", Value: bson.D{{Key: "$exists", Value: false}}}},
+		bson.D{{Key: "state.lastOk", Value: bson.D{{Key: "$lt", Value: breach.first.UTC()}}}},
+	}})
+
+	update := bson.D{
+		{Key: "$min", Value: bson.D{{Key: "state.breachSince", Value: breach.since.UTC()}}},
+		{Key: "$max", Value: bson.D{{Key: "state.breachLast", Value: breach.last.UTC()}}},
+	}
+
+	after := AlertRule{}
+	err := a.db.GetCollection(alertRulesCollection).FindOneAndUpdate(context.TODO(), filter, update, options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&after)
+	if err != nil {
+		if err != mongo.ErrNoDocuments {
+			log.Printf("ERROR: [ALERTS] failed to update rule %s REASON: %s", rule.ID.Hex(), err.Error())
+		}
+		return
+	}
+
+	state := after.State
+	if !breachOpens(rule, state) {
+		return
+	}
+
+	a.open(rule, *state.BreachSince, breach.value, bson.D{{Key: "state.breachSince", Value: *state.BreachSince}})
+}
+
+// breachOpens returns true if the breach of a rule state lasted the rule
+// duration and no alert is open for it yet
+func breachOpens(rule *AlertRule, state AlertRuleState) bool {
+
+	if state.AlertID != nil || state.BreachSince == nil || state.BreachLast == nil {
+		return false
+	}
+
+	return state.BreachLast.Sub(*state.BreachSince) >= time.Duration(rule.Duration)*time.Millisecond
+}
+
+// okResolves returns true if a reading within the limits at the given time
+// resolves the open alert of a rule state, the state before the reading
+func okResolves(state AlertRuleState, at time.Time) bool {
+
+	return state.AlertID != nil && state.BreachSince != nil && !state.BreachSince.After(at)
+}
+
+// checkNoData opens the alerts of the rules without data
+// for longer than the rule duration
+func (a *Alerts) checkNoData() {
+
+	a.mu.RLock()
+	rules := make([]*AlertRule, 0)
+	for _, deviceRules := range a.rules {
+		for _, rule := range deviceRules {
+			if rule.Type == alertTypeNoData {
+				rules = append(rules, rule)
+			}
+		}
+	}
+	a.mu.RUnlock()
+
+	now := time.Now().UTC()
+
+	for _, rule := range rules {
+
+		// a rule without readings yet counts from its last change
+		cutoff := now.Add(-time.Duration(rule.Duration) * time.Millisecond)
+		filter := append(ruleFilter(rule),
+			bson.E{Key: "state.alertId", Value: bson.D{{Key: "$exists", Value: false}}},
+			bson.E{Key: "$or", Value: bson.A{
+				bson.D{{Key: "state.lastOk", Value: bson.D{{Key: "$lt", Value: cutoff}}}},
+				bson.D{{Key: "state.lastOk", Value: bson.D{{Key: "$exists", Value: false}}}, {Key: "updatedAt", Value: bson.D{{Key: "$lt", Value: cutoff}}}},
+			}},
+		)
+
+		update := mongo.Pipeline{
+			{{Key: "$set", Value: bson.D{{Key: "state.breachSince", Value: bson.D{{Key: "$ifNull", Value: bson.A{"$state.lastOk", "$updatedAt"}}}}}}},
+		}
+
+		after := AlertRule{}
+		err := a.db.GetCollection(alertRulesCollection).FindOneAndUpdate(context.TODO(), filter, update, options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&after)
+		if err != nil {
+			if err != mongo.ErrNoDocuments {
+				log.Printf("ERROR: [ALERTS] failed to check rule %s REASON: %s", rule.ID.Hex(), err.Error())
+			}
+			continue
+		}
+
+		if after.State.BreachSince == nil {
+			continue
+		}
+
+		a.open(rule, *after.State.BreachSince, nil, bson.D{{Key: "state.breachSince", Value: *after.State.BreachSince}})
+	}
+}
+
+// open opens an alert of a rule if the rule state still matches the breach
+// and no other consumer opened it
+func (a *Alerts) open(rule *AlertRule, since time.Time, value *float64, breach bson.D) {
+
+	now := time.Now().UTC()
+
+	alert := &AlertModel{
+		ID:        primitive.NewObjectID(),
+		RuleID:    rule.ID,
+		DeviceID:  rule.DeviceID,
+		UserID:    rule.UserID,
+		Name:      rule.Name,
+		Type:      rule.Type,
+		Sensor:    rule.Sensor,
+		Value:     value,
+		State:     alertStateOpen,
+		Since:     since.UTC(),
+		OpenedAt:  now,
+		UpdatedAt: now,
+		History:   []AlertEvent{{State: alertStateOpen, Time: now, Note: ruleDescription(rule)}},
+	}
+
+	// the alert is saved before the rule references it, so a consumer
+	// resolving it right after always finds it
+	if _, err := a.db.GetCollection(alertsCollection).InsertOne(context.TODO(), alert); err != nil {
+		log.Printf("ERROR: [ALERTS] failed to save alert of rule %s into database REASON: %s", rule.ID.Hex(), err.Error())
+		return
+	}
+
+	filter := append(ruleFilter(rule), bson.E{Key: "state.alertId", Value: bson.D{{Key: "$exists", Value: false}}})
+	filter = append(filter, breach...)
+
+	result, err := a.db.GetCollection(alertRulesCollection).UpdateOne(context.TODO(), filter, bson.D{{Key: "$set", Value: bson.D{{Key: "state.alertId", Value: alert.ID}}}})
+	if err != nil || result.ModifiedCount == 0 {
+
+		if err != nil {
+			log.Printf("ERROR: [ALERTS] failed to update rule %s REASON: %s", rule.ID.Hex(), err.Error())
+		}
+
+		// another consumer opened the alert or the rule changed
+		if _, err := a.db.GetCollection(alertsCollection).DeleteOne(context.TODO(), bson.D{{Key: "_id", Value: alert.ID}}); err != nil {
+			log.Printf("ERROR: [ALERTS] failed to delete alert %s REASON: %s", alert.ID.Hex(), err.Error())
+		}
+		return
+	}
+
+	log.Printf("WARNING: [ALERTS] alert %s opened for device %s: %s", alert.ID.Hex(), rule.DeviceID.Hex(), alert.History[0].Note)
+
+	a.publish(alert)
+}
+
+// resolve resolves an open or acknowledged alert
+func (a *Alerts) resolve(alertID primitive.ObjectID, at time.Time) {
+
+	now := time.Now().UTC()
+
+	filter := bson.D{{Key: "_id", Value: alertID}, {Key: "state", Value: bson.D{{Key: "$ne", Value: alertStateResolved}}}}
+	update := bson.D{
+		{Key: "$set", Value: bson.D{
+			{Key: "state", Value: alertStateResolved},
+			{Key: "resolvedAt", Value: now},
+			{Key: "updatedAt", Value: now},
+		}},
+		{Key: "$push", Value: bson.D{{Key: "history", Value: AlertEvent{
+			State: alertStateResolved,
+			Time:  now,
+			Note:  fmt.Sprintf("back within the limits at %s", at.Format(time.RFC3339)),
+		}}}},
+	}
+
+	alert := &AlertModel{}
+	err := a.db.GetCollection(alertsCollection).FindOneAndUpdate(context.TODO(), filter, update, options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(alert)
+	if err != nil {
+		if err != mongo.ErrNoDocuments {
+			log.Printf("ERROR: [ALERTS] failed to resolve alert %s REASON: %s", alertID.Hex(), err.Error())
+		}
+		return
+	}
+
+	log.Printf("INFO: [ALERTS] alert %s of device %s resolved", alert.ID.Hex(), alert.DeviceID.Hex())
+
+	a.publish(alert)
+}
+
+// publish publishes an alert to the alerts topic if one is set
+func (a *Alerts) publish(alert *AlertModel) {
+
+	if a.conf.Alerts.Topic == "" || a.broker == nil {
+		return
+	}
+
+	bytes, err := json.Marshal(alert)
+	if err != nil {
+		log.Printf("ERROR: [ALERTS] failed to create alert message REASON: %s", err.Error())
+		return
+	}
+
+	if !a.broker.IsConnected() {
+		log.Printf("WARNING: [ALERTS] not connected to the MQTT Broker, alert %s not published", alert.ID.Hex())
+		return
+	}
+
+	if err := a.broker.PublishTo(a.conf.Alerts.Topic, a.conf.Alerts.Qos, bytes); err != nil {
+		log.Printf("ERROR: [ALERTS] failed to publish alert %s REASON: %s", alert.ID.Hex(), err.Error())
+	}
+}
+
+// run refreshes the rules and checks the rules without
+// data until the context is canceled
+func (a *Alerts) run(ctx context.Context) {
+
+	refresh := a.conf.Alerts.RefreshInterval
+	if refresh <= 0 {
+		refresh = defaultAlertRulesRefresh
+	}
+
+	check := a.conf.Alerts.NoDataCheck
+	if check <= 0 {
+		check = defaultAlertsNoDataCheck
+	}
+
+	refreshTicker := time.NewTicker(time.Duration(refresh) * time.Millisecond)
+	defer refreshTicker.Stop()
+
+	checkTicker := time.NewTicker(time.Duration(check) * time.Millisecond)
+	defer checkTicker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-refreshTicker.C:
+			if err := a.load(); err != nil {
+				log.Printf("WARNING: [ALERTS] failed to refresh alert rules REASON: %s", err.Error())
+			}
+		case <-checkTicker.C:
+			a.checkNoData()
+		}
+	}
+}
+
+// load replaces the rules with the active rules in the database
+func (a *Alerts) load() error {
+
+	cursor, err := a.db.GetCollection(alertRulesCollection).Find(context.TODO(), bson.D{{Key: "active", Value: true}})
+	if err != nil {
+		return err
+	}
+
+	found := make([]*AlertRule, 0)
+	if err := cursor.All(context.TODO(), &found); err != nil {
+		return err
+	}
+
+	rules := make(map[primitive.ObjectID][]*AlertRule)
+	for _, rule := range found {
+		rules[rule.DeviceID] = append(rules[rule.DeviceID], rule)
+	}
+
+	a.mu.Lock()
+	a.rules = rules
+	a.mu.Unlock()
+
+	if a.conf.Options.debug {
+		log.Printf("INFO: [ALERTS] loaded %d alert rules", len(found))
+	}
+
+	return nil
+}
+
+// ruleFilter returns the filter of a rule as it was loaded, the state of
+// a rule changed or disabled since isn't updated with its previous condition
+func ruleFilter(rule *AlertRule) bson.D {
+
+	return bson.D{
+		{Key: "_id", Value: rule.ID},
+		{Key: "active", Value: true},
+		{Key: "updatedAt", Value: rule.UpdatedAt},
+	}
+}
+
+// ruleDescription describes the condition of a rule
+func ruleDescription(rule *AlertRule) string {
+
+	duration := time.Duration(rule.Duration) * time.Millisecond
+
+	switch rule.Type {
+	case alertTypeThreshold:
+		return fmt.Sprintf("%s %s %g for %s", rule.Sensor, rule.Operator, rule.Value, duration)
+	case alertTypeDoor:
+		return fmt.Sprintf("%s open for %s", rule.Sensor, duration)
+	case alertTypeNoData:
+		return fmt.Sprintf("no data for %s", duration)
+	}
+
+	return rule.Type
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// testReading returns a stored reading of a temperature and a door sensor,
+// received a second after it was collected or later for a skewed clock
+func testReading(collectedAt time.Time, temperature float64, openTime *time.Time, skew time.Duration) MessageModel {
+
+	door := map[string]interface{}{"IsOpen": openTime != nil}
+	if openTime != nil {
+		door["OpenTime"] = openTime.Format(time.RFC3339Nano)
+	}
+
+	return MessageModel{
+		Sensors: map[string]interface{}{
+			"temperature": map[string]interface{}{"CurrentValue": temperature},
+			"door":        door,
+		},
+		CollectedAt: collectedAt,
+		Received:    collectedAt.Add(time.Second + skew),
+		ClockSkewed: skew != 0,
+	}
+}
+
+func TestEvaluateRule(t *testing.T) {
+
+	start := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)
+	at := func(seconds int) time.Time { return start.Add(time.Duration(seconds) * time.Second) }
+	opened := at(-30)
+	// a device clock an hour behind reports its door opened an hour ago
+	skewedOpened := at(-30).Add(-time.Hour)
+
+	above := &AlertRule{Type: alertTypeThreshold, Sensor: "temperature", Operator: alertOperatorAbove, Value: -10}
+	below := &AlertRule{Type: alertTypeThreshold, Sensor: "temperature", Operator: alertOperatorBelow, Value: -30}
+	door := &AlertRule{Type: alertTypeDoor, Sensor: "door"}
+	missing := &AlertRule{Type: alertTypeThreshold, Sensor: "humidity", Value: 80}
+
+	tests := []struct {
+		name       string
+		rule       *AlertRule
+		records    []MessageModel
+		wantLastOk *time.Time
+		wantBreach bool
+		wantFirst  time.Time
+		wantSince  time.Time
+		wantLast   time.Time
+		wantValue  float64
+	}{
+		{
+			name:       "within the limits",
+			rule:       above,
+			records:    []MessageModel{testReading(at(0), -20, nil, 0), testReading(at(10), -18, nil, 0)},
+			wantLastOk: timePtr(at(10)),
+		},
+		{
+			name:       "above",
+			rule:       above,
+			records:    []MessageModel{testReading(at(0), -20, nil, 0), testReading(at(10), -5, nil, 0), testReading(at(20), -2, nil, 0)},
+			wantLastOk: timePtr(at(0)),
+			wantBreach: true, wantFirst: at(10), wantSince: at(10), wantLast: at(20), wantValue: -2,
+		},
+		{
+			name:       "below",
+			rule:       below,
+			records:    []MessageModel{testReading(at(0), -35, nil, 0)},
+			wantBreach: true, wantFirst: at(0), wantSince: at(0), wantLast: at(0), wantValue: -35,
+		},
+		{
+			name:       "back within the limits",
+			rule:       above,
+			records:    []MessageModel{testReading(at(0), -5, nil, 0), testReading(at(10), -20, nil, 0)},
+			wantLastOk: timePtr(at(10)),
+		},
+		{
+			name:       "readings out of order",
+			rule:       above,
+			records:    []MessageModel{testReading(at(20), -2, nil, 0), testReading(at(0), -20, nil, 0), testReading(at(10), -5, nil, 0)},
+			wantLastOk: timePtr(at(0)),
+			wantBreach: true, wantFirst: at(10), wantSince: at(10), wantLast: at(20), wantValue: -2,
+		},
+		{
+			name:       "skewed clock uses the receive time",
+			rule:       above,
+			records:    []MessageModel{testReading(at(0), -5, nil, -time.Hour)},
+			wantBreach: true, wantFirst: at(1).Add(-time.Hour), wantSince: at(1).Add(-time.Hour), wantLast: at(1).Add(-time.Hour), wantValue: -5,
+		},
+		{
+			name:       "door open",
+			rule:       door,
+			records:    []MessageModel{testReading(at(0), -20, &opened, 0), testReading(at(10), -20, &opened, 0)},
+			wantBreach: true, wantFirst: at(0), wantSince: opened, wantLast: at(10),
+		},
+		{
+			name:       "door open with a skewed clock",
+			rule:       door,
+			records:    []MessageModel{testReading(at(0).Add(-time.Hour), -20, &skewedOpened, time.Hour)},
+			wantBreach: true, wantFirst: at(1), wantSince: at(1).Add(-30 * time.Second), wantLast: at(1),
+		},
+		{
+			name:       "door closed",
+			rule:       door,
+			records:    []MessageModel{testReading(at(0), -20, &opened, 0), testReading(at(10), -20, nil, 0)},
+			wantLastOk: timePtr(at(10)),
+		},
+		{
+			name:    "sensor missing",
+			rule:    missing,
+			records: []MessageModel{testReading(at(0), -20, nil, 0)},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			lastOk, breach := evaluateRule(tt.rule, tt.records)
+
+			if (lastOk == nil) != (tt.wantLastOk == nil) || (lastOk != nil && !lastOk.Equal(*tt.wantLastOk)) {
+				t.Errorf("last reading within the limits at %v, want %v", lastOk, tt.wantLastOk)
+			}
+
+			if (breach != nil) != tt.wantBreach {
+				t.Fatalf("breach is %+v, want breach %t", breach, tt.wantBreach)
+			}
+			if breach == nil {
+				return
+			}
+
+			if !breach.first.Equal(tt.wantFirst) || !breach.since.Equal(tt.wantSince) || !breach.last.Equal(tt.wantLast) {
+				t.Errorf("breach from %s since %s until %s, want from %s since %s until %s", breach.first, breach.since, breach.last, tt.wantFirst, tt.wantSince, tt.wantLast)
+			}
+			if tt.rule.Type == alertTypeThreshold && (breach.value == nil || *breach.value != tt.wantValue) {
+				t.Errorf("breach value is %v, want %v", breach.value, tt.wantValue)
+			}
+		})
+	}
+}
+
+func TestBreachOpens(t *testing.T) {
+
+	start := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)
+	alertID := primitive.NewObjectID()
+
+	rule := &AlertRule{Duration: 60000}
+
+	tests := []struct {
+		name  string
+		state AlertRuleState
+		want  bool
+	}{
+		{"no breach", AlertRuleState{LastOk: &start}, false},
+		{"shorter than the duration", AlertRuleState{BreachSince: &start, BreachLast: timePtr(start.Add(59 * time.Second))}, false},
+		{"as long as the duration", AlertRuleState{BreachSince: &start, BreachLast: timePtr(start.Add(time.Minute))}, true},
+		{"longer than the duration", AlertRuleState{BreachSince: &start, BreachLast: timePtr(start.Add(time.Hour))}, true},
+		{"alert already open", AlertRuleState{BreachSince: &start, BreachLast: timePtr(start.Add(time.Hour)), AlertID: &alertID}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			if got := breachOpens(rule, tt.state); got != tt.want {
+				t.Errorf("breach opens is %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOkResolves(t *testing.T) {
+
+	start := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)
+	alertID := primitive.NewObjectID()
+
+	tests := []struct {
+		name  string
+		state AlertRuleState
+		at    time.Time
+		want  bool
+	}{
+		{"no alert", AlertRuleState{BreachSince: &start}, start.Add(time.Minute), false},
+		{"reading after the breach", AlertRuleState{BreachSince: &start, AlertID: &alertID}, start.Add(time.Minute), true},
+		{"reading when the breach started", AlertRuleState{BreachSince: &start, AlertID: &alertID}, start, true},
+		{"reading before the breach", AlertRuleState{BreachSince: &start, AlertID: &alertID}, start.Add(-time.Minute), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			if got := okResolves(tt.state, tt.at); got != tt.want {
+				t.Errorf("reading resolves is %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func timePtr(t time.Time) *time.Time {
+
+	return &t
+}
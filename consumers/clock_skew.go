@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ClockSkew estimates the clock offset of each device from the collection
+// and receive times of its readings. The delivery delay only makes a reading
+// look older, so the offset of a device is the largest collection time minus
+// receive time of its readings in a window, this way the readings buffered
+// during an outage aren't taken for a late clock. A device is skewed when
+// the offset is beyond the threshold, the detection is stored in the
+// device clockSkew field and removed when its clock is back in sync.
+// The consumers of a group receive different readings of a device so the
+// stored detection, not the estimation of each consumer, marks its readings.
+type ClockSkew struct {
+	conf    *Configuration
+	db      *Database
+	mu      sync.Mutex
+	devices map[primitive.ObjectID]*deviceClock
+}
+
+// ClockSkewModel is the clock skew of a device
+type ClockSkewModel struct {
+	Offset     int64     `json:"offset" bson:"offset"`
+	DetectedAt time.Time `json:"detectedAt" bson:"detectedAt"`
+}
+
+// deviceClock is the clock offset estimation of a device
+type deviceClock struct {
+	windowStart time.Time
+	maxOffset   time.Duration
+	// the detection reported in the window, used until the
+	// cached device holds it
+	reported *bool
+}
+
+const (
+	defaultClockSkewThreshold = 300000
+)
+
+// NewClockSkew creates a new ClockSkew struct pointer
+func NewClockSkew(conf *Configuration, db *Database) *ClockSkew {
+
+	s := &ClockSkew{}
+
+	s.conf = conf
+	s.db = db
+	s.devices = make(map[primitive.ObjectID]*deviceClock)
+
+	return s
+}
+
+// Observe adds a reading of a device to the estimation of its clock offset
+// and returns if the device clock is skewed
+func (s *ClockSkew) Observe(device *Device, collectedAt time.Time, received time.Time) bool {
+
+	skewed, changed, estimate := s.estimate(device, collectedAt, received)
+
+	if changed {
+		s.report(device.ID, skewed, estimate, received)
+	}
+
+	return skewed
+}
+
+// estimate adds a reading of a device to the estimation of its clock offset
+// and returns if the device clock is skewed, if it changed from the stored
+// detection and the estimated offset
+func (s *ClockSkew) estimate(device *Device, collectedAt time.Time, received time.Time) (bool, bool, time.Duration) {
+
+	threshold := s.threshold()
+	if threshold <= 0 {
+		return false, false, 0
+	}
+
+	offset := collectedAt.Sub(received)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	clock, ok := s.devices[device.ID]
+	if !ok {
+		clock = &deviceClock{windowStart: received, maxOffset: offset}
+		s.devices[device.ID] = clock
+	}
+
+	stored := device.ClockSkew != nil
+	if clock.reported != nil {
+		if *clock.reported == stored {
+			clock.reported = nil
+		} else {
+			stored = *clock.reported
+		}
+	}
+
+	if offset > clock.maxOffset {
+		clock.maxOffset = offset
+	}
+
+	// a reading from the future is always a skewed clock
+	skewed := stored || offset > threshold
+
+	// the window is evaluated when it's over
+	if received.Sub(clock.windowStart) >= threshold {
+
+		skewed = clock.maxOffset > threshold || clock.maxOffset < -threshold
+
+		clock.windowStart = received
+		clock.maxOffset = offset
+		clock.reported = nil
+	}
+
+	changed := skewed != stored
+	if changed {
+		clock.reported = &skewed
+	}
+
+	estimate := clock.maxOffset
+	if offset > estimate {
+		estimate = offset
+	}
+
+	return skewed, changed, estimate
+}
+
+// report stores a device clock skew change in the device, the update is
+// conditional so only the first consumer detecting the change logs it
+func (s *ClockSkew) report(deviceID primitive.ObjectID, skewed bool, offset time.Duration, received time.Time) {
+
+	filter := bson.D{{Key: "_id", Value: deviceID}, {Key: "clockSkew", Value: bson.D{{Key: "$exists", Value: true}}}}
+	update := bson.D{{Key: "$unset", Value: bson.D{{Key: "clockSkew", Value: ""}}}}
+
+	if skewed {
+		filter = bson.D{{Key: "_id", Value: deviceID}, {Key: "clockSkew", Value: bson.D{{Key: "$exists", Value: false}}}}
+		update = bson.D{{Key: "$set", Value: bson.D{{Key: "clockSkew", Value: ClockSkewModel{
+			Offset:     offset.Milliseconds(),
+			DetectedAt: received.UTC(),
+		}}}}}
+	}
+
+	result, err := s.db.GetCollection("devices").UpdateOne(context.TODO(), filter, update)
+	if err != nil {
+		log.Printf("ERROR: [CLOCK SKEW] failed to update device %s clock skew REASON: %s", deviceID.Hex(), err.Error())
+		return
+	}
+
+	if result.ModifiedCount == 0 {
+		return
+	}
+
+	if skewed {
+		log.Printf("WARNING: [CLOCK SKEW] device %s clock is %s off", deviceID.Hex(), offset.Round(time.Second))
+	} else {
+		log.Printf("INFO: [CLOCK SKEW] device %s clock is back in sync", deviceID.Hex())
+	}
+}
+
+// threshold returns the maximum clock offset of a device in sync
+func (s *ClockSkew) threshold() time.Duration {
+
+	threshold := s.conf.ClockSkew.Threshold
+	if threshold == 0 {
+		threshold = defaultClockSkewThreshold
+	}
+
+	return time.Duration(threshold) * time.Millisecond
+}
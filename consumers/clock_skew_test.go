@@ -0,0 +1,100 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestClockSkewEstimate(t *testing.T) {
+
+	start := time.Date(2024, 1, 31, 10, 0, 0, 0, time.UTC)
+
+	// a reading received at the given time after the start from a device
+	// whose clock is offset, stored is the detection held by the device
+	type reading struct {
+		received    time.Duration
+		offset      time.Duration
+		stored      bool
+		wantSkewed  bool
+		wantChanged bool
+	}
+
+	tests := []struct {
+		name     string
+		readings []reading
+	}{
+		{
+			name: "clock in sync",
+			readings: []reading{
+				{0, -time.Second, false, false, false},
+				{30 * time.Second, -time.Second, false, false, false},
+				{time.Minute, -time.Second, false, false, false},
+			},
+		},
+		{
+			name: "reading from the future",
+			readings: []reading{
+				{0, 2 * time.Minute, false, true, true},
+			},
+		},
+		{
+			name: "late clock detected when the window is over",
+			readings: []reading{
+				{0, -2 * time.Minute, false, false, false},
+				{30 * time.Second, -2 * time.Minute, false, false, false},
+				{time.Minute, -2 * time.Minute, false, true, true},
+			},
+		},
+		{
+			name: "buffered readings aren't a late clock",
+			readings: []reading{
+				{0, -5 * time.Minute, false, false, false},
+				{30 * time.Second, -time.Second, false, false, false},
+				{time.Minute, -time.Second, false, false, false},
+			},
+		},
+		{
+			name: "back in sync when the window is over",
+			readings: []reading{
+				{0, -time.Second, true, true, false},
+				{time.Minute, -time.Second, true, false, true},
+			},
+		},
+		{
+			name: "detection kept until the cached device holds it",
+			readings: []reading{
+				{0, 2 * time.Minute, false, true, true},
+				{10 * time.Second, -time.Second, false, true, false},
+				{20 * time.Second, -time.Second, true, true, false},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			conf := &Configuration{}
+			conf.ClockSkew.Threshold = 60000
+
+			s := NewClockSkew(conf, nil)
+			device := &Device{ID: primitive.NewObjectID()}
+
+			for i, r := range tt.readings {
+
+				device.ClockSkew = nil
+				if r.stored {
+					device.ClockSkew = &ClockSkewModel{}
+				}
+
+				received := start.Add(r.received)
+				skewed, changed, _ := s.estimate(device, received.Add(r.offset), received)
+
+				if skewed != r.wantSkewed || changed != r.wantChanged {
+					t.Errorf("reading %d is skewed %t changed %t, want skewed %t changed %t", i, skewed, changed, r.wantSkewed, r.wantChanged)
+				}
+			}
+		})
+	}
+}
@@ -5,15 +5,18 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"strings"
 
+	"github.com/joaoribeirodasilva/mqtt-course/shared/timeseries"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
 type TLSConf struct {
-	Use  bool   `json:"use"`
-	Root string `json:"root"`
-	Crt  string `json:"ctr"`
-	Key  string `json:"key"`
+	Use      bool   `json:"use"`
+	Insecure bool   `json:"insecure"`
+	Root     string `json:"root"`
+	Crt      string `json:"crt"`
+	Key      string `json:"key"`
 }
 
 type MongoCompressorsConf struct {
@@ -65,22 +68,76 @@ type AuthConf struct {
 	Password string `json:"password"`
 }
 
+type WebsocketConf struct {
+	Path    string            `json:"path"`
+	Headers map[string]string `json:"headers"`
+	Proxy   string            `json:"proxy"`
+}
+
 type MQTTConf struct {
-	ClientID       string    `json:"clientId"`
-	Host           string    `json:"host"`
-	Port           int       `json:"port"`
-	Interval       int64     `json:"interval"`
-	Publish        TopicConf `json:"publish"`
-	Subscribe      TopicConf `json:"subscribe"`
-	Authentication AuthConf  `json:"authentication"`
-	Tls            TLSConf   `json:"tls"`
+	ClientID        string        `json:"clientId"`
+	Host            string        `json:"host"`
+	Port            int           `json:"port"`
+	ProtocolVersion int           `json:"protocolVersion"`
+	Transport       string        `json:"transport"`
+	Websocket       WebsocketConf `json:"websocket"`
+	Interval        int64         `json:"interval"`
+	Publish         TopicConf     `json:"publish"`
+	Subscribe       TopicConf     `json:"subscribe"`
+	Group           string        `json:"group"`
+	Session         SessionConf   `json:"session"`
+	Authentication  AuthConf      `json:"authentication"`
+	Tls             TLSConf       `json:"tls"`
+}
+
+type SessionConf struct {
+	CleanSession bool   `json:"cleanSession"`
+	Expiry       uint32 `json:"expiry"`
+}
+
+type PipelineConf struct {
+	QueueSize     int   `json:"queueSize"`
+	QueueTimeout  int64 `json:"queueTimeout"`
+	Workers       int   `json:"workers"`
+	BatchSize     int   `json:"batchSize"`
+	FlushInterval int64 `json:"flushInterval"`
+}
+
+type DeviceCacheConf struct {
+	TTL             int64 `json:"ttl"`
+	NegativeTTL     int64 `json:"negativeTtl"`
+	RefreshInterval int64 `json:"refreshInterval"`
+}
+
+type DeadLettersConf struct {
+	Topic         string `json:"topic"`
+	Qos           byte   `json:"qos"`
+	RetryInterval int64  `json:"retryInterval"`
+	Spool         string `json:"spool"`
+}
+
+type ClockSkewConf struct {
+	Threshold int64 `json:"threshold"`
+}
+
+type AlertsConf struct {
+	Topic           string `json:"topic"`
+	Qos             byte   `json:"qos"`
+	RefreshInterval int64  `json:"refreshInterval"`
+	NoDataCheck     int64  `json:"noDataCheck"`
 }
 
 type Configuration struct {
-	Options  *Options  `json:"-"`
-	ClientID string    `json:"clientId"`
-	Mongo    MongoConf `json:"mongodb"`
-	MQTT     MQTTConf  `json:"mqtt"`
+	Options     *Options        `json:"-"`
+	ClientID    string          `json:"clientId"`
+	Mongo       MongoConf       `json:"mongodb"`
+	MQTT        MQTTConf        `json:"mqtt"`
+	Pipeline    PipelineConf    `json:"pipeline"`
+	DeviceCache DeviceCacheConf `json:"deviceCache"`
+	DeadLetters DeadLettersConf `json:"deadLetters"`
+	Metrics     timeseries.Conf `json:"metrics"`
+	ClockSkew   ClockSkewConf   `json:"clockSkew"`
+	Alerts      AlertsConf      `json:"alerts"`
 }
 
 const (
@@ -111,6 +168,17 @@ func (c *Configuration) Read() error {
 		return fmt.Errorf("ERROR: [CONFIGURATION] failed to parse configuration file: %s REASON: %s", fileName, err.Error())
 	}
 
+	// the group is a single topic level of the shared subscription
+	if strings.ContainsAny(c.MQTT.Group, "/+#") {
+		return fmt.Errorf("ERROR: [CONFIGURATION] invalid consumer group: %s REASON: it can't contain '/', '+' or '#'", c.MQTT.Group)
+	}
+
+	switch c.Metrics.Granularity {
+	case "", "seconds", "minutes", "hours":
+	default:
+		return fmt.Errorf("ERROR: [CONFIGURATION] invalid metrics granularity: %s REASON: it must be seconds, minutes or hours", c.Metrics.Granularity)
+	}
+
 	return nil
 
 }
@@ -7,12 +7,23 @@ import (
 	"strings"
 	"time"
 
+	"github.com/joaoribeirodasilva/mqtt-course/shared/timeseries"
+	"github.com/joaoribeirodasilva/mqtt-course/shared/tls"
+	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 	"go.mongodb.org/mongo-driver/mongo/readpref"
 	"go.mongodb.org/mongo-driver/mongo/writeconcern"
 )
 
+const (
+	// message sequences of the messages already stored
+	sequencesCollection = "metricsequences"
+
+	// how long the sequences are kept when the metrics never expire, 30 days
+	defaultDeduplicationWindow = 30 * 24 * 60 * 60
+)
+
 type Database struct {
 	conf     *Configuration
 	Client   *mongo.Client
@@ -107,7 +118,7 @@ func (d *Database) Connect() error {
 	if d.conf.Mongo.Tls.Use {
 
 		// create the TLS configuration
-		tlsConf := NewTlsConfig(d.conf.Mongo.Tls.Crt, d.conf.Mongo.Tls.Key, d.conf.Mongo.Tls.Root, true)
+		tlsConf := tls.NewTlsConfig(d.conf.Mongo.Tls.Crt, d.conf.Mongo.Tls.Key, d.conf.Mongo.Tls.Root, d.conf.Mongo.Tls.Insecure)
 		if err := tlsConf.Create(); err != nil {
 			return err
 		}
@@ -141,6 +152,109 @@ func (d *Database) Connect() error {
 	return nil
 }
 
+// Setup creates the metrics time series collection, the message
+// sequences collection used to drop the messages stored twice and the
+// rollup and alert indexes. The sequences are kept as long as the metrics, or for
+// the deduplication window when the metrics are kept forever.
+func (d *Database) Setup() error {
+
+	if err := timeseries.Setup(d.Database, "metrics", d.conf.Metrics); err != nil {
+		return err
+	}
+
+	legacy, err := timeseries.HasLegacy(d.Database, "metrics")
+	if err != nil {
+		return err
+	}
+	if legacy {
+		log.Printf("WARNING: [DATABASE] the metrics stored before the time series collection aren't migrated, run: consumers -c %d migrate", d.conf.Options.consumer)
+	}
+
+	expire := d.conf.Metrics.Retention()
+	if expire == 0 {
+		expire = defaultDeduplicationWindow
+	}
+
+	if err := d.ensureTTLIndex(sequencesCollection, "createdAt", expire); err != nil {
+		return err
+	}
+
+	// one bucket per device and time in the rollups
+	for _, resolution := range rollupResolutions {
+
+		index := mongo.IndexModel{
+			Keys:    bson.D{{Key: "deviceId", Value: 1}, {Key: "time", Value: 1}},
+			Options: options.Index().SetName("deviceId_time").SetUnique(true),
+		}
+
+		if _, err := d.GetCollection(resolution.collection).Indexes().CreateOne(context.TODO(), index); err != nil {
+			return fmt.Errorf("ERROR: [DATABASE] failed to create %s index REASON: %s", resolution.collection, err.Error())
+		}
+	}
+
+	// the alerts of a user by state and the history of a rule
+	indexes := []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "userId", Value: 1}, {Key: "state", Value: 1}, {Key: "openedAt", Value: -1}},
+			Options: options.Index().SetName("userId_state_openedAt"),
+		},
+		{
+			Keys:    bson.D{{Key: "ruleId", Value: 1}, {Key: "openedAt", Value: -1}},
+			Options: options.Index().SetName("ruleId_openedAt"),
+		},
+	}
+
+	if _, err := d.GetCollection(alertsCollection).Indexes().CreateMany(context.TODO(), indexes); err != nil {
+		return fmt.Errorf("ERROR: [DATABASE] failed to create %s indexes REASON: %s", alertsCollection, err.Error())
+	}
+
+	return nil
+}
+
+// ensureTTLIndex creates a TTL index on a field or updates its expiry
+func (d *Database) ensureTTLIndex(collection string, field string, expire int64) error {
+
+	name := field + "_ttl"
+
+	specs, err := d.GetCollection(collection).Indexes().ListSpecifications(context.TODO())
+	if err != nil {
+		return fmt.Errorf("ERROR: [DATABASE] failed to read %s indexes REASON: %s", collection, err.Error())
+	}
+
+	for _, spec := range specs {
+
+		if spec.Name != name {
+			continue
+		}
+
+		if spec.ExpireAfterSeconds != nil && int64(*spec.ExpireAfterSeconds) == expire {
+			return nil
+		}
+
+		command := bson.D{
+			{Key: "collMod", Value: collection},
+			{Key: "index", Value: bson.D{{Key: "name", Value: name}, {Key: "expireAfterSeconds", Value: expire}}},
+		}
+
+		if err := d.Database.RunCommand(context.TODO(), command).Err(); err != nil {
+			return fmt.Errorf("ERROR: [DATABASE] failed to update %s index %s REASON: %s", collection, name, err.Error())
+		}
+
+		return nil
+	}
+
+	index := mongo.IndexModel{
+		Keys:    bson.D{{Key: field, Value: 1}},
+		Options: options.Index().SetName(name).SetExpireAfterSeconds(int32(expire)),
+	}
+
+	if _, err := d.GetCollection(collection).Indexes().CreateOne(context.TODO(), index); err != nil {
+		return fmt.Errorf("ERROR: [DATABASE] failed to create %s index %s REASON: %s", collection, name, err.Error())
+	}
+
+	return nil
+}
+
 func (d *Database) GetCollection(name string) *mongo.Collection {
 
 	if d.Database != nil {
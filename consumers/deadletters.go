@@ -0,0 +1,430 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// DeadLetter is a message the consumer couldn't store
+type DeadLetter struct {
+	ID         primitive.ObjectID `json:"id" bson:"_id"`
+	Topic      string             `json:"topic" bson:"topic"`
+	Payload    []byte             `json:"payload" bson:"payload"`
+	Reason     string             `json:"reason" bson:"reason"`
+	Error      string             `json:"error" bson:"error"`
+	DeviceID   primitive.ObjectID `json:"deviceId,omitempty" bson:"deviceId,omitempty"`
+	ConsumerID primitive.ObjectID `json:"consumer" bson:"consumer"`
+	CreatedAt  time.Time          `json:"createdAt" bson:"createdAt"`
+	ReplayedAt *time.Time         `json:"replayedAt,omitempty" bson:"replayedAt,omitempty"`
+	Replays    int                `json:"replays" bson:"replays"`
+}
+
+// DeadLetters stores the messages the consumer couldn't store in the
+// deadletters collection and republishes them to the dead letter topic
+// if one is set. The MQTT callbacks can't wait for the database, that may
+// be the reason of the dead letters, so the dead letters are saved by their
+// own goroutine, retried while the database fails and kept in a spool file
+// when the consumer stops before they're saved. They're republished by
+// another goroutine because the MQTT callbacks can't wait for a publish.
+type DeadLetters struct {
+	conf     *Configuration
+	db       *Database
+	broker   *MQTTClient
+	mu       sync.RWMutex
+	pending  chan *DeadLetter
+	stopping chan bool
+	stored   chan bool
+	failing  bool
+	spoolMu  sync.Mutex
+	spooled  atomic.Bool
+	queue    chan *DeadLetter
+	finished chan bool
+	count    atomic.Uint64
+}
+
+const (
+	reasonInvalidPayload     = "invalidPayload"
+	reasonUnsupportedMessage = "unsupportedMessage"
+	reasonUnknownDevice      = "unknownDevice"
+	reasonStoreFailed        = "storeFailed"
+
+	maxPendingDeadLetters  = 1000
+	defaultDeadLetterRetry = 5000
+
+	// extension of a spool file being saved in the database
+	spoolRecoverExt = ".recovering"
+)
+
+// NewDeadLetters creates a new DeadLetters struct pointer
+func NewDeadLetters(conf *Configuration, db *Database, broker *MQTTClient) *DeadLetters {
+
+	l := &DeadLetters{}
+
+	l.conf = conf
+	l.db = db
+	l.broker = broker
+
+	return l
+}
+
+// Start starts saving the dead letters, beginning with the ones left in the
+// spool file, and republishing them if a dead letter topic is set
+func (l *DeadLetters) Start() {
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.pending != nil {
+		return
+	}
+
+	l.pending = make(chan *DeadLetter, maxPendingDeadLetters)
+	l.stopping = make(chan bool)
+	l.stored = make(chan bool, 1)
+
+	if l.conf.DeadLetters.Topic != "" {
+
+		l.queue = make(chan *DeadLetter, maxPendingDeadLetters)
+		l.finished = make(chan bool, 1)
+
+		go func() {
+
+			for deadLetter := range l.queue {
+				l.publish(deadLetter)
+			}
+
+			l.finished <- true
+		}()
+	}
+
+	go func(pending chan *DeadLetter) {
+
+		l.recoverSpool()
+
+		for deadLetter := range pending {
+			l.store(deadLetter)
+
+			// the dead letters spooled while the database
+			// failed are saved once it's available again
+			if !l.failing && l.spooled.CompareAndSwap(true, false) {
+				l.recoverSpool()
+			}
+		}
+
+		l.stored <- true
+	}(l.pending)
+}
+
+// Stop saves or spools the pending dead letters, publishes them and stops
+func (l *DeadLetters) Stop() {
+
+	l.mu.Lock()
+	if l.pending == nil {
+		l.mu.Unlock()
+		return
+	}
+	close(l.stopping)
+	close(l.pending)
+	l.pending = nil
+	l.mu.Unlock()
+
+	<-l.stored
+
+	if l.queue != nil {
+		close(l.queue)
+		<-l.finished
+		l.queue = nil
+	}
+
+	if count := l.count.Load(); count > 0 {
+		log.Printf("WARNING: [DEAD LETTERS] %d messages stored as dead letters", count)
+	}
+}
+
+// Add stores a message the consumer couldn't store as a dead letter
+func (l *DeadLetters) Add(topic string, payload []byte, deviceID primitive.ObjectID, reason string, err error) {
+
+	deadLetter := &DeadLetter{
+		ID:         primitive.NewObjectID(),
+		Topic:      topic,
+		Payload:    payload,
+		Reason:     reason,
+		DeviceID:   deviceID,
+		ConsumerID: l.conf.Mongo.ClientID,
+		CreatedAt:  time.Now().UTC(),
+	}
+
+	if err != nil {
+		deadLetter.Error = err.Error()
+	}
+
+	l.count.Add(1)
+
+	log.Printf("ERROR: [DEAD LETTERS] message received in %s is a dead letter REASON: %s %s\n", topic, reason, deadLetter.Error)
+
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	// without the saving goroutine the dead letter is saved once
+	if l.pending == nil {
+		if err := l.insert(deadLetter); err != nil {
+			l.spool(deadLetter, err)
+		}
+		return
+	}
+
+	select {
+	case l.pending <- deadLetter:
+	default:
+		l.spool(deadLetter, fmt.Errorf("%d dead letters waiting for the database", cap(l.pending)))
+	}
+}
+
+// store saves a dead letter in the database and queues it to be published,
+// while the database fails it's retried until the consumer stops and then
+// spooled, the dead letters still pending then aren't tried again
+func (l *DeadLetters) store(deadLetter *DeadLetter) {
+
+	retry := l.conf.DeadLetters.RetryInterval
+	if retry <= 0 {
+		retry = defaultDeadLetterRetry
+	}
+
+	for {
+
+		if l.failing && l.isStopping() {
+			l.spool(deadLetter, fmt.Errorf("consumer stopping"))
+			return
+		}
+
+		err := l.insert(deadLetter)
+		if err == nil {
+			if l.failing {
+				log.Println("INFO: [DEAD LETTERS] dead letters saved into database again")
+			}
+			l.failing = false
+			break
+		}
+
+		if !l.failing {
+			log.Printf("ERROR: [DEAD LETTERS] failed to save dead letter into database, retrying every %d ms REASON: %s", retry, err.Error())
+			l.failing = true
+		}
+
+		select {
+		case <-l.stopping:
+		case <-time.After(time.Duration(retry) * time.Millisecond):
+		}
+	}
+
+	if l.queue == nil {
+		return
+	}
+
+	select {
+	case l.queue <- deadLetter:
+	default:
+		log.Printf("WARNING: [DEAD LETTERS] publish queue is full, dead letter %s not published", deadLetter.ID.Hex())
+	}
+}
+
+// insert saves a dead letter in the database, a dead letter already
+// saved, e.g. recovered from the spool file twice, isn't an error
+func (l *DeadLetters) insert(deadLetter *DeadLetter) error {
+
+	_, err := l.db.GetCollection("deadletters").InsertOne(context.TODO(), deadLetter)
+	if err != nil && !mongo.IsDuplicateKeyError(err) {
+		return err
+	}
+
+	return nil
+}
+
+// isStopping returns true once Stop was called
+func (l *DeadLetters) isStopping() bool {
+
+	select {
+	case <-l.stopping:
+		return true
+	default:
+		return false
+	}
+}
+
+// spool appends a dead letter that couldn't be saved in the database to
+// the spool file, it's saved in the database when the consumer starts again
+func (l *DeadLetters) spool(deadLetter *DeadLetter, reason error) {
+
+	path := l.conf.DeadLetters.Spool
+	if path == "" {
+		log.Printf("ERROR: [DEAD LETTERS] dead letter %s lost, no spool file is set REASON: %s", deadLetter.ID.Hex(), reason.Error())
+		return
+	}
+
+	l.spoolMu.Lock()
+	defer l.spoolMu.Unlock()
+
+	if err := appendSpool(path, deadLetter); err != nil {
+		log.Printf("ERROR: [DEAD LETTERS] dead letter %s lost REASON: %s", deadLetter.ID.Hex(), err.Error())
+		return
+	}
+	l.spooled.Store(true)
+
+	log.Printf("WARNING: [DEAD LETTERS] dead letter %s saved to %s until it can be saved into database REASON: %s", deadLetter.ID.Hex(), path, reason.Error())
+}
+
+// recoverSpool saves the dead letters of the spool file in the database,
+// the file is renamed while it's saved so the dead letters spooled again
+// go to a new file, and a recovery interrupted by a crash is finished first
+func (l *DeadLetters) recoverSpool() {
+
+	path := l.conf.DeadLetters.Spool
+	if path == "" {
+		return
+	}
+
+	recovering := path + spoolRecoverExt
+
+	if _, err := os.Stat(recovering); err == nil {
+		l.recoverSpoolFile(recovering)
+	}
+
+	// no dead letter is spooled while the file is renamed
+	l.spoolMu.Lock()
+	err := os.Rename(path, recovering)
+	l.spoolMu.Unlock()
+
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("ERROR: [DEAD LETTERS] failed to read spool file: %s REASON: %s", path, err.Error())
+		}
+		return
+	}
+
+	l.recoverSpoolFile(recovering)
+}
+
+// recoverSpoolFile saves the dead letters of a spool file and removes it
+func (l *DeadLetters) recoverSpoolFile(path string) {
+
+	deadLetters, err := readSpool(path)
+	if err != nil {
+		log.Printf("ERROR: [DEAD LETTERS] failed to read spool file: %s REASON: %s", path, err.Error())
+		return
+	}
+
+	log.Printf("INFO: [DEAD LETTERS] saving %d dead letters of spool file %s into database", len(deadLetters), path)
+
+	for _, deadLetter := range deadLetters {
+		l.store(deadLetter)
+	}
+
+	if err := os.Remove(path); err != nil {
+		log.Printf("ERROR: [DEAD LETTERS] failed to remove spool file: %s REASON: %s", path, err.Error())
+	}
+}
+
+// appendSpool appends a dead letter to a spool file as a JSON line
+func appendSpool(path string, deadLetter *DeadLetter) error {
+
+	bytes, err := json.Marshal(deadLetter)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	if _, err := file.Write(append(bytes, '\n')); err != nil {
+		file.Close()
+		return err
+	}
+
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+
+	return file.Close()
+}
+
+// readSpool reads the dead letters of a spool file, a line torn
+// by a crash while it was written is skipped
+func readSpool(path string) ([]*DeadLetter, error) {
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	deadLetters := make([]*DeadLetter, 0)
+
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 {
+			deadLetter := &DeadLetter{}
+			if jsonErr := json.Unmarshal(line, deadLetter); jsonErr != nil {
+				log.Printf("WARNING: [DEAD LETTERS] skipping invalid line of spool file: %s REASON: %s", path, jsonErr.Error())
+			} else {
+				deadLetters = append(deadLetters, deadLetter)
+			}
+		}
+		if err == io.EOF {
+			return deadLetters, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// AddMessage stores a parsed message as a dead letter, the messages
+// received in a batch are stored as single messages
+func (l *DeadLetters) AddMessage(msg *Message, reason string, err error) {
+
+	payload := msg.payload
+	if payload == nil {
+		payload, _ = json.Marshal(msg)
+	}
+
+	l.Add(msg.topic, payload, msg.DeviceID, reason, err)
+}
+
+// publish republishes a dead letter to the dead letter topic
+func (l *DeadLetters) publish(deadLetter *DeadLetter) {
+
+	bytes, err := json.Marshal(deadLetter)
+	if err != nil {
+		log.Printf("ERROR: [DEAD LETTERS] failed to create dead letter message REASON: %s", err.Error())
+		return
+	}
+
+	if !l.broker.IsConnected() {
+		log.Printf("WARNING: [DEAD LETTERS] not connected to the MQTT Broker, dead letter %s not published", deadLetter.ID.Hex())
+		return
+	}
+
+	if err := l.broker.PublishTo(l.conf.DeadLetters.Topic, l.conf.DeadLetters.Qos, bytes); err != nil {
+		log.Printf("ERROR: [DEAD LETTERS] failed to publish dead letter %s REASON: %s", deadLetter.ID.Hex(), err.Error())
+	}
+}
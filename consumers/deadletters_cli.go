@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const deadLettersUsage = `usage: consumers -c <n> deadletters <command> [options]
+
+commands:
+  list [-reason <reason>] [-device <id>] [-limit <n>] [-all]
+        lists the dead letters not replayed yet, newest first
+  show <id>
+        prints a dead letter with its payload
+  replay [-reason <reason>] [-device <id>] [-all] [id ...]
+        publishes the dead letters again to the topic they were received in
+
+reasons: invalidPayload, unsupportedMessage, unknownDevice, storeFailed
+`
+
+// deadLettersCommand runs a dead letters command and returns the exit code
+func deadLettersCommand(conf *Configuration, db *Database, args []string) int {
+
+	if len(args) == 0 {
+		fmt.Print(deadLettersUsage)
+		return 1
+	}
+
+	var err error
+
+	switch args[0] {
+	case "list":
+		err = listDeadLetters(db, args[1:])
+	case "show":
+		err = showDeadLetter(db, args[1:])
+	case "replay":
+		err = replayDeadLetters(conf, db, args[1:])
+	default:
+		fmt.Print(deadLettersUsage)
+		return 1
+	}
+
+	if err != nil {
+		log.Println(err.Error())
+		return 1
+	}
+
+	return 0
+}
+
+// deadLettersFilter parses the filter options of the list and replay commands
+func deadLettersFilter(name string, args []string, limit *int64) (bson.D, []string, error) {
+
+	reason := ""
+	device := ""
+	all := false
+
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.StringVar(&reason, "reason", "", "only the dead letters with this reason")
+	flags.StringVar(&device, "device", "", "only the dead letters of this device id")
+	flags.BoolVar(&all, "all", false, "include the dead letters already replayed")
+	if limit != nil {
+		flags.Int64Var(limit, "limit", 20, "maximum number of dead letters")
+	}
+
+	if err := flags.Parse(args); err != nil {
+		return nil, nil, fmt.Errorf("ERROR: [DEAD LETTERS] invalid %s options REASON: %s", name, err.Error())
+	}
+
+	filter := bson.D{}
+
+	if reason != "" {
+		filter = append(filter, bson.E{Key: "reason", Value: reason})
+	}
+
+	if device != "" {
+		deviceID, err := primitive.ObjectIDFromHex(device)
+		if err != nil {
+			return nil, nil, fmt.Errorf("ERROR: [DEAD LETTERS] invalid device id: %s REASON: %s", device, err.Error())
+		}
+		filter = append(filter, bson.E{Key: "deviceId", Value: deviceID})
+	}
+
+	if !all {
+		filter = append(filter, bson.E{Key: "replayedAt", Value: bson.D{{Key: "$exists", Value: false}}})
+	}
+
+	return filter, flags.Args(), nil
+}
+
+// findDeadLetters searches the dead letters matching a filter, newest first
+func findDeadLetters(db *Database, filter bson.D, limit int64) ([]*DeadLetter, error) {
+
+	findOptions := options.Find().SetSort(bson.D{{Key: "createdAt", Value: -1}})
+	if limit > 0 {
+		findOptions.SetLimit(limit)
+	}
+
+	cursor, err := db.GetCollection("deadletters").Find(context.TODO(), filter, findOptions)
+	if err != nil {
+		return nil, fmt.Errorf("ERROR: [DEAD LETTERS] failed to search dead letters REASON: %s", err.Error())
+	}
+
+	deadLetters := make([]*DeadLetter, 0)
+	if err := cursor.All(context.TODO(), &deadLetters); err != nil {
+		return nil, fmt.Errorf("ERROR: [DEAD LETTERS] failed to read dead letters REASON: %s", err.Error())
+	}
+
+	return deadLetters, nil
+}
+
+func listDeadLetters(db *Database, args []string) error {
+
+	limit := int64(0)
+
+	filter, _, err := deadLettersFilter("list", args, &limit)
+	if err != nil {
+		return err
+	}
+
+	deadLetters, err := findDeadLetters(db, filter, limit)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tCREATED\tREASON\tDEVICE\tTOPIC\tREPLAYS\tERROR")
+
+	for _, deadLetter := range deadLetters {
+
+		device := "-"
+		if !deadLetter.DeviceID.IsZero() {
+			device = deadLetter.DeviceID.Hex()
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%d\t%s\n",
+			deadLetter.ID.Hex(),
+			deadLetter.CreatedAt.Local().Format(time.DateTime),
+			deadLetter.Reason,
+			device,
+			deadLetter.Topic,
+			deadLetter.Replays,
+			deadLetter.Error,
+		)
+	}
+
+	return w.Flush()
+}
+
+func showDeadLetter(db *Database, args []string) error {
+
+	if len(args) != 1 {
+		return fmt.Errorf("ERROR: [DEAD LETTERS] show requires a dead letter id")
+	}
+
+	id, err := primitive.ObjectIDFromHex(args[0])
+	if err != nil {
+		return fmt.Errorf("ERROR: [DEAD LETTERS] invalid dead letter id: %s REASON: %s", args[0], err.Error())
+	}
+
+	deadLetter := DeadLetter{}
+	if err := db.GetCollection("deadletters").FindOne(context.TODO(), bson.D{{Key: "_id", Value: id}}).Decode(&deadLetter); err != nil {
+		return fmt.Errorf("ERROR: [DEAD LETTERS] failed to find dead letter %s REASON: %s", args[0], err.Error())
+	}
+
+	// the payload is printed as it was received instead of base64
+	bytes, err := json.MarshalIndent(struct {
+		DeadLetter
+		Payload string `json:"payload"`
+	}{deadLetter, string(deadLetter.Payload)}, "", "    ")
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(string(bytes))
+
+	return nil
+}
+
+func replayDeadLetters(conf *Configuration, db *Database, args []string) error {
+
+	filter, ids, err := deadLettersFilter("replay", args, nil)
+	if err != nil {
+		return err
+	}
+
+	// the given ids are replayed even if they were already replayed
+	if len(ids) > 0 {
+
+		objectIDs := make([]primitive.ObjectID, 0, len(ids))
+		for _, id := range ids {
+			objectID, err := primitive.ObjectIDFromHex(id)
+			if err != nil {
+				return fmt.Errorf("ERROR: [DEAD LETTERS] invalid dead letter id: %s REASON: %s", id, err.Error())
+			}
+			objectIDs = append(objectIDs, objectID)
+		}
+
+		filter = bson.D{{Key: "_id", Value: bson.D{{Key: "$in", Value: objectIDs}}}}
+	}
+
+	deadLetters, err := findDeadLetters(db, filter, 0)
+	if err != nil {
+		return err
+	}
+
+	if len(deadLetters) == 0 {
+		log.Println("INFO: [DEAD LETTERS] no dead letters to replay")
+		return nil
+	}
+
+	// its own client id and a clean session so the running consumer
+	// isn't disconnected and the broker keeps nothing after the replay
+	replayConf := *conf
+	replayConf.MQTT.ClientID = conf.MQTT.ClientID + "-replay"
+	replayConf.MQTT.Session = SessionConf{CleanSession: true}
+
+	broker := NewMQTTClient(&replayConf, nil)
+	if err := broker.Connect(); err != nil {
+		return err
+	}
+	defer broker.Disconnect()
+
+	replayed := 0
+	for _, deadLetter := range deadLetters {
+
+		if err := broker.PublishTo(deadLetter.Topic, conf.MQTT.Subscribe.Qos, deadLetter.Payload); err != nil {
+			log.Printf("ERROR: [DEAD LETTERS] failed to replay dead letter %s REASON: %s", deadLetter.ID.Hex(), err.Error())
+			continue
+		}
+
+		update := bson.D{
+			{Key: "$set", Value: bson.D{{Key: "replayedAt", Value: time.Now().UTC()}}},
+			{Key: "$inc", Value: bson.D{{Key: "replays", Value: 1}}},
+		}
+
+		if _, err := db.GetCollection("deadletters").UpdateByID(context.TODO(), deadLetter.ID, update); err != nil {
+			log.Printf("ERROR: [DEAD LETTERS] failed to mark dead letter %s as replayed REASON: %s", deadLetter.ID.Hex(), err.Error())
+		}
+
+		replayed++
+	}
+
+	log.Printf("INFO: [DEAD LETTERS] replayed %d of %d dead letters", replayed, len(deadLetters))
+
+	return nil
+}
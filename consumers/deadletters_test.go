@@ -0,0 +1,64 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestDeadLetterSpool(t *testing.T) {
+
+	tests := []struct {
+		name      string
+		letters   int
+		trailing  string
+		wantCount int
+	}{
+		{"one dead letter", 1, "", 1},
+		{"several dead letters", 3, "", 3},
+		{"line torn by a crash", 2, `{"id":"65ba1f0c2b9e`, 2},
+		{"invalid line", 2, "not json\n", 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			// the directory of the spool file is created
+			path := filepath.Join(t.TempDir(), "data", "deadletters.jsonl")
+
+			ids := make([]primitive.ObjectID, tt.letters)
+			for i := range ids {
+				ids[i] = primitive.NewObjectID()
+				deadLetter := &DeadLetter{ID: ids[i], Topic: "mqttcourse/freezer", Payload: []byte(`{"deviceId":1}`), Reason: reasonStoreFailed}
+				if err := appendSpool(path, deadLetter); err != nil {
+					t.Fatalf("append failed: %s", err.Error())
+				}
+			}
+
+			if tt.trailing != "" {
+				file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+				if err != nil {
+					t.Fatal(err)
+				}
+				file.WriteString(tt.trailing)
+				file.Close()
+			}
+
+			deadLetters, err := readSpool(path)
+			if err != nil {
+				t.Fatalf("read failed: %s", err.Error())
+			}
+
+			if len(deadLetters) != tt.wantCount {
+				t.Fatalf("read %d dead letters, want %d", len(deadLetters), tt.wantCount)
+			}
+			for i, deadLetter := range deadLetters {
+				if deadLetter.ID != ids[i] || string(deadLetter.Payload) != `{"deviceId":1}` {
+					t.Errorf("dead letter %d is %s with payload %s, want %s", i, deadLetter.ID.Hex(), deadLetter.Payload, ids[i].Hex())
+				}
+			}
+		})
+	}
+}
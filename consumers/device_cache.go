@@ -0,0 +1,437 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// DeviceCache keeps the devices looked up by the consumer in memory. The
+// devices not found are also cached for a shorter time so messages of an
+// unknown device don't reach the database. Changes to the devices
+// collection are followed with a change stream, or when change streams
+// aren't available (a server outside a replica set), by refreshing the
+// cached devices periodically.
+type DeviceCache struct {
+	conf    *Configuration
+	db      *Database
+	mu      sync.RWMutex
+	entries map[primitive.ObjectID]*deviceCacheEntry
+	// the invalidations of each device and the clears of the cache,
+	// the devices read before them are never stored
+	invalidations map[primitive.ObjectID]uint64
+	epoch         uint64
+	cancel        context.CancelFunc
+	finished      chan bool
+}
+
+// deviceCacheGeneration is the state of the cache when devices are read,
+// they're only stored if the cache and the devices weren't invalidated since
+type deviceCacheGeneration struct {
+	epoch         uint64
+	invalidations map[primitive.ObjectID]uint64
+}
+
+// deviceCacheEntry is a cached device, a nil device
+// means the device doesn't exist
+type deviceCacheEntry struct {
+	device  *Device
+	expires time.Time
+}
+
+// deviceChange is an event of the devices change stream
+type deviceChange struct {
+	OperationType string `bson:"operationType"`
+	DocumentKey   struct {
+		ID primitive.ObjectID `bson:"_id"`
+	} `bson:"documentKey"`
+	UpdateDescription struct {
+		UpdatedFields bson.M   `bson:"updatedFields"`
+		RemovedFields []string `bson:"removedFields"`
+	} `bson:"updateDescription"`
+}
+
+// deviceCachedFields are the device fields the consumers read from the cache,
+// the updates of other fields, like the lastMetricTime written with every
+// batch, don't invalidate the cached device. The clockSkew is only written
+// when a consumer detects a change, the others read it from the cache.
+var deviceCachedFields = []string{"active", "userId", "clockSkew"}
+
+const (
+	defaultDeviceTTL         = 60000
+	defaultDeviceNegativeTTL = 10000
+	defaultDeviceRefresh     = 5000
+	deviceWatchRetry         = 5 * time.Second
+)
+
+// NewDeviceCache creates a new DeviceCache struct pointer
+func NewDeviceCache(conf *Configuration, db *Database) *DeviceCache {
+
+	c := &DeviceCache{}
+
+	c.conf = conf
+	c.db = db
+	c.entries = make(map[primitive.ObjectID]*deviceCacheEntry)
+	c.invalidations = make(map[primitive.ObjectID]uint64)
+
+	return c
+}
+
+// Start starts following the changes of the devices collection
+func (c *DeviceCache) Start() {
+
+	if c.cancel != nil {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	c.cancel = cancel
+	c.finished = make(chan bool, 1)
+
+	go func() {
+
+		c.follow(ctx)
+
+		c.finished <- true
+	}()
+}
+
+// Stop stops following the changes of the devices collection
+func (c *DeviceCache) Stop() {
+
+	if c.cancel == nil {
+		return
+	}
+
+	c.cancel()
+	<-c.finished
+	c.cancel = nil
+}
+
+// Lookup returns the active devices with the given ids, the devices
+// not cached are searched with a single query
+func (c *DeviceCache) Lookup(ids []primitive.ObjectID) (map[primitive.ObjectID]*Device, error) {
+
+	now := time.Now()
+
+	devices := make(map[primitive.ObjectID]*Device)
+	missing := make([]primitive.ObjectID, 0)
+
+	c.mu.RLock()
+	for _, id := range ids {
+
+		entry, ok := c.entries[id]
+		if !ok || now.After(entry.expires) {
+			missing = append(missing, id)
+			continue
+		}
+
+		if entry.device != nil && entry.device.Active {
+			devices[id] = entry.device
+		}
+	}
+	generation := c.generation(missing)
+	c.mu.RUnlock()
+
+	if len(missing) == 0 {
+		return devices, nil
+	}
+
+	found, err := c.find(missing)
+	if err != nil {
+		return nil, err
+	}
+
+	c.store(missing, found, generation)
+
+	for _, device := range found {
+		if device.Active {
+			devices[device.ID] = device
+		}
+	}
+
+	return devices, nil
+}
+
+// Invalidate removes a device from the cache
+func (c *DeviceCache) Invalidate(id primitive.ObjectID) {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.entries, id)
+	c.invalidations[id]++
+}
+
+// generation returns the state of the cache for the given ids,
+// the caller holds the lock
+func (c *DeviceCache) generation(ids []primitive.ObjectID) deviceCacheGeneration {
+
+	generation := deviceCacheGeneration{
+		epoch:         c.epoch,
+		invalidations: make(map[primitive.ObjectID]uint64, len(ids)),
+	}
+
+	for _, id := range ids {
+		generation.invalidations[id] = c.invalidations[id]
+	}
+
+	return generation
+}
+
+// find searches the devices with the given ids, the inactive devices
+// are also returned so they're cached
+func (c *DeviceCache) find(ids []primitive.ObjectID) ([]*Device, error) {
+
+	filter := bson.D{{Key: "_id", Value: bson.D{{Key: "$in", Value: ids}}}}
+
+	cursor, err := c.db.GetCollection("devices").Find(context.TODO(), filter)
+	if err != nil {
+		return nil, err
+	}
+
+	found := make([]*Device, 0)
+	if err := cursor.All(context.TODO(), &found); err != nil {
+		return nil, err
+	}
+
+	return found, nil
+}
+
+// store caches the devices found, the ids not found are cached as missing.
+// The devices invalidated since they were read are skipped, a change
+// received while reading them would be lost otherwise.
+func (c *DeviceCache) store(ids []primitive.ObjectID, found []*Device, generation deviceCacheGeneration) {
+
+	ttl := c.conf.DeviceCache.TTL
+	if ttl <= 0 {
+		ttl = defaultDeviceTTL
+	}
+
+	negativeTTL := c.conf.DeviceCache.NegativeTTL
+	if negativeTTL <= 0 {
+		negativeTTL = defaultDeviceNegativeTTL
+	}
+
+	now := time.Now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.epoch != generation.epoch {
+		return
+	}
+
+	for _, id := range ids {
+		if c.invalidations[id] == generation.invalidations[id] {
+			c.entries[id] = &deviceCacheEntry{expires: now.Add(time.Duration(negativeTTL) * time.Millisecond)}
+		}
+	}
+
+	for _, device := range found {
+		if c.invalidations[device.ID] == generation.invalidations[device.ID] {
+			c.entries[device.ID] = &deviceCacheEntry{device: device, expires: now.Add(time.Duration(ttl) * time.Millisecond)}
+		}
+	}
+}
+
+// follow invalidates the changed devices until the context is canceled, while
+// change streams aren't available the devices are refreshed periodically and
+// following the changes is retried
+func (c *DeviceCache) follow(ctx context.Context) {
+
+	isRefreshing := false
+
+	for ctx.Err() == nil {
+
+		stream, err := c.db.GetCollection("devices").Watch(ctx, deviceChangesPipeline())
+		if err != nil {
+
+			if ctx.Err() != nil {
+				return
+			}
+
+			if !isRefreshing {
+				log.Printf("INFO: [DEVICE CACHE] change streams unavailable, refreshing devices every %d ms REASON: %s", c.refreshInterval().Milliseconds(), err.Error())
+				isRefreshing = true
+			}
+
+			c.refresh(ctx, deviceWatchRetry)
+			continue
+		}
+
+		// the changes made since the last refresh are unknown
+		if isRefreshing {
+			log.Println("INFO: [DEVICE CACHE] change streams available, following devices changes")
+			c.clear()
+			isRefreshing = false
+		}
+
+		if c.conf.Options.debug {
+			log.Println("INFO: [DEVICE CACHE] following devices changes")
+		}
+
+		c.watch(ctx, stream)
+		err = stream.Err()
+		stream.Close(context.TODO())
+
+		if ctx.Err() != nil {
+			return
+		}
+
+		// the changes missed until the stream is open again are unknown
+		c.clear()
+
+		log.Printf("WARNING: [DEVICE CACHE] devices change stream closed, retrying in %s REASON: %v", deviceWatchRetry, err)
+
+		select {
+		case <-ctx.Done():
+		case <-time.After(deviceWatchRetry):
+		}
+	}
+}
+
+// watch invalidates the devices changed in the stream until it's closed
+func (c *DeviceCache) watch(ctx context.Context, stream *mongo.ChangeStream) {
+
+	for stream.Next(ctx) {
+
+		event := deviceChange{}
+		if err := stream.Decode(&event); err != nil {
+			continue
+		}
+
+		c.apply(&event)
+	}
+}
+
+// apply invalidates the device of a change that modifies a cached field
+func (c *DeviceCache) apply(event *deviceChange) {
+
+	if !event.changesDevice() {
+		return
+	}
+
+	if c.conf.Options.debug {
+		log.Printf("INFO: [DEVICE CACHE] device %s changed", event.DocumentKey.ID.Hex())
+	}
+
+	c.Invalidate(event.DocumentKey.ID)
+}
+
+// changesDevice returns true if the change inserts, replaces or deletes
+// a device or updates one of its cached fields
+func (e *deviceChange) changesDevice() bool {
+
+	if e.OperationType != "update" {
+		return true
+	}
+
+	for _, field := range deviceCachedFields {
+
+		if _, ok := e.UpdateDescription.UpdatedFields[field]; ok {
+			return true
+		}
+
+		for _, removed := range e.UpdateDescription.RemovedFields {
+			if removed == field {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// deviceChangesPipeline returns the change stream pipeline keeping only
+// the changes that invalidate a cached device, see changesDevice
+func deviceChangesPipeline() mongo.Pipeline {
+
+	changes := bson.A{bson.D{{Key: "operationType", Value: bson.D{{Key: "$ne", Value: "update"}}}}}
+	for _, field := range deviceCachedFields {
+		changes = append(changes,
+			bson.D{{Key: "updateDescription.updatedFields." + field, Value: bson.D{{Key: "$exists", Value: true}}}},
+			bson.D{{Key: "updateDescription.removedFields", Value: field}},
+		)
+	}
+
+	return mongo.Pipeline{{{Key: "$match", Value: bson.D{{Key: "$or", Value: changes}}}}}
+}
+
+// refresh reloads the cached devices every refresh interval for at least
+// the given duration, or until the context is canceled
+func (c *DeviceCache) refresh(ctx context.Context, duration time.Duration) {
+
+	deadline := time.Now().Add(duration)
+
+	ticker := time.NewTicker(c.refreshInterval())
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		c.refreshDevices()
+
+		if !time.Now().Before(deadline) {
+			return
+		}
+	}
+}
+
+// refreshDevices reloads the cached devices
+func (c *DeviceCache) refreshDevices() {
+
+	// the missing devices expire by themselves
+	c.mu.RLock()
+	ids := make([]primitive.ObjectID, 0, len(c.entries))
+	for id, entry := range c.entries {
+		if entry.device != nil {
+			ids = append(ids, id)
+		}
+	}
+	generation := c.generation(ids)
+	c.mu.RUnlock()
+
+	if len(ids) == 0 {
+		return
+	}
+
+	found, err := c.find(ids)
+	if err != nil {
+		log.Printf("WARNING: [DEVICE CACHE] failed to refresh devices REASON: %s", err.Error())
+		return
+	}
+
+	c.store(ids, found, generation)
+}
+
+// refreshInterval returns the interval between devices refreshes
+func (c *DeviceCache) refreshInterval() time.Duration {
+
+	refresh := c.conf.DeviceCache.RefreshInterval
+	if refresh <= 0 {
+		refresh = defaultDeviceRefresh
+	}
+
+	return time.Duration(refresh) * time.Millisecond
+}
+
+// clear removes all the devices from the cache
+func (c *DeviceCache) clear() {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries = make(map[primitive.ObjectID]*deviceCacheEntry)
+	c.invalidations = make(map[primitive.ObjectID]uint64)
+	c.epoch++
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestDeviceCacheApply(t *testing.T) {
+
+	update := func(updated bson.M, removed ...string) deviceChange {
+		event := deviceChange{OperationType: "update"}
+		event.UpdateDescription.UpdatedFields = updated
+		event.UpdateDescription.RemovedFields = removed
+		return event
+	}
+
+	tests := []struct {
+		name            string
+		event           deviceChange
+		wantInvalidated bool
+	}{
+		{"batch flush", update(bson.M{"lastMetricTime": time.Now()}), false},
+		{"other field", update(bson.M{"name": "freezer"}), false},
+		{"deactivated", update(bson.M{"active": false, "updatedAt": time.Now()}), true},
+		{"owner changed", update(bson.M{"userId": primitive.NewObjectID()}), true},
+		{"clock skew detected", update(bson.M{"clockSkew": bson.M{"offset": 600000}}), true},
+		{"clock back in sync", update(bson.M{}, "clockSkew"), true},
+		{"inserted", deviceChange{OperationType: "insert"}, true},
+		{"replaced", deviceChange{OperationType: "replace"}, true},
+		{"deleted", deviceChange{OperationType: "delete"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			id := primitive.NewObjectID()
+
+			c := NewDeviceCache(&Configuration{Options: &Options{}}, nil)
+			c.entries[id] = &deviceCacheEntry{device: &Device{ID: id, Active: true}, expires: time.Now().Add(time.Minute)}
+
+			tt.event.DocumentKey.ID = id
+			c.apply(&tt.event)
+
+			if _, cached := c.entries[id]; cached == tt.wantInvalidated {
+				t.Errorf("device cached is %t, want %t", cached, !tt.wantInvalidated)
+			}
+		})
+	}
+}
@@ -1,16 +1,14 @@
 package main
 
 import (
-	"context"
 	"encoding/json"
 	"fmt"
 	"log"
 	"syscall"
 	"time"
 
-	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/joaoribeirodasilva/mqtt-course/shared/broker"
 	"github.com/joaoribeirodasilva/wait_signals"
-	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
@@ -20,27 +18,66 @@ type Device struct {
 	Name           string             `json:"name" bson:"name"`
 	LastMetricTime *time.Time         `json:"lastMetricTime" bson:"lastMetricTime"`
 	Active         bool               `json:"active" bson:"active"`
+	ClockSkew      *ClockSkewModel    `json:"clockSkew,omitempty" bson:"clockSkew,omitempty"`
 	CreatedAt      time.Time          `json:"createdAt" bson:"createdAt"`
 	UpdatedAt      time.Time          `json:"updatedAt" bson:"updatedAt"`
 }
 
 type Message struct {
 	DeviceID    primitive.ObjectID `json:"deviceId"`
+	Sequence    uint64             `json:"sequence"`
 	Sensors     interface{}        `json:"sensors"`
 	CollectedAt time.Time          `json:"collectedAt"`
+	Aggregate   *MessageAggregate  `json:"aggregate,omitempty"`
+	// topic and payload the message was received with, used by dead letters
+	topic   string
+	payload []byte
+}
+
+// MessageAggregate describes a message merging several readings of a device
+// whose storage was full, the sensors values are the averages of the readings
+// and min and max are keyed by the sensor name or sensor.field path
+type MessageAggregate struct {
+	Count int                `json:"count" bson:"count"`
+	From  time.Time          `json:"from" bson:"from"`
+	To    time.Time          `json:"to" bson:"to"`
+	Min   map[string]float64 `json:"min" bson:"min"`
+	Max   map[string]float64 `json:"max" bson:"max"`
+}
+
+// MessageBatch is the envelope of several messages published at once by a device
+type MessageBatch struct {
+	DeviceID primitive.ObjectID `json:"deviceId"`
+	Count    int                `json:"count"`
+	Messages []Message          `json:"messages"`
+}
+
+// MessageMeta is the metaField of the metrics time series collection,
+// the readings are grouped in buckets by device
+type MessageMeta struct {
+	DeviceID primitive.ObjectID `json:"deviceId" bson:"deviceId"`
+	UserID   primitive.ObjectID `json:"userId" bson:"userId"`
 }
 
 // TODO: Define the base message object
 type MessageModel struct {
 	ID          primitive.ObjectID `json:"_id" bson:"_id"`
-	UserID      primitive.ObjectID `json:"userId" bson:"userId"`
-	DeviceID    primitive.ObjectID `json:"deviceId"`
+	Meta        MessageMeta        `json:"meta" bson:"meta"`
+	Sequence    uint64             `json:"sequence,omitempty" bson:"sequence,omitempty"`
 	ConsumerID  primitive.ObjectID `json:"consumer" bson:"consumer"`
 	Sensors     interface{}        `json:"sensors"`
-	CollectedAt time.Time          `json:"collectedAt"`
+	CollectedAt time.Time          `json:"collectedAt" bson:"collectedAt"`
 	Received    time.Time          `json:"received" bson:"received"`
+	ClockSkewed bool               `json:"clockSkewed,omitempty" bson:"clockSkewed,omitempty"`
+	Aggregate   *MessageAggregate  `json:"aggregate,omitempty" bson:"aggregate,omitempty"`
 }
 
+const (
+	// the message schema versions this consumer understands
+	supportedSchemaVersion = "1"
+	jsonContentType        = "application/json"
+)
+
 type Dial struct {
 	conf          *Configuration
 	broker        *MQTTClient
@@ -48,6 +85,10 @@ type Dial struct {
 	stopRequested bool
 	finished      chan bool
 	db            *Database
+	devices       *DeviceCache
+	pipeline      *Pipeline
+	deadLetters   *DeadLetters
+	alerts        *Alerts
 }
 
 // NewDial create a new Dial struct pointer
@@ -60,6 +101,10 @@ func NewDial(conf *Configuration, db *Database) *Dial {
 	d.stopRequested = false
 	d.broker = NewMQTTClient(conf, d.onMessageReceived)
 	d.db = db
+	d.deadLetters = NewDeadLetters(conf, db, d.broker)
+	d.devices = NewDeviceCache(conf, db)
+	d.alerts = NewAlerts(conf, db, d.broker)
+	d.pipeline = NewPipeline(conf, db, d.devices, d.deadLetters, d.alerts)
 
 	return d
 }
@@ -74,6 +119,14 @@ func (d *Dial) Start() error {
 
 	d.finished = make(chan bool, 1)
 
+	// the pipeline stores the received messages
+	// of the devices in the cache and evaluates
+	// their alert rules
+	d.deadLetters.Start()
+	d.devices.Start()
+	d.alerts.Start()
+	d.pipeline.Start()
+
 	go func() {
 
 		log.Println("INFO: [DIAL] MQTT dial started")
@@ -127,57 +180,92 @@ func (d *Dial) Stop() {
 
 		log.Println("INFO: [DIAL] MQTT dial stopped")
 	}
+
+	// store the messages already received, the dial
+	// loop also ends by itself on a signal
+	d.pipeline.Stop()
+	d.alerts.Stop()
+	d.devices.Stop()
+	d.deadLetters.Stop()
 }
 
-func (d *Dial) onMessageReceived(client mqtt.Client, message mqtt.Message) {
+func (d *Dial) onMessageReceived(message *broker.Message) {
 
-	msgJson := Message{}
+	bytes := message.Payload
 
-	bytes := message.Payload()
+	// the device id property is used when the payload has none
+	propertyDeviceID := primitive.NilObjectID
+	if deviceId := message.UserProperties["deviceId"]; deviceId != "" {
+		if id, err := primitive.ObjectIDFromHex(deviceId); err == nil {
+			propertyDeviceID = id
+		}
+	}
 
-	if err := json.Unmarshal(bytes, &msgJson); err != nil {
-		log.Printf("ERROR: [DIAL] failed to parse message bytes REASON: %v\n", err)
+	// MQTT 5 messages describe their payload, MQTT 3 messages have no properties
+	if message.ContentType != "" && message.ContentType != jsonContentType {
+		d.deadLetters.Add(message.Topic, bytes, propertyDeviceID, reasonUnsupportedMessage, fmt.Errorf("unsupported content type %s", message.ContentType))
 		return
 	}
 
-	collDevices := d.db.GetCollection("metrics")
-
-	device := &Device{}
+	if version := message.UserProperties["schemaVersion"]; version != "" && version != supportedSchemaVersion {
+		d.deadLetters.Add(message.Topic, bytes, propertyDeviceID, reasonUnsupportedMessage, fmt.Errorf("unsupported schema version %s", version))
+		return
+	}
 
-	err := collDevices.FindOne(context.TODO(), bson.D{{Key: "_id", Value: msgJson.DeviceID}, {Key: "active", Value: true}}).Decode(device)
-	if err != nil || device.UserID.IsZero() {
-		log.Printf("ERROR: [DIAL] failed to search for device REASON: %v\n", err)
+	// a device can publish a single message
+	// or a batch of messages
+	batch := MessageBatch{}
+	if err := json.Unmarshal(bytes, &batch); err != nil {
+		d.deadLetters.Add(message.Topic, bytes, propertyDeviceID, reasonInvalidPayload, err)
 		return
 	}
 
-	coll := d.db.GetCollection("metrics")
+	if batch.Messages != nil {
 
-	rec := MessageModel{
-		ID:         primitive.NewObjectID(),
-		UserID:     device.UserID,
-		DeviceID:   msgJson.DeviceID,
-		ConsumerID: d.conf.Mongo.ClientID,
-		Sensors:    msgJson.Sensors,
-		Received:   time.Now(),
-	}
+		if d.conf.Options.debug {
+			fmt.Printf("INFO: [DIAL] received batch of %d messages\n", len(batch.Messages))
+		}
+
+		for i := range batch.Messages {
+
+			// the messages inherit the batch device
+			if batch.Messages[i].DeviceID.IsZero() {
+				batch.Messages[i].DeviceID = batch.DeviceID
+			}
+			if batch.Messages[i].DeviceID.IsZero() {
+				batch.Messages[i].DeviceID = propertyDeviceID
+			}
+
+			batch.Messages[i].topic = message.Topic
+
+			d.enqueue(&batch.Messages[i])
+		}
 
-	_, err = coll.InsertOne(context.TODO(), rec)
-	if err != nil {
-		log.Printf("ERROR: [DIAL] failed to save message into database REASON: %v\n", err)
 		return
 	}
 
-	now := time.Now().UTC()
-	device.LastMetricTime = &now
-
-	_, err = collDevices.UpdateOne(context.TODO(), bson.D{{Key: "_id", Value: device.ID}}, bson.D{{Key: "$set", Value: device}})
-	if err != nil {
-		log.Printf("ERROR: [DIAL] failed to update device last message time REASON: %v\n", err)
+	msgJson := Message{}
+	if err := json.Unmarshal(bytes, &msgJson); err != nil {
+		d.deadLetters.Add(message.Topic, bytes, propertyDeviceID, reasonInvalidPayload, err)
 		return
 	}
 
-	if d.conf.Options.debug {
-		fmt.Printf("INFO: [DIAL] received message\n ")
+	if msgJson.DeviceID.IsZero() {
+		msgJson.DeviceID = propertyDeviceID
+	}
+
+	msgJson.topic = message.Topic
+	msgJson.payload = bytes
+
+	d.enqueue(&msgJson)
+}
+
+// enqueue queues a message in the pipeline, the messages received after
+// the pipeline stopped or while its queue stays full are stored as dead letters
+func (d *Dial) enqueue(msg *Message) {
+
+	if err := d.pipeline.Enqueue(msg); err != nil {
+		d.deadLetters.AddMessage(msg, reasonStoreFailed, err)
 	}
 }
 
@@ -2,14 +2,14 @@ module github.com/joaoribeirodasilva/mqtt-course/consumers
 
 go 1.21.4
 
-require (
-	github.com/eclipse/paho.mqtt.golang v1.4.3
-	go.mongodb.org/mongo-driver v1.13.0
-)
+require go.mongodb.org/mongo-driver v1.13.0
 
 require (
+	github.com/eclipse/paho.golang v0.21.0 // indirect
+	github.com/eclipse/paho.mqtt.golang v1.4.3 // indirect
 	github.com/golang/snappy v0.0.1 // indirect
-	github.com/gorilla/websocket v1.5.0 // indirect
+	github.com/gorilla/websocket v1.5.1 // indirect
+	github.com/joaoribeirodasilva/mqtt-course/shared v0.0.0
 	github.com/klauspost/compress v1.13.6 // indirect
 	github.com/montanaflynn/stats v0.0.0-20171201202039-1bf9dbcd8cbe // indirect
 	github.com/xdg-go/pbkdf2 v1.0.0 // indirect
@@ -17,7 +17,9 @@ require (
 	github.com/xdg-go/stringprep v1.0.4 // indirect
 	github.com/youmark/pkcs8 v0.0.0-20181117223130-1be2e3e5546d // indirect
 	golang.org/x/crypto v0.0.0-20220622213112-05595931fe9d // indirect
-	golang.org/x/net v0.8.0 // indirect
+	golang.org/x/net v0.21.0 // indirect
 	golang.org/x/sync v0.1.0 // indirect
 	golang.org/x/text v0.8.0 // indirect
 )
+
+replace github.com/joaoribeirodasilva/mqtt-course/shared => ../shared
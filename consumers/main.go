@@ -35,6 +35,33 @@ func main() {
 		panic(err)
 	}
 
+	// metrics time series collection and the
+	// sequences used to drop duplicated messages
+	if err := db.Setup(); err != nil {
+		panic(err)
+	}
+
+	// migrate the metrics stored before the time series collection
+	if flag.Arg(0) == "migrate" {
+		exit := migrateCommand(conf, db, flag.Args()[1:])
+		db.Disconnect()
+		os.Exit(exit)
+	}
+
+	// rebuild the hourly and daily statistics of past days
+	if flag.Arg(0) == "rollups" {
+		exit := rollupsCommand(conf, db, flag.Args()[1:])
+		db.Disconnect()
+		os.Exit(exit)
+	}
+
+	// list, show or replay the dead letters
+	if flag.Arg(0) == "deadletters" {
+		exit := deadLettersCommand(conf, db, flag.Args()[1:])
+		db.Disconnect()
+		os.Exit(exit)
+	}
+
 	// initial subscribe and final unsubscribe
 	if conf.Options.subscribe || conf.Options.unsubscribe {
 
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/joaoribeirodasilva/mqtt-course/shared/timeseries"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// legacyMetric is a metric stored in the regular metrics collection, the
+// first consumers stored the device id and collection time in lowercase
+type legacyMetric struct {
+	ID               primitive.ObjectID `bson:"_id"`
+	UserID           primitive.ObjectID `bson:"userId"`
+	DeviceID         primitive.ObjectID `bson:"deviceId"`
+	LowerDeviceID    primitive.ObjectID `bson:"deviceid"`
+	Sequence         uint64             `bson:"sequence"`
+	ConsumerID       primitive.ObjectID `bson:"consumer"`
+	Sensors          interface{}        `bson:"sensors"`
+	CollectedAt      time.Time          `bson:"collectedAt"`
+	LowerCollectedAt time.Time          `bson:"collectedat"`
+	Received         time.Time          `bson:"received"`
+}
+
+const (
+	defaultMigrateBatch = 1000
+)
+
+// migrateCommand copies the metrics of the legacy collection to the time
+// series collection in batches, removing each batch copied from the legacy
+// collection so an interrupted migration continues where it stopped. The
+// legacy collection is dropped when it's empty.
+func migrateCommand(conf *Configuration, db *Database, args []string) int {
+
+	batchSize := 0
+
+	flags := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	flags.IntVar(&batchSize, "batch", defaultMigrateBatch, "number of metrics copied at once")
+	if err := flags.Parse(args); err != nil || batchSize <= 0 {
+		return 1
+	}
+
+	legacy := db.GetCollection("metrics" + timeseries.LegacySuffix)
+
+	// the metrics older than the retention would be deleted right away
+	oldest := time.Time{}
+	if retention := conf.Metrics.Retention(); retention > 0 {
+		oldest = time.Now().Add(-time.Duration(retention) * time.Second)
+	}
+
+	migrated := 0
+	skipped := 0
+
+	for {
+
+		findOptions := options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}).SetLimit(int64(batchSize))
+
+		cursor, err := legacy.Find(context.TODO(), bson.D{}, findOptions)
+		if err != nil {
+			log.Printf("ERROR: [MIGRATE] failed to read legacy metrics REASON: %s", err.Error())
+			return 1
+		}
+
+		batch := make([]legacyMetric, 0, batchSize)
+		if err := cursor.All(context.TODO(), &batch); err != nil {
+			log.Printf("ERROR: [MIGRATE] failed to read legacy metrics REASON: %s", err.Error())
+			return 1
+		}
+
+		if len(batch) == 0 {
+			break
+		}
+
+		records, claims := migrateBatch(batch, oldest)
+		skipped += len(batch) - len(records)
+
+		if err := migrateRecords(db, records, claims); err != nil {
+			log.Println(err.Error())
+			return 1
+		}
+
+		ids := make([]primitive.ObjectID, 0, len(batch))
+		for _, metric := range batch {
+			ids = append(ids, metric.ID)
+		}
+
+		if _, err := legacy.DeleteMany(context.TODO(), bson.D{{Key: "_id", Value: bson.D{{Key: "$in", Value: ids}}}}); err != nil {
+			log.Printf("ERROR: [MIGRATE] failed to remove migrated legacy metrics REASON: %s", err.Error())
+			return 1
+		}
+
+		migrated += len(records)
+		log.Printf("INFO: [MIGRATE] %d metrics migrated, %d skipped", migrated, skipped)
+	}
+
+	if err := legacy.Drop(context.TODO()); err != nil {
+		log.Printf("ERROR: [MIGRATE] failed to drop the legacy metrics collection REASON: %s", err.Error())
+		return 1
+	}
+
+	log.Printf("INFO: [MIGRATE] migration finished, %d metrics migrated, %d skipped", migrated, skipped)
+
+	return 0
+}
+
+// migrateBatch converts a batch of legacy metrics, the metrics without a
+// device or older than oldest are skipped
+func migrateBatch(batch []legacyMetric, oldest time.Time) ([]interface{}, []interface{}) {
+
+	records := make([]interface{}, 0, len(batch))
+	claims := make([]interface{}, 0, len(batch))
+
+	for _, metric := range batch {
+
+		deviceID := metric.DeviceID
+		if deviceID.IsZero() {
+			deviceID = metric.LowerDeviceID
+		}
+
+		collectedAt := metric.CollectedAt
+		if collectedAt.IsZero() {
+			collectedAt = metric.LowerCollectedAt
+		}
+		if collectedAt.IsZero() {
+			collectedAt = metric.Received
+		}
+
+		if deviceID.IsZero() || collectedAt.IsZero() || collectedAt.Before(oldest) {
+			continue
+		}
+
+		records = append(records, MessageModel{
+			ID: metric.ID,
+			Meta: MessageMeta{
+				DeviceID: deviceID,
+				UserID:   metric.UserID,
+			},
+			Sequence:    metric.Sequence,
+			ConsumerID:  metric.ConsumerID,
+			Sensors:     metric.Sensors,
+			CollectedAt: collectedAt.UTC(),
+			Received:    metric.Received,
+		})
+
+		if metric.Sequence != 0 {
+			claims = append(claims, SequenceModel{
+				ID:        SequenceKey{DeviceID: deviceID, Sequence: metric.Sequence},
+				CreatedAt: metric.Received,
+			})
+		}
+	}
+
+	return records, claims
+}
+
+// migrateRecords inserts a batch of converted metrics and their sequences,
+// the metrics already copied by an interrupted migration are skipped
+func migrateRecords(db *Database, records []interface{}, claims []interface{}) error {
+
+	if len(records) == 0 {
+		return nil
+	}
+
+	copied, err := copiedMetrics(db, records)
+	if err != nil {
+		return err
+	}
+
+	remaining := make([]interface{}, 0, len(records))
+	for _, record := range records {
+		if !copied[record.(MessageModel).ID] {
+			remaining = append(remaining, record)
+		}
+	}
+
+	if len(remaining) > 0 {
+		if _, err := db.GetCollection("metrics").InsertMany(context.TODO(), remaining, options.InsertMany().SetOrdered(false)); err != nil {
+			return fmt.Errorf("ERROR: [MIGRATE] failed to save metrics REASON: %s", err.Error())
+		}
+	}
+
+	if len(claims) == 0 {
+		return nil
+	}
+
+	// the sequences already claimed were copied before
+	_, err = db.GetCollection(sequencesCollection).InsertMany(context.TODO(), claims, options.InsertMany().SetOrdered(false))
+	if err != nil {
+
+		bulkErr := mongo.BulkWriteException{}
+		if !errors.As(err, &bulkErr) || bulkErr.WriteConcernError != nil {
+			return fmt.Errorf("ERROR: [MIGRATE] failed to save message sequences REASON: %s", err.Error())
+		}
+
+		for _, writeErr := range bulkErr.WriteErrors {
+			if !mongo.IsDuplicateKeyError(writeErr) {
+				return fmt.Errorf("ERROR: [MIGRATE] failed to save message sequences REASON: %s", writeErr.Error())
+			}
+		}
+	}
+
+	return nil
+}
+
+// copiedMetrics returns the ids of the metrics of a batch already in the
+// time series collection, the query is limited to the devices and time
+// range of the batch so it uses the device index
+func copiedMetrics(db *Database, records []interface{}) (map[primitive.ObjectID]bool, error) {
+
+	ids := make([]primitive.ObjectID, 0, len(records))
+	devices := make([]primitive.ObjectID, 0)
+	seen := make(map[primitive.ObjectID]bool)
+	first := time.Time{}
+	last := time.Time{}
+
+	for _, record := range records {
+
+		model := record.(MessageModel)
+		ids = append(ids, model.ID)
+
+		if !seen[model.Meta.DeviceID] {
+			seen[model.Meta.DeviceID] = true
+			devices = append(devices, model.Meta.DeviceID)
+		}
+
+		if first.IsZero() || model.CollectedAt.Before(first) {
+			first = model.CollectedAt
+		}
+		if model.CollectedAt.After(last) {
+			last = model.CollectedAt
+		}
+	}
+
+	filter := bson.D{
+		{Key: "meta.deviceId", Value: bson.D{{Key: "$in", Value: devices}}},
+		{Key: timeseries.TimeField, Value: bson.D{{Key: "$gte", Value: first}, {Key: "$lte", Value: last}}},
+		{Key: "_id", Value: bson.D{{Key: "$in", Value: ids}}},
+	}
+
+	cursor, err := db.GetCollection("metrics").Find(context.TODO(), filter, options.Find().SetProjection(bson.D{{Key: "_id", Value: 1}}))
+	if err != nil {
+		return nil, fmt.Errorf("ERROR: [MIGRATE] failed to read migrated metrics REASON: %s", err.Error())
+	}
+
+	found := make([]struct {
+		ID primitive.ObjectID `bson:"_id"`
+	}, 0)
+	if err := cursor.All(context.TODO(), &found); err != nil {
+		return nil, fmt.Errorf("ERROR: [MIGRATE] failed to read migrated metrics REASON: %s", err.Error())
+	}
+
+	copied := make(map[primitive.ObjectID]bool)
+	for _, metric := range found {
+		copied[metric.ID] = true
+	}
+
+	return copied, nil
+}
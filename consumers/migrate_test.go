@@ -0,0 +1,64 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestMigrateBatch(t *testing.T) {
+
+	deviceID := primitive.NewObjectID()
+	collectedAt := time.Date(2024, 1, 31, 10, 0, 0, 0, time.FixedZone("UTC+1", 3600))
+	received := time.Date(2024, 1, 31, 9, 0, 1, 0, time.UTC)
+	oldest := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name            string
+		metric          legacyMetric
+		wantRecord      bool
+		wantCollectedAt time.Time
+		wantClaim       bool
+	}{
+		{"current fields", legacyMetric{DeviceID: deviceID, CollectedAt: collectedAt, Received: received, Sequence: 7}, true, collectedAt, true},
+		{"lowercase fields", legacyMetric{LowerDeviceID: deviceID, LowerCollectedAt: collectedAt, Received: received}, true, collectedAt, false},
+		{"receive time only", legacyMetric{DeviceID: deviceID, Received: received, Sequence: 7}, true, received, true},
+		{"no device", legacyMetric{CollectedAt: collectedAt, Received: received}, false, time.Time{}, false},
+		{"no time", legacyMetric{DeviceID: deviceID}, false, time.Time{}, false},
+		{"older than the retention", legacyMetric{DeviceID: deviceID, CollectedAt: oldest.Add(-time.Second), Received: received}, false, time.Time{}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			tt.metric.ID = primitive.NewObjectID()
+
+			records, claims := migrateBatch([]legacyMetric{tt.metric}, oldest)
+
+			if (len(records) == 1) != tt.wantRecord {
+				t.Fatalf("converted %d metrics, want metric %t", len(records), tt.wantRecord)
+			}
+			if (len(claims) == 1) != tt.wantClaim {
+				t.Errorf("claimed %d sequences, want claim %t", len(claims), tt.wantClaim)
+			}
+			if !tt.wantRecord {
+				return
+			}
+
+			record := records[0].(MessageModel)
+			if record.ID != tt.metric.ID || record.Meta.DeviceID != deviceID {
+				t.Errorf("metric %s of device %s, want %s of device %s", record.ID.Hex(), record.Meta.DeviceID.Hex(), tt.metric.ID.Hex(), deviceID.Hex())
+			}
+			if !record.CollectedAt.Equal(tt.wantCollectedAt) || record.CollectedAt.Location() != time.UTC {
+				t.Errorf("collected at %s, want %s in UTC", record.CollectedAt, tt.wantCollectedAt)
+			}
+			if tt.wantClaim {
+				claim := claims[0].(SequenceModel)
+				if claim.ID.DeviceID != deviceID || claim.ID.Sequence != tt.metric.Sequence {
+					t.Errorf("claimed sequence %d of device %s, want %d of device %s", claim.ID.Sequence, claim.ID.DeviceID.Hex(), tt.metric.Sequence, deviceID.Hex())
+				}
+			}
+		})
+	}
+}
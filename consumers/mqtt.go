@@ -3,19 +3,25 @@ package main
 import (
 	"fmt"
 	"log"
+	"strings"
 
-	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/joaoribeirodasilva/mqtt-course/shared/broker"
+	"github.com/joaoribeirodasilva/mqtt-course/shared/tls"
 )
 
 type MQTTClient struct {
 	conf             *Configuration
-	mqttClient       mqtt.Client
-	mqttToken        mqtt.Token
-	onReceiveMessage mqtt.MessageHandler
+	mqttClient       broker.Client
+	onReceiveMessage broker.MessageHandler
 	isConnected      bool
 }
 
-func NewMQTTClient(conf *Configuration, onReceiveMessage mqtt.MessageHandler) *MQTTClient {
+const (
+	// MQTT 5 session expiry meaning the session never expires
+	sessionNeverExpires = 0xFFFFFFFF
+)
+
+func NewMQTTClient(conf *Configuration, onReceiveMessage broker.MessageHandler) *MQTTClient {
 
 	c := &MQTTClient{}
 
@@ -33,53 +39,94 @@ func (c *MQTTClient) Connect() error {
 		return nil
 	}
 
-	auth := ""
-	if c.conf.MQTT.Authentication.Use {
-		auth = fmt.Sprintf("%s:%s@", c.conf.MQTT.Authentication.Username, c.conf.MQTT.Authentication.Password)
+	endpoint := &broker.Endpoint{
+		Transport: c.conf.MQTT.Transport,
+		Host:      c.conf.MQTT.Host,
+		Port:      c.conf.MQTT.Port,
+		Path:      c.conf.MQTT.Websocket.Path,
+		Headers:   c.conf.MQTT.Websocket.Headers,
+		Proxy:     c.conf.MQTT.Websocket.Proxy,
+		Tls:       c.conf.MQTT.Tls.Use,
 	}
 
-	brokerUrl := fmt.Sprintf("tcp://%s%s:%d", auth, c.conf.MQTT.Host, c.conf.MQTT.Port)
-
 	//log.Printf("connecting to MQTT broker at %s ...", brokerUrl)
 
-	options := mqtt.NewClientOptions()
-
-	options.AddBroker(brokerUrl)
-
-	options.SetClientID(c.conf.MQTT.ClientID)
-	options.SetDefaultPublishHandler(c.onMessagePublishedHandler)
+	brokerUrl, err := endpoint.URL()
+	if err != nil {
+		return err
+	}
 
-	options.OnConnect = c.onConnectHandler
-	options.OnConnectionLost = c.onConnectLostHandler
+	options := broker.ClientOptions{
+		Endpoint:         endpoint,
+		ClientID:         c.conf.MQTT.ClientID,
+		DefaultHandler:   c.onMessagePublishedHandler,
+		OnConnectionLost: c.onConnectLostHandler,
+	}
 
 	if c.conf.MQTT.Authentication.Use {
 
-		options.SetUsername(c.conf.MQTT.Authentication.Username)
-		options.SetPassword(c.conf.MQTT.Authentication.Password)
+		options.Username = c.conf.MQTT.Authentication.Username
+		options.Password = c.conf.MQTT.Authentication.Password
+	}
+
+	// without a clean session the broker keeps the subscription and
+	// queues the messages published while the consumer is offline,
+	// with MQTT 5 only until the session expires
+	options.CleanSession = c.conf.MQTT.Session.CleanSession
+	options.SessionExpiry = c.conf.MQTT.Session.Expiry
+	if !options.CleanSession && options.SessionExpiry == 0 {
+		options.SessionExpiry = sessionNeverExpires
 	}
 
-	options.SetCleanSession(c.conf.Options.subscribe)
+	// TLS, with a client certificate for mutual TLS
+	if endpoint.IsSecure() {
 
-	// Add tls code
+		tlsConf := tls.NewTlsConfig(c.conf.MQTT.Tls.Crt, c.conf.MQTT.Tls.Key, c.conf.MQTT.Tls.Root, c.conf.MQTT.Tls.Insecure)
+		if err := tlsConf.Create(); err != nil {
+			return err
+		}
 
-	c.mqttClient = mqtt.NewClient(options)
-	if c.mqttToken = c.mqttClient.Connect(); c.mqttToken.Wait() && c.mqttToken.Error() != nil {
+		options.TLSConfig = tlsConf.Config
+	}
 
-		return fmt.Errorf("ERROR: [MQTT CLIENT] failed to connect to MQTT Broker at %s. REASON: %s", brokerUrl, c.mqttToken.Error().Error())
+	if c.mqttClient, err = broker.NewClient(c.conf.MQTT.ProtocolVersion, options); err != nil {
+		return err
 	}
 
+	if err := c.mqttClient.Connect(); err != nil {
+
+		return fmt.Errorf("ERROR: [MQTT CLIENT] failed to connect to MQTT Broker at %s. REASON: %s", brokerUrl, err.Error())
+	}
+
+	c.onConnectHandler()
+
 	return nil
 }
 
+// SubscribeTopic returns the topic filter subscribed, with a consumer group
+// it's the shared subscription $share/<group>/<topic> so the broker delivers
+// each message to only one consumer of the group
+func (c *MQTTClient) SubscribeTopic() string {
+
+	topic := c.conf.MQTT.Subscribe.Topic
+	if c.conf.MQTT.Group == "" || strings.HasPrefix(topic, "$share/") {
+		return topic
+	}
+
+	return fmt.Sprintf("$share/%s/%s", c.conf.MQTT.Group, topic)
+}
+
 func (c *MQTTClient) Subscribe(verbose bool) error {
 
+	topic := c.SubscribeTopic()
+
 	if c.conf.Options.debug {
-		log.Printf("subscribing MQTT topic %s with QOS %d ...", c.conf.MQTT.Subscribe.Topic, c.conf.MQTT.Subscribe.Qos)
+		log.Printf("subscribing MQTT topic %s with QOS %d ...", topic, c.conf.MQTT.Subscribe.Qos)
 	}
 
-	if c.mqttToken = c.mqttClient.Subscribe(c.conf.MQTT.Subscribe.Topic, c.conf.MQTT.Subscribe.Qos, c.onReceiveMessage); c.mqttToken.Wait() && c.mqttToken.Error() != nil {
+	if err := c.mqttClient.Subscribe(topic, c.conf.MQTT.Subscribe.Qos, c.onReceiveMessage); err != nil {
 
-		return c.mqttToken.Error()
+		return err
 	}
 
 	// log.Println(" subscribed")
@@ -89,13 +136,15 @@ func (c *MQTTClient) Subscribe(verbose bool) error {
 
 func (c *MQTTClient) Unsubscribe() error {
 
+	topic := c.SubscribeTopic()
+
 	if c.conf.Options.debug {
-		log.Printf("unsubscribing from MQTT topic %s  ...", c.conf.MQTT.Subscribe.Topic)
+		log.Printf("unsubscribing from MQTT topic %s  ...", topic)
 	}
 
-	if c.mqttToken = c.mqttClient.Unsubscribe(c.conf.MQTT.Subscribe.Topic); c.mqttToken.Wait() && c.mqttToken.Error() != nil {
+	if err := c.mqttClient.Unsubscribe(topic); err != nil {
 
-		return c.mqttToken.Error()
+		return err
 	}
 
 	//log.Println(" unsubscribed")
@@ -105,9 +154,9 @@ func (c *MQTTClient) Unsubscribe() error {
 
 func (c *MQTTClient) Publish(data []byte) error {
 
-	if c.mqttToken = c.mqttClient.Publish(c.conf.MQTT.Publish.Topic, c.conf.MQTT.Publish.Qos, false, data); c.mqttToken.Wait() && c.mqttToken.Error() != nil {
+	if err := c.mqttClient.Publish(c.conf.MQTT.Publish.Topic, data, broker.PublishOptions{Qos: c.conf.MQTT.Publish.Qos}); err != nil {
 
-		return c.mqttToken.Error()
+		return err
 	}
 
 	//log.Println(" published")
@@ -115,10 +164,16 @@ func (c *MQTTClient) Publish(data []byte) error {
 	return nil
 }
 
+// PublishTo publishes data to a topic other than the configured publish topic
+func (c *MQTTClient) PublishTo(topic string, qos byte, data []byte) error {
+
+	return c.mqttClient.Publish(topic, data, broker.PublishOptions{Qos: qos, ContentType: jsonContentType})
+}
+
 func (c *MQTTClient) Disconnect() {
 
 	if c.isConnected {
-		c.mqttClient.Disconnect(250)
+		c.mqttClient.Disconnect()
 		log.Println("INFO: [MQTT CLIENT] disconnected from MQTT Broker")
 		c.isConnected = false
 	}
@@ -129,12 +184,12 @@ func (c *MQTTClient) IsConnected() bool {
 	return c.isConnected
 }
 
-func (c *MQTTClient) onMessagePublishedHandler(client mqtt.Client, msg mqtt.Message) {
+func (c *MQTTClient) onMessagePublishedHandler(msg *broker.Message) {
 
 	// Message published to the broker
 }
 
-func (c *MQTTClient) onConnectHandler(client mqtt.Client) {
+func (c *MQTTClient) onConnectHandler() {
 
 	if c.conf.Options.debug {
 		log.Println("INFO: [MQTT CLIENT] connected to MQTT Broker")
@@ -142,7 +197,7 @@ func (c *MQTTClient) onConnectHandler(client mqtt.Client) {
 	c.isConnected = true
 }
 
-func (c *MQTTClient) onConnectLostHandler(client mqtt.Client, err error) {
+func (c *MQTTClient) onConnectLostHandler(err error) {
 
 	if c.conf.Options.debug {
 		log.Println("INFO: [MQTT CLIENT] MQTT Broker connection lost ")
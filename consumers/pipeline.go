@@ -0,0 +1,455 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Pipeline stores the received messages in the database in batches. The
+// messages are queued by the MQTT callback and a pool of workers inserts
+// them with a single InsertMany per batch, a batch is flushed when it's
+// full or when the flush interval expires.
+type Pipeline struct {
+	conf       *Configuration
+	db         *Database
+	devices    *DeviceCache
+	dead       *DeadLetters
+	clock      *ClockSkew
+	rollups    *Rollups
+	alerts     *Alerts
+	queue      chan *Message
+	mu         sync.RWMutex
+	closed     bool
+	isFull     atomic.Bool
+	workers    sync.WaitGroup
+	stored     atomic.Uint64
+	duplicates atomic.Uint64
+}
+
+// SequenceKey identifies a message of a device
+type SequenceKey struct {
+	DeviceID primitive.ObjectID `bson:"deviceId"`
+	Sequence uint64             `bson:"sequence"`
+}
+
+// SequenceModel is a message sequence already stored
+type SequenceModel struct {
+	ID        SequenceKey `bson:"_id"`
+	CreatedAt time.Time   `bson:"createdAt"`
+}
+
+const (
+	defaultQueueSize     = 10000
+	defaultQueueTimeout  = 5000
+	defaultWorkers       = 2
+	defaultBatchSize     = 500
+	defaultFlushInterval = 1000
+)
+
+// NewPipeline creates a new Pipeline struct pointer
+func NewPipeline(conf *Configuration, db *Database, devices *DeviceCache, dead *DeadLetters, alerts *Alerts) *Pipeline {
+
+	p := &Pipeline{}
+
+	p.conf = conf
+	p.db = db
+	p.devices = devices
+	p.dead = dead
+	p.alerts = alerts
+	p.clock = NewClockSkew(conf, db)
+	p.rollups = NewRollups(conf, db)
+
+	return p
+}
+
+// Start starts the pipeline workers
+func (p *Pipeline) Start() {
+
+	queueSize := p.conf.Pipeline.QueueSize
+	if queueSize <= 0 {
+		queueSize = defaultQueueSize
+	}
+
+	workers := p.conf.Pipeline.Workers
+	if workers <= 0 {
+		workers = defaultWorkers
+	}
+
+	p.mu.Lock()
+	p.queue = make(chan *Message, queueSize)
+	p.closed = false
+	p.mu.Unlock()
+
+	for i := 0; i < workers; i++ {
+		p.workers.Add(1)
+		go p.worker()
+	}
+
+	log.Printf("INFO: [PIPELINE] pipeline started with %d workers", workers)
+}
+
+// Enqueue queues a message to be stored. While the queue is full it blocks
+// the caller, so the MQTT client stops reading and the broker holds the
+// messages, for at most the queue timeout so the MQTT client keeps its
+// connection. It returns an error if the message wasn't queued because
+// the pipeline is stopped or the queue stayed full.
+func (p *Pipeline) Enqueue(msg *Message) error {
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if p.closed || p.queue == nil {
+		return fmt.Errorf("pipeline stopped")
+	}
+
+	select {
+	case p.queue <- msg:
+		p.isFull.Store(false)
+		return nil
+	default:
+	}
+
+	timeout := p.conf.Pipeline.QueueTimeout
+	if timeout <= 0 {
+		timeout = defaultQueueTimeout
+	}
+
+	// warn once until the queue has room again
+	if p.isFull.CompareAndSwap(false, true) {
+		log.Printf("WARNING: [PIPELINE] queue is full with %d messages, waiting for the database", cap(p.queue))
+	}
+
+	timer := time.NewTimer(time.Duration(timeout) * time.Millisecond)
+	defer timer.Stop()
+
+	select {
+	case p.queue <- msg:
+		return nil
+	case <-timer.C:
+		return fmt.Errorf("pipeline queue full for %d ms", timeout)
+	}
+}
+
+// Stop stops accepting messages and waits for the queued ones to be stored
+func (p *Pipeline) Stop() {
+
+	p.mu.Lock()
+	if p.closed || p.queue == nil {
+		p.mu.Unlock()
+		return
+	}
+	p.closed = true
+	close(p.queue)
+	p.mu.Unlock()
+
+	if p.conf.Options.debug {
+		log.Println("INFO: [PIPELINE] pipeline requested to stop... draining")
+	}
+
+	p.workers.Wait()
+
+	log.Printf("INFO: [PIPELINE] pipeline stopped, %d messages stored, %d duplicated messages dropped", p.stored.Load(), p.duplicates.Load())
+}
+
+// worker collects the queued messages into batches and stores them
+func (p *Pipeline) worker() {
+
+	defer p.workers.Done()
+
+	batchSize := p.conf.Pipeline.BatchSize
+	if batchSize <= 0 {
+		batchSize = defaultBatchSize
+	}
+
+	flushInterval := p.conf.Pipeline.FlushInterval
+	if flushInterval <= 0 {
+		flushInterval = defaultFlushInterval
+	}
+
+	batch := make([]*Message, 0, batchSize)
+
+	// the timer only runs while the batch has messages
+	timer := time.NewTimer(time.Duration(flushInterval) * time.Millisecond)
+	timer.Stop()
+
+	for {
+		select {
+		case msg, ok := <-p.queue:
+
+			// the queue is closed and empty
+			if !ok {
+				timer.Stop()
+				p.flush(batch)
+				return
+			}
+
+			if len(batch) == 0 {
+				timer.Reset(time.Duration(flushInterval) * time.Millisecond)
+			}
+
+			batch = append(batch, msg)
+
+			if len(batch) >= batchSize {
+				timer.Stop()
+				p.flush(batch)
+				batch = batch[:0]
+			}
+
+		case <-timer.C:
+			p.flush(batch)
+			batch = batch[:0]
+		}
+	}
+}
+
+// flush stores a batch of messages and updates the last metric time
+// of their devices
+func (p *Pipeline) flush(batch []*Message) {
+
+	if len(batch) == 0 {
+		return
+	}
+
+	devices, err := p.lookupDevices(batch)
+	if err != nil {
+		log.Printf("ERROR: [PIPELINE] failed to search for devices REASON: %v\n", err)
+		p.deadLetters(batch, reasonStoreFailed, err)
+		return
+	}
+
+	now := time.Now()
+
+	messages := make([]*Message, 0, len(batch))
+	for _, msg := range batch {
+
+		device, ok := devices[msg.DeviceID]
+		if !ok || device.UserID.IsZero() {
+			p.dead.AddMessage(msg, reasonUnknownDevice, fmt.Errorf("unknown or inactive device %s", msg.DeviceID.Hex()))
+			continue
+		}
+
+		messages = append(messages, msg)
+	}
+
+	messages = p.claimSequences(messages, now)
+	if len(messages) == 0 {
+		return
+	}
+
+	records := make([]interface{}, 0, len(messages))
+	for _, msg := range messages {
+
+		// the time series collection requires the collection time
+		collectedAt := msg.CollectedAt
+		skewed := false
+		if collectedAt.IsZero() {
+			collectedAt = now
+		} else {
+			skewed = p.clock.Observe(devices[msg.DeviceID], collectedAt, now)
+		}
+
+		records = append(records, MessageModel{
+			ID: primitive.NewObjectID(),
+			Meta: MessageMeta{
+				DeviceID: msg.DeviceID,
+				UserID:   devices[msg.DeviceID].UserID,
+			},
+			Sequence:    msg.Sequence,
+			ConsumerID:  p.conf.Mongo.ClientID,
+			Sensors:     msg.Sensors,
+			CollectedAt: collectedAt.UTC(),
+			Received:    now,
+			ClockSkewed: skewed,
+			Aggregate:   msg.Aggregate,
+		})
+	}
+
+	// unordered so a failed message doesn't stop the remaining ones
+	failed := make(map[int]bool)
+
+	_, err = p.db.GetCollection("metrics").InsertMany(context.TODO(), records, options.InsertMany().SetOrdered(false))
+	if err != nil {
+
+		bulkErr := mongo.BulkWriteException{}
+		if !errors.As(err, &bulkErr) {
+			log.Printf("ERROR: [PIPELINE] failed to save %d messages into database REASON: %v\n", len(records), err)
+			for i, msg := range messages {
+				failed[i] = true
+				p.dead.AddMessage(msg, reasonStoreFailed, err)
+			}
+		}
+
+		for _, writeErr := range bulkErr.WriteErrors {
+			failed[writeErr.Index] = true
+			p.dead.AddMessage(messages[writeErr.Index], reasonStoreFailed, writeErr)
+		}
+
+		if bulkErr.WriteConcernError != nil {
+			log.Printf("ERROR: [PIPELINE] failed to save messages into database REASON: %v\n", bulkErr.WriteConcernError)
+		}
+	}
+
+	p.releaseSequences(messages, failed)
+
+	storedRecords := make([]MessageModel, 0, len(records))
+	for i, record := range records {
+		if !failed[i] {
+			storedRecords = append(storedRecords, record.(MessageModel))
+		}
+	}
+	p.rollups.Add(storedRecords)
+	p.alerts.Evaluate(storedRecords)
+
+	// one last metric time update per device with new messages
+	updated := make(map[primitive.ObjectID]bool)
+	models := make([]mongo.WriteModel, 0)
+
+	for i, msg := range messages {
+
+		deviceID := msg.DeviceID
+		if failed[i] || updated[deviceID] {
+			continue
+		}
+		updated[deviceID] = true
+
+		models = append(models, mongo.NewUpdateOneModel().
+			SetFilter(bson.D{{Key: "_id", Value: deviceID}}).
+			SetUpdate(bson.D{{Key: "$set", Value: bson.D{{Key: "lastMetricTime", Value: now.UTC()}}}}))
+	}
+
+	stored := len(records) - len(failed)
+	p.stored.Add(uint64(stored))
+
+	if len(models) > 0 {
+		if _, err := p.db.GetCollection("devices").BulkWrite(context.TODO(), models, options.BulkWrite().SetOrdered(false)); err != nil {
+			log.Printf("ERROR: [PIPELINE] failed to update devices last message time REASON: %v\n", err)
+		}
+	}
+
+	if p.conf.Options.debug {
+		log.Printf("INFO: [PIPELINE] stored %d of %d messages\n", stored, len(batch))
+	}
+}
+
+// claimSequences records the sequences of the messages in the sequences
+// collection, its _id is the device id and sequence so the messages already
+// stored by any consumer are rejected as duplicates and dropped. The time
+// series collection can't have a unique index to reject them itself.
+func (p *Pipeline) claimSequences(messages []*Message, now time.Time) []*Message {
+
+	claims := make([]interface{}, 0, len(messages))
+	indexes := make([]int, 0, len(messages))
+
+	for i, msg := range messages {
+
+		if msg.Sequence == 0 {
+			continue
+		}
+
+		claims = append(claims, SequenceModel{
+			ID:        SequenceKey{DeviceID: msg.DeviceID, Sequence: msg.Sequence},
+			CreatedAt: now.UTC(),
+		})
+		indexes = append(indexes, i)
+	}
+
+	if len(claims) == 0 {
+		return messages
+	}
+
+	rejected := make(map[int]bool)
+
+	_, err := p.db.GetCollection(sequencesCollection).InsertMany(context.TODO(), claims, options.InsertMany().SetOrdered(false))
+	if err != nil {
+
+		bulkErr := mongo.BulkWriteException{}
+		if !errors.As(err, &bulkErr) {
+			log.Printf("ERROR: [PIPELINE] failed to save %d message sequences into database REASON: %v\n", len(claims), err)
+			for _, i := range indexes {
+				rejected[i] = true
+				p.dead.AddMessage(messages[i], reasonStoreFailed, err)
+			}
+		}
+
+		for _, writeErr := range bulkErr.WriteErrors {
+
+			i := indexes[writeErr.Index]
+			rejected[i] = true
+
+			if mongo.IsDuplicateKeyError(writeErr) {
+				p.duplicates.Add(1)
+				continue
+			}
+
+			p.dead.AddMessage(messages[i], reasonStoreFailed, writeErr)
+		}
+	}
+
+	if len(rejected) == 0 {
+		return messages
+	}
+
+	accepted := make([]*Message, 0, len(messages)-len(rejected))
+	for i, msg := range messages {
+		if !rejected[i] {
+			accepted = append(accepted, msg)
+		}
+	}
+
+	return accepted
+}
+
+// releaseSequences removes the sequences of the messages not stored,
+// so the messages aren't dropped as duplicates when they're received
+// again or replayed
+func (p *Pipeline) releaseSequences(messages []*Message, failed map[int]bool) {
+
+	keys := make([]SequenceKey, 0, len(failed))
+	for i := range failed {
+		if messages[i].Sequence != 0 {
+			keys = append(keys, SequenceKey{DeviceID: messages[i].DeviceID, Sequence: messages[i].Sequence})
+		}
+	}
+
+	if len(keys) == 0 {
+		return
+	}
+
+	filter := bson.D{{Key: "_id", Value: bson.D{{Key: "$in", Value: keys}}}}
+	if _, err := p.db.GetCollection(sequencesCollection).DeleteMany(context.TODO(), filter); err != nil {
+		log.Printf("ERROR: [PIPELINE] failed to release %d message sequences REASON: %v\n", len(keys), err)
+	}
+}
+
+// deadLetters stores the messages of a batch as dead letters
+func (p *Pipeline) deadLetters(batch []*Message, reason string, err error) {
+
+	for _, msg := range batch {
+		p.dead.AddMessage(msg, reason, err)
+	}
+}
+
+// lookupDevices returns the active devices of a batch of messages
+func (p *Pipeline) lookupDevices(batch []*Message) (map[primitive.ObjectID]*Device, error) {
+
+	ids := make([]primitive.ObjectID, 0)
+	seen := make(map[primitive.ObjectID]bool)
+	for _, msg := range batch {
+		if !seen[msg.DeviceID] {
+			seen[msg.DeviceID] = true
+			ids = append(ids, msg.DeviceID)
+		}
+	}
+
+	return p.devices.Lookup(ids)
+}
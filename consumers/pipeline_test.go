@@ -0,0 +1,52 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPipelineEnqueue(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		queued  int
+		closed  bool
+		drain   bool
+		wantErr bool
+	}{
+		{"room in the queue", 0, false, false, false},
+		{"room freed while waiting", 1, false, true, false},
+		{"queue stays full", 1, false, false, true},
+		{"pipeline stopped", 0, true, false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			conf := &Configuration{}
+			conf.Pipeline.QueueTimeout = 50
+
+			p := &Pipeline{conf: conf, queue: make(chan *Message, 1), closed: tt.closed}
+			for i := 0; i < tt.queued; i++ {
+				p.queue <- &Message{}
+			}
+
+			if tt.drain {
+				go func() {
+					time.Sleep(10 * time.Millisecond)
+					<-p.queue
+				}()
+			}
+
+			started := time.Now()
+			err := p.Enqueue(&Message{})
+
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %t", err, tt.wantErr)
+			}
+			if elapsed := time.Since(started); elapsed > time.Second {
+				t.Errorf("enqueue blocked for %s", elapsed)
+			}
+		})
+	}
+}
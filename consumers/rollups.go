@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/joaoribeirodasilva/mqtt-course/shared/timeseries"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Rollups keeps the hourly and daily statistics of the readings of each
+// device up to date as the readings are stored. The statistics of a bucket
+// are updated with $inc, $min and $max so the consumers of a group update
+// the same buckets in any order. Numeric sensors keep their min, max, sum
+// and count, doors keep the time each opening was last seen open, keyed by
+// the time it opened, so the openings and the open time of a bucket can
+// be computed no matter which consumer received each reading.
+type Rollups struct {
+	conf *Configuration
+	db   *Database
+}
+
+// RollupModel is the statistics of the readings of a device in a bucket
+type RollupModel struct {
+	DeviceID primitive.ObjectID              `json:"deviceId" bson:"deviceId"`
+	Time     time.Time                       `json:"time" bson:"time"`
+	UserID   primitive.ObjectID              `json:"userId" bson:"userId"`
+	Count    int64                           `json:"count" bson:"count"`
+	Sensors  map[string]*RollupStats         `json:"sensors" bson:"sensors"`
+	Doors    map[string]map[string]time.Time `json:"doors" bson:"doors"`
+}
+
+// RollupStats are the statistics of a numeric sensor in a bucket
+type RollupStats struct {
+	Min   float64 `json:"min" bson:"min"`
+	Max   float64 `json:"max" bson:"max"`
+	Sum   float64 `json:"sum" bson:"sum"`
+	Count int64   `json:"count" bson:"count"`
+}
+
+// rollupResolution is a rollup collection and its bucket size
+type rollupResolution struct {
+	collection string
+	size       time.Duration
+}
+
+// rollupKey identifies the bucket of a device
+type rollupKey struct {
+	deviceID primitive.ObjectID
+	time     time.Time
+}
+
+var rollupResolutions = []rollupResolution{
+	{collection: timeseries.HourlyRollups, size: time.Hour},
+	{collection: timeseries.DailyRollups, size: 24 * time.Hour},
+}
+
+// NewRollups creates a new Rollups struct pointer
+func NewRollups(conf *Configuration, db *Database) *Rollups {
+
+	r := &Rollups{}
+
+	r.conf = conf
+	r.db = db
+
+	return r
+}
+
+// Add adds the stored readings to the statistics of their buckets
+func (r *Rollups) Add(records []MessageModel) {
+
+	if len(records) == 0 {
+		return
+	}
+
+	for _, resolution := range rollupResolutions {
+
+		buckets := make(map[rollupKey]*RollupModel)
+		for _, record := range records {
+			accumulateRollup(buckets, resolution, record)
+		}
+
+		models := make([]mongo.WriteModel, 0, len(buckets))
+		for _, bucket := range buckets {
+			models = append(models, mongo.NewUpdateOneModel().
+				SetFilter(bson.D{{Key: "deviceId", Value: bucket.DeviceID}, {Key: "time", Value: bucket.Time}}).
+				SetUpdate(incrementRollup(bucket)).
+				SetUpsert(true))
+		}
+
+		if _, err := r.db.GetCollection(resolution.collection).BulkWrite(context.TODO(), models, options.BulkWrite().SetOrdered(false)); err != nil {
+			log.Printf("ERROR: [ROLLUPS] failed to update %d buckets of %s REASON: %v\n", len(models), resolution.collection, err)
+		}
+	}
+}
+
+// accumulateRollup adds a reading to the statistics of its bucket
+func accumulateRollup(buckets map[rollupKey]*RollupModel, resolution rollupResolution, record MessageModel) {
+
+	key := rollupKey{deviceID: record.Meta.DeviceID, time: record.CollectedAt.UTC().Truncate(resolution.size)}
+
+	bucket, ok := buckets[key]
+	if !ok {
+		bucket = &RollupModel{
+			DeviceID: key.deviceID,
+			Time:     key.time,
+			UserID:   record.Meta.UserID,
+			Sensors:  make(map[string]*RollupStats),
+			Doors:    make(map[string]map[string]time.Time),
+		}
+		buckets[key] = bucket
+	}
+
+	// an aggregated reading counts as the readings it merged
+	count := int64(1)
+	if record.Aggregate != nil && record.Aggregate.Count > 1 {
+		count = int64(record.Aggregate.Count)
+	}
+
+	bucket.Count += count
+
+	sensors, ok := sensorFields(record.Sensors)
+	if !ok {
+		return
+	}
+
+	for name, reading := range sensors {
+
+		// the names are used in the update paths
+		if name == "" || strings.ContainsAny(name, ".$") {
+			continue
+		}
+
+		if value, ok := sensorValue(reading); ok {
+
+			// the value of an aggregated reading is the average
+			low, high := aggregateRange(record.Aggregate, name, value)
+
+			stats, ok := bucket.Sensors[name]
+			if !ok {
+				stats = &RollupStats{Min: low, Max: high}
+				bucket.Sensors[name] = stats
+			}
+
+			stats.Min = min(stats.Min, low)
+			stats.Max = max(stats.Max, high)
+			stats.Sum += value * float64(count)
+			stats.Count += count
+
+			continue
+		}
+
+		// a door reports if it's open and when it opened
+		fields, ok := sensorFields(reading)
+		if !ok {
+			continue
+		}
+
+		isOpen, ok := fields["IsOpen"].(bool)
+		if !ok || !isOpen {
+			continue
+		}
+
+		openTime, ok := sensorTime(fields["OpenTime"])
+		if !ok {
+			continue
+		}
+
+		openings, ok := bucket.Doors[name]
+		if !ok {
+			openings = make(map[string]time.Time)
+			bucket.Doors[name] = openings
+		}
+
+		opening := strconv.FormatInt(openTime.UnixMilli(), 10)
+		if last, ok := openings[opening]; !ok || record.CollectedAt.After(last) {
+			openings[opening] = record.CollectedAt.UTC()
+		}
+	}
+}
+
+// incrementRollup returns the update adding the statistics of a bucket
+func incrementRollup(bucket *RollupModel) bson.D {
+
+	inc := bson.D{{Key: "count", Value: bucket.Count}}
+	minimums := bson.D{}
+	maximums := bson.D{}
+
+	for name, stats := range bucket.Sensors {
+
+		path := "sensors." + name
+		inc = append(inc, bson.E{Key: path + ".sum", Value: stats.Sum}, bson.E{Key: path + ".count", Value: stats.Count})
+		minimums = append(minimums, bson.E{Key: path + ".min", Value: stats.Min})
+		maximums = append(maximums, bson.E{Key: path + ".max", Value: stats.Max})
+	}
+
+	for name, openings := range bucket.Doors {
+		for opening, last := range openings {
+			maximums = append(maximums, bson.E{Key: "doors." + name + "." + opening, Value: last})
+		}
+	}
+
+	update := bson.D{
+		{Key: "$setOnInsert", Value: bson.D{{Key: "userId", Value: bucket.UserID}}},
+		{Key: "$inc", Value: inc},
+	}
+
+	if len(minimums) > 0 {
+		update = append(update, bson.E{Key: "$min", Value: minimums})
+	}
+	if len(maximums) > 0 {
+		update = append(update, bson.E{Key: "$max", Value: maximums})
+	}
+
+	return update
+}
+
+// sensorFields returns the fields of a sensor reading, the readings are
+// decoded from the device messages or read back from the database
+func sensorFields(reading interface{}) (map[string]interface{}, bool) {
+
+	switch fields := reading.(type) {
+	case map[string]interface{}:
+		return fields, true
+	case primitive.M:
+		return fields, true
+	case primitive.D:
+		m := make(map[string]interface{}, len(fields))
+		for _, field := range fields {
+			m[field.Key] = field.Value
+		}
+		return m, true
+	}
+
+	return nil, false
+}
+
+// sensorValue returns the value of a numeric sensor, a number
+// or an object with the value in CurrentValue
+func sensorValue(reading interface{}) (float64, bool) {
+
+	switch value := reading.(type) {
+	case float64:
+		return value, true
+	case int32:
+		return float64(value), true
+	case int64:
+		return float64(value), true
+	}
+
+	if fields, ok := sensorFields(reading); ok {
+		if value, ok := fields["CurrentValue"]; ok {
+			return sensorValue(value)
+		}
+	}
+
+	return 0, false
+}
+
+// aggregateRange returns the min and max of a numeric sensor, the aggregate
+// keys them by the sensor name or by the path of its CurrentValue field
+func aggregateRange(aggregate *MessageAggregate, name string, value float64) (float64, float64) {
+
+	low, high := value, value
+	if aggregate == nil {
+		return low, high
+	}
+
+	for _, key := range []string{name, name + ".CurrentValue"} {
+		if m, ok := aggregate.Min[key]; ok {
+			low = min(low, m)
+		}
+		if m, ok := aggregate.Max[key]; ok {
+			high = max(high, m)
+		}
+	}
+
+	return low, high
+}
+
+// sensorTime returns a time of a sensor reading
+func sensorTime(value interface{}) (time.Time, bool) {
+
+	switch value := value.(type) {
+	case string:
+		t, err := time.Parse(time.RFC3339Nano, value)
+		return t, err == nil
+	case time.Time:
+		return value, true
+	case primitive.DateTime:
+		return value.Time(), true
+	}
+
+	return time.Time{}, false
+}
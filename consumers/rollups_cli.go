@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"time"
+
+	"github.com/joaoribeirodasilva/mqtt-course/shared/timeseries"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// rollupsCommand rebuilds the hourly and daily statistics of the days in
+// a range from the stored readings, e.g. after migrating old readings. The
+// buckets are replaced so the range shouldn't include the current day,
+// where the consumers are still adding readings.
+func rollupsCommand(conf *Configuration, db *Database, args []string) int {
+
+	strFrom := ""
+	strTo := ""
+
+	flags := flag.NewFlagSet("rollups", flag.ContinueOnError)
+	flags.StringVar(&strFrom, "from", "", "first day rebuilt, RFC 3339")
+	flags.StringVar(&strTo, "to", "", "end of the range, RFC 3339, defaults to the start of today")
+	if err := flags.Parse(args); err != nil {
+		return 1
+	}
+
+	day := 24 * time.Hour
+
+	from, err := time.Parse(time.RFC3339, strFrom)
+	if err != nil {
+		log.Printf("ERROR: [ROLLUPS] invalid -from date/time: %s", strFrom)
+		return 1
+	}
+
+	to := time.Now().UTC().Truncate(day)
+	if strTo != "" {
+		if to, err = time.Parse(time.RFC3339, strTo); err != nil {
+			log.Printf("ERROR: [ROLLUPS] invalid -to date/time: %s", strTo)
+			return 1
+		}
+	}
+
+	for start := from.UTC().Truncate(day); start.Before(to); start = start.Add(day) {
+
+		count, err := rebuildRollups(db, start, start.Add(day))
+		if err != nil {
+			log.Println(err.Error())
+			return 1
+		}
+
+		log.Printf("INFO: [ROLLUPS] rebuilt %s from %d readings", start.Format(time.DateOnly), count)
+	}
+
+	return 0
+}
+
+// rebuildRollups replaces the buckets of a day with the statistics of its readings
+func rebuildRollups(db *Database, start time.Time, end time.Time) (int, error) {
+
+	filter := bson.D{{Key: timeseries.TimeField, Value: bson.D{{Key: "$gte", Value: start}, {Key: "$lt", Value: end}}}}
+
+	cursor, err := db.GetCollection("metrics").Find(context.TODO(), filter)
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close(context.TODO())
+
+	buckets := make(map[string]map[rollupKey]*RollupModel)
+	for _, resolution := range rollupResolutions {
+		buckets[resolution.collection] = make(map[rollupKey]*RollupModel)
+	}
+
+	count := 0
+	for cursor.Next(context.TODO()) {
+
+		record := MessageModel{}
+		if err := cursor.Decode(&record); err != nil {
+			return count, err
+		}
+
+		for _, resolution := range rollupResolutions {
+			accumulateRollup(buckets[resolution.collection], resolution, record)
+		}
+		count++
+	}
+
+	if err := cursor.Err(); err != nil {
+		return count, err
+	}
+
+	for _, resolution := range rollupResolutions {
+
+		models := make([]mongo.WriteModel, 0, len(buckets[resolution.collection]))
+		for _, bucket := range buckets[resolution.collection] {
+			models = append(models, mongo.NewReplaceOneModel().
+				SetFilter(bson.D{{Key: "deviceId", Value: bucket.DeviceID}, {Key: "time", Value: bucket.Time}}).
+				SetReplacement(bucket).
+				SetUpsert(true))
+		}
+
+		if len(models) == 0 {
+			continue
+		}
+
+		if _, err := db.GetCollection(resolution.collection).BulkWrite(context.TODO(), models, options.BulkWrite().SetOrdered(false)); err != nil {
+			return count, err
+		}
+	}
+
+	return count, nil
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestAccumulateRollup(t *testing.T) {
+
+	deviceID := primitive.NewObjectID()
+	hour := time.Date(2024, 1, 31, 10, 0, 0, 0, time.UTC)
+	opened := hour.Add(-time.Minute)
+	reopened := hour.Add(20 * time.Minute)
+
+	reading := func(minutes int, temperature float64, openTime *time.Time) MessageModel {
+		door := map[string]interface{}{"IsOpen": openTime != nil}
+		if openTime != nil {
+			door["OpenTime"] = openTime.Format(time.RFC3339Nano)
+		}
+		return MessageModel{
+			Meta: MessageMeta{DeviceID: deviceID},
+			Sensors: map[string]interface{}{
+				"temperature":  map[string]interface{}{"CurrentValue": temperature},
+				"humidity":     float64(50),
+				"door":         door,
+				"invalid.name": float64(1),
+			},
+			CollectedAt: hour.Add(time.Duration(minutes) * time.Minute),
+		}
+	}
+
+	// four readings merged by the device, the values are their averages
+	aggregated := reading(5, -19, nil)
+	aggregated.Aggregate = &MessageAggregate{
+		Count: 4,
+		Min:   map[string]float64{"temperature.CurrentValue": -22, "humidity": 45},
+		Max:   map[string]float64{"temperature.CurrentValue": -16, "humidity": 52},
+	}
+
+	tests := []struct {
+		name         string
+		records      []MessageModel
+		wantBuckets  int
+		wantCount    int64
+		wantTemp     RollupStats
+		wantHumidity RollupStats
+		wantOpenings int
+	}{
+		{
+			name:         "readings",
+			records:      []MessageModel{reading(0, -20, nil), reading(30, -18, nil)},
+			wantBuckets:  1,
+			wantCount:    2,
+			wantTemp:     RollupStats{Min: -20, Max: -18, Sum: -38, Count: 2},
+			wantHumidity: RollupStats{Min: 50, Max: 50, Sum: 100, Count: 2},
+		},
+		{
+			name:         "aggregated reading",
+			records:      []MessageModel{aggregated},
+			wantBuckets:  1,
+			wantCount:    4,
+			wantTemp:     RollupStats{Min: -22, Max: -16, Sum: -76, Count: 4},
+			wantHumidity: RollupStats{Min: 45, Max: 52, Sum: 200, Count: 4},
+		},
+		{
+			name:         "aggregated reading and reading",
+			records:      []MessageModel{aggregated, reading(10, -25, nil)},
+			wantBuckets:  1,
+			wantCount:    5,
+			wantTemp:     RollupStats{Min: -25, Max: -16, Sum: -101, Count: 5},
+			wantHumidity: RollupStats{Min: 45, Max: 52, Sum: 250, Count: 5},
+		},
+		{
+			name:         "two hours",
+			records:      []MessageModel{reading(59, -20, nil), reading(60, -18, nil)},
+			wantBuckets:  2,
+			wantCount:    1,
+			wantTemp:     RollupStats{Min: -20, Max: -20, Sum: -20, Count: 1},
+			wantHumidity: RollupStats{Min: 50, Max: 50, Sum: 50, Count: 1},
+		},
+		{
+			name:         "door openings",
+			records:      []MessageModel{reading(1, -20, &opened), reading(2, -20, &opened), reading(3, -20, nil), reading(21, -20, &reopened)},
+			wantBuckets:  1,
+			wantCount:    4,
+			wantTemp:     RollupStats{Min: -20, Max: -20, Sum: -80, Count: 4},
+			wantHumidity: RollupStats{Min: 50, Max: 50, Sum: 200, Count: 4},
+			wantOpenings: 2,
+		},
+	}
+
+	hourly := rollupResolutions[0]
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			buckets := make(map[rollupKey]*RollupModel)
+			for _, record := range tt.records {
+				accumulateRollup(buckets, hourly, record)
+			}
+
+			if len(buckets) != tt.wantBuckets {
+				t.Fatalf("%d buckets, want %d", len(buckets), tt.wantBuckets)
+			}
+
+			bucket := buckets[rollupKey{deviceID: deviceID, time: hour}]
+			if bucket == nil {
+				t.Fatalf("no bucket for %s", hour)
+			}
+
+			if bucket.Count != tt.wantCount {
+				t.Errorf("bucket count is %d, want %d", bucket.Count, tt.wantCount)
+			}
+			if *bucket.Sensors["temperature"] != tt.wantTemp {
+				t.Errorf("temperature statistics %+v, want %+v", *bucket.Sensors["temperature"], tt.wantTemp)
+			}
+			if *bucket.Sensors["humidity"] != tt.wantHumidity {
+				t.Errorf("humidity statistics %+v, want %+v", *bucket.Sensors["humidity"], tt.wantHumidity)
+			}
+			if _, ok := bucket.Sensors["invalid.name"]; ok {
+				t.Errorf("a sensor name with a dot was kept")
+			}
+			if len(bucket.Doors["door"]) != tt.wantOpenings {
+				t.Errorf("%d door openings, want %d", len(bucket.Doors["door"]), tt.wantOpenings)
+			}
+		})
+	}
+}
+
+func TestAggregateRange(t *testing.T) {
+
+	aggregate := &MessageAggregate{
+		Count: 3,
+		Min:   map[string]float64{"temperature.CurrentValue": -22, "humidity": 45},
+		Max:   map[string]float64{"temperature.CurrentValue": -16, "humidity": 52},
+	}
+
+	tests := []struct {
+		name      string
+		aggregate *MessageAggregate
+		sensor    string
+		value     float64
+		wantLow   float64
+		wantHigh  float64
+	}{
+		{"reading", nil, "temperature", -19, -19, -19},
+		{"sensor with fields", aggregate, "temperature", -19, -22, -16},
+		{"sensor value", aggregate, "humidity", 50, 45, 52},
+		{"sensor not merged", aggregate, "pressure", 1000, 1000, 1000},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			low, high := aggregateRange(tt.aggregate, tt.sensor, tt.value)
+			if low != tt.wantLow || high != tt.wantHigh {
+				t.Errorf("range is %v to %v, want %v to %v", low, high, tt.wantLow, tt.wantHigh)
+			}
+		})
+	}
+}
+
+func TestIncrementRollup(t *testing.T) {
+
+	last := time.Date(2024, 1, 31, 10, 2, 0, 0, time.UTC)
+
+	tests := []struct {
+		name   string
+		bucket *RollupModel
+		want   map[string]bson.M
+	}{
+		{
+			name:   "count only",
+			bucket: &RollupModel{Count: 2},
+			want:   map[string]bson.M{"$inc": {"count": int64(2)}},
+		},
+		{
+			name: "sensors and doors",
+			bucket: &RollupModel{
+				Count:   4,
+				Sensors: map[string]*RollupStats{"temperature": {Min: -22, Max: -16, Sum: -76, Count: 4}},
+				Doors:   map[string]map[string]time.Time{"door": {"1706695140000": last}},
+			},
+			want: map[string]bson.M{
+				"$inc": {"count": int64(4), "sensors.temperature.sum": float64(-76), "sensors.temperature.count": int64(4)},
+				"$min": {"sensors.temperature.min": float64(-22)},
+				"$max": {"sensors.temperature.max": float64(-16), "doors.door.1706695140000": last},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			update := incrementRollup(tt.bucket)
+
+			for _, operator := range []string{"$inc", "$min", "$max"} {
+
+				got := bson.M{}
+				for _, e := range update {
+					if e.Key == operator {
+						for _, field := range e.Value.(bson.D) {
+							got[field.Key] = field.Value
+						}
+					}
+				}
+
+				want := tt.want[operator]
+				if len(got) != len(want) {
+					t.Errorf("%s is %v, want %v", operator, got, want)
+					continue
+				}
+				for key, value := range want {
+					if got[key] != value {
+						t.Errorf("%s %s is %v, want %v", operator, key, got[key], value)
+					}
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Batch runs the simulation over a virtual time range as fast as possible
+// and writes the resulting messages to a JSONL/CSV file or publishes them
+// to the MQTT Broker
+type Batch struct {
+	conf       *Configuration
+	simulation *Simulation
+	clock      *VirtualClock
+	broker     *MQTTClient
+	out        *os.File
+	writer     *bufio.Writer
+	csv        *csv.Writer
+	columns    []string
+	count      int
+	sequence   uint64
+	err        error
+}
+
+const (
+	batchFormatJSONL = "jsonl"
+	batchFormatCSV   = "csv"
+)
+
+// batchSequenceBit marks the sequences of the messages generated in batch
+// mode, the sequences of a running device are far below it so a backfill
+// never reuses the sequence of a live message, whatever their start time
+const batchSequenceBit = uint64(1) << 62
+
+// NewBatch creates a new Batch struct pointer
+func NewBatch(conf *Configuration) *Batch {
+
+	b := &Batch{}
+
+	// the configuration doesn't change in batch mode
+	live := NewLiveConfiguration(conf)
+
+	b.conf = conf
+	b.simulation = NewSimulation(live, b)
+	b.clock = NewVirtualClock(live, b.simulation)
+	b.count = 0
+
+	return b
+}
+
+// Run generates the messages until the batch end time
+func (b *Batch) Run() error {
+
+	if b.conf.Options.batchEnd == "" {
+		return fmt.Errorf("ERROR: [BATCH] the -end option is required in batch mode")
+	}
+
+	end, err := time.Parse(time.RFC3339, b.conf.Options.batchEnd)
+	if err != nil {
+		return fmt.Errorf("ERROR: [BATCH] invalid end time: %s REASON: %s", b.conf.Options.batchEnd, err.Error())
+	}
+
+	if b.conf.Clock.Interval*b.conf.Clock.Multiplier == 0 {
+		return fmt.Errorf("ERROR: [BATCH] the clock interval and multiplier must be greater than 0")
+	}
+
+	// without a start time the run starts now, so a past end
+	// time would generate nothing
+	start := b.clock.startTime()
+	if !end.After(start) {
+		return fmt.Errorf("ERROR: [BATCH] the end time %s must be after the start time %s, set -start to generate past readings", end.Format(time.RFC3339), start.Format(time.RFC3339))
+	}
+
+	if err := b.simulation.Load(); err != nil {
+		return err
+	}
+
+	if err := b.open(); err != nil {
+		return err
+	}
+
+	// stop generating on SIGINT or SIGTERM keeping
+	// the messages already written
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sigChan)
+
+	go func() {
+		if _, ok := <-sigChan; ok {
+			b.clock.RequestStop()
+		}
+	}()
+
+	log.Printf("INFO: [BATCH] generating messages from %s until %s", start.Format(time.RFC3339), end.Format(time.RFC3339))
+
+	started := time.Now()
+	b.clock.Run(start, end)
+
+	if err := b.close(); err != nil && b.err == nil {
+		b.err = err
+	}
+
+	if b.err != nil {
+		return b.err
+	}
+
+	log.Printf("INFO: [BATCH] generated %d messages in %s", b.count, time.Since(started).Round(time.Millisecond))
+
+	return nil
+}
+
+// Append writes the simulation readings, it's called by the simulation
+// at every virtual clock tick
+func (b *Batch) Append(item *Sensors, collectedAt time.Time) {
+
+	// after the first error nothing else is written
+	if b.err != nil || item == nil {
+		return
+	}
+
+	// the sequence follows the virtual time in microseconds so the output
+	// stays reproducible, marked so it never matches a live message sequence
+	b.sequence++
+	if virtual := batchSequenceBit | uint64(collectedAt.UnixMicro()); virtual > b.sequence {
+		b.sequence = virtual
+	}
+
+	msg := &Message{
+		DeviceID:    b.conf.ID,
+		Sequence:    b.sequence,
+		Sensors:     *item,
+		CollectedAt: collectedAt.UTC(),
+	}
+
+	if err := b.write(msg); err != nil {
+		b.err = err
+		b.clock.RequestStop()
+		return
+	}
+
+	b.count++
+
+	if b.conf.Options.debug && b.count%10000 == 0 {
+		log.Printf("INFO: [BATCH] %d messages generated, virtual time %s", b.count, collectedAt.Format(time.RFC3339))
+	}
+}
+
+// open opens the output file or connects to the MQTT Broker
+func (b *Batch) open() error {
+
+	if b.conf.Options.batchPublish {
+
+		b.broker = NewMQTTClient(NewLiveConfiguration(b.conf), nil)
+
+		return b.broker.Connect()
+	}
+
+	format := strings.ToLower(b.conf.Options.batchFormat)
+	if format != batchFormatJSONL && format != batchFormatCSV {
+		return fmt.Errorf("ERROR: [BATCH] invalid output format %s", b.conf.Options.batchFormat)
+	}
+
+	if b.conf.Options.batchOut == "" {
+		return fmt.Errorf("ERROR: [BATCH] the -out or -publish option is required in batch mode")
+	}
+
+	file, err := os.Create(b.conf.Options.batchOut)
+	if err != nil {
+		return fmt.Errorf("ERROR: [BATCH] failed to create output file: %s REASON: %s", b.conf.Options.batchOut, err.Error())
+	}
+	b.out = file
+
+	b.writer = bufio.NewWriter(b.out)
+
+	if format == batchFormatCSV {
+
+		b.csv = csv.NewWriter(b.writer)
+
+		// the columns are the flattened initial sensor readings
+		b.columns = make([]string, 0)
+		for _, sensor := range b.simulation.sensors {
+			b.columns = append(b.columns, flattenReading(sensor.Name(), sensor.Reading())...)
+		}
+		sort.Strings(b.columns)
+
+		header := append([]string{"deviceId", "collectedAt"}, b.columns...)
+		if err := b.csv.Write(header); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// write writes or publishes a single message
+func (b *Batch) write(msg *Message) error {
+
+	if b.broker != nil {
+
+		bytes, err := json.Marshal(msg)
+		if err != nil {
+			return err
+		}
+
+		return b.broker.Publish(bytes)
+	}
+
+	if b.csv != nil {
+
+		values := make(map[string]string)
+		for name, reading := range msg.Sensors {
+			flattenValues(name, reading, values)
+		}
+
+		record := []string{msg.DeviceID, msg.CollectedAt.Format(time.RFC3339Nano)}
+		for _, column := range b.columns {
+			record = append(record, values[column])
+		}
+
+		return b.csv.Write(record)
+	}
+
+	bytes, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	if _, err := b.writer.Write(append(bytes, '\n')); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// close flushes and closes the output or disconnects from the MQTT Broker
+func (b *Batch) close() error {
+
+	if b.broker != nil {
+		b.broker.Disconnect()
+		return nil
+	}
+
+	if b.csv != nil {
+		b.csv.Flush()
+		if err := b.csv.Error(); err != nil {
+			return err
+		}
+	}
+
+	if err := b.writer.Flush(); err != nil {
+		return err
+	}
+
+	return b.out.Close()
+}
+
+// flattenReading returns the CSV column names of a sensor reading
+func flattenReading(name string, reading interface{}) []string {
+
+	values := make(map[string]string)
+	flattenValues(name, reading, values)
+
+	columns := make([]string, 0, len(values))
+	for column := range values {
+		columns = append(columns, column)
+	}
+
+	return columns
+}
+
+// flattenValues converts a sensor reading into sensor.field CSV values
+func flattenValues(name string, reading interface{}, values map[string]string) {
+
+	bytes, err := json.Marshal(reading)
+	if err != nil {
+		return
+	}
+
+	fields := make(map[string]interface{})
+	if err := json.Unmarshal(bytes, &fields); err != nil {
+
+		// the reading isn't an object
+		values[name] = ""
+		var value interface{}
+		if json.Unmarshal(bytes, &value) == nil {
+			values[name] = formatValue(value)
+		}
+		return
+	}
+
+	for field, value := range fields {
+		values[name+"."+field] = formatValue(value)
+	}
+}
+
+func formatValue(value interface{}) string {
+
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	case string:
+		return v
+	default:
+		bytes, _ := json.Marshal(v)
+		return string(bytes)
+	}
+}
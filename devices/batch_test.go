@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// sequenceRun simulates a device from its configured start time until end
+// and returns the sequences of the generated messages
+type sequenceRun func(t *testing.T, conf *Configuration, end time.Time) []uint64
+
+func liveRun(t *testing.T, conf *Configuration, end time.Time) []uint64 {
+
+	live := NewLiveConfiguration(conf)
+	dl := NewDataList(live)
+	simulation := NewSimulation(live, dl)
+	if err := simulation.Load(); err != nil {
+		t.Fatalf("load failed: %s", err.Error())
+	}
+
+	NewVirtualClock(live, simulation).Run(*conf.StartTime(), end)
+
+	return sequences(dl.GetHeadN(dl.Len()))
+}
+
+func batchRun(t *testing.T, conf *Configuration, end time.Time) []uint64 {
+
+	conf.Options.batchEnd = end.Format(time.RFC3339)
+	conf.Options.batchFormat = batchFormatJSONL
+	conf.Options.batchOut = filepath.Join(t.TempDir(), "backfill.jsonl")
+
+	if err := NewBatch(conf).Run(); err != nil {
+		t.Fatalf("batch failed: %s", err.Error())
+	}
+
+	file, err := os.Open(conf.Options.batchOut)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	seqs := make([]uint64, 0)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		msg := Message{}
+		if err := json.Unmarshal(scanner.Bytes(), &msg); err != nil {
+			t.Fatal(err)
+		}
+		seqs = append(seqs, msg.Sequence)
+	}
+
+	return seqs
+}
+
+func TestSequenceSpaces(t *testing.T) {
+
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	end := start.Add(time.Minute)
+
+	tests := []struct {
+		name     string
+		first    sequenceRun
+		second   sequenceRun
+		offset   time.Duration
+		wantSame bool
+	}{
+		{"live runs with the same start", liveRun, liveRun, 0, true},
+		{"backfills with the same start", batchRun, batchRun, 0, true},
+		{"backfill and live run with the same start", batchRun, liveRun, 0, false},
+		// the first live sequence is the virtual time of the first backfill message
+		{"live run starting during a backfill", batchRun, liveRun, time.Second - time.Microsecond, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			newConf := func(start time.Time) *Configuration {
+				conf := &Configuration{ID: "device", Options: &Options{}, startOverride: &start}
+				conf.Clock.Interval = 1000
+				conf.Clock.Multiplier = 1
+				conf.Data.MaxMessages = 1000
+				return conf
+			}
+
+			first := tt.first(t, newConf(start), end)
+			second := tt.second(t, newConf(start.Add(tt.offset)), end.Add(tt.offset))
+
+			if len(first) != 60 || len(second) != 60 {
+				t.Fatalf("generated %d and %d messages, want 60", len(first), len(second))
+			}
+
+			if tt.wantSame {
+				if !sameSequences(first, second) {
+					t.Errorf("sequences %v and %v differ, want the same", first, second)
+				}
+				return
+			}
+
+			seen := make(map[uint64]bool)
+			for _, seq := range first {
+				seen[seq] = true
+			}
+			for _, seq := range second {
+				if seen[seq] {
+					t.Errorf("sequence %d is used by both runs", seq)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+)
+
+// Command is the envelope of the commands received
+// in the device subscribe topic
+type Command struct {
+	Command   string          `json:"command"`
+	RequestID string          `json:"requestId"`
+	Args      json.RawMessage `json:"args"`
+}
+
+// CommandResponse is the envelope of the command replies
+// published in the device response topic
+type CommandResponse struct {
+	DeviceID  string      `json:"deviceId"`
+	Command   string      `json:"command"`
+	RequestID string      `json:"requestId"`
+	Success   bool        `json:"success"`
+	Error     string      `json:"error,omitempty"`
+	Data      interface{} `json:"data,omitempty"`
+	Time      time.Time   `json:"time"`
+}
+
+// CommandHandler executes a command and returns the response data
+type CommandHandler func(args json.RawMessage) (interface{}, error)
+
+type Commander struct {
+	conf       *LiveConfiguration
+	simulation *Simulation
+	statusList *DataList
+	handlers   map[string]CommandHandler
+}
+
+type setpointArgs struct {
+	Sensor string   `json:"sensor"`
+	Value  *float64 `json:"value"`
+}
+
+type openDoorArgs struct {
+	Sensor   string `json:"sensor"`
+	Duration int64  `json:"duration"`
+}
+
+type statusData struct {
+	VirtualTime *time.Time    `json:"virtualTime"`
+	Buffered    int           `json:"buffered"`
+	Interval    int64         `json:"interval"`
+	Overflow    OverflowStats `json:"overflow"`
+	Sensors     Sensors       `json:"sensors"`
+}
+
+// NewCommander creates a new command dispatcher with the
+// simulation commands registered
+func NewCommander(conf *LiveConfiguration, simulation *Simulation, list *DataList) *Commander {
+
+	c := &Commander{}
+
+	c.conf = conf
+	c.simulation = simulation
+	c.statusList = list
+	c.handlers = make(map[string]CommandHandler)
+
+	c.Register("setSetpoint", c.setSetpoint)
+	c.Register("openDoor", c.openDoor)
+	c.Register("status", c.status)
+
+	return c
+}
+
+// Register registers a command handler
+func (c *Commander) Register(command string, handler CommandHandler) {
+
+	c.handlers[command] = handler
+}
+
+// Handle parses and executes a command payload and returns the response
+func (c *Commander) Handle(payload []byte) *CommandResponse {
+
+	response := &CommandResponse{
+		DeviceID: c.conf.Get().ID,
+		Time:     time.Now().UTC(),
+	}
+
+	cmd := Command{}
+	if err := json.Unmarshal(payload, &cmd); err != nil {
+		response.Error = fmt.Sprintf("invalid command envelope: %s", err.Error())
+		return response
+	}
+
+	response.Command = cmd.Command
+	response.RequestID = cmd.RequestID
+
+	handler, ok := c.handlers[cmd.Command]
+	if !ok {
+		response.Error = fmt.Sprintf("unknown command %s", cmd.Command)
+		return response
+	}
+
+	if c.conf.Get().Options.debug {
+		log.Printf("INFO: [COMMAND] executing command %s request %s", cmd.Command, cmd.RequestID)
+	}
+
+	data, err := handler(cmd.Args)
+	if err != nil {
+		response.Error = err.Error()
+		return response
+	}
+
+	response.Success = true
+	response.Data = data
+
+	return response
+}
+
+func (c *Commander) setSetpoint(args json.RawMessage) (interface{}, error) {
+
+	setpoint := setpointArgs{}
+	if err := decodeCommandArgs(args, &setpoint); err != nil {
+		return nil, err
+	}
+
+	if setpoint.Sensor == "" || setpoint.Value == nil {
+		return nil, fmt.Errorf("sensor and value arguments are required")
+	}
+
+	if err := c.simulation.SetSetpoint(setpoint.Sensor, *setpoint.Value); err != nil {
+		return nil, err
+	}
+
+	return setpoint, nil
+}
+
+func (c *Commander) openDoor(args json.RawMessage) (interface{}, error) {
+
+	openDoor := openDoorArgs{}
+	if err := decodeCommandArgs(args, &openDoor); err != nil {
+		return nil, err
+	}
+
+	if openDoor.Sensor == "" {
+		openDoor.Sensor = defaultDoorSensor
+	}
+
+	if openDoor.Duration <= 0 {
+		return nil, fmt.Errorf("duration argument must be greater than 0")
+	}
+
+	if err := c.simulation.OpenDoor(openDoor.Sensor, time.Duration(openDoor.Duration)*time.Millisecond); err != nil {
+		return nil, err
+	}
+
+	return openDoor, nil
+}
+
+func (c *Commander) status(args json.RawMessage) (interface{}, error) {
+
+	sensors, virtualTime := c.simulation.Status()
+
+	status := statusData{
+		VirtualTime: virtualTime,
+		Buffered:    c.statusList.Len(),
+		Interval:    c.conf.Get().MQTT.Interval,
+		Overflow:    c.statusList.Overflow(),
+		Sensors:     sensors,
+	}
+
+	return status, nil
+}
+
+// decodeCommandArgs decodes the command arguments if any
+func decodeCommandArgs(args json.RawMessage, v interface{}) error {
+
+	if len(args) == 0 {
+		return nil
+	}
+
+	if err := json.Unmarshal(args, v); err != nil {
+		return fmt.Errorf("invalid arguments: %s", err.Error())
+	}
+
+	return nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+)
+
+// ConfigUpdater applies configuration patches received over MQTT
+// to the running device and persists them
+type ConfigUpdater struct {
+	conf       *LiveConfiguration
+	mu         sync.Mutex
+	simulation *Simulation
+}
+
+type configureData struct {
+	Version int64 `json:"version"`
+}
+
+// NewConfigUpdater creates a new ConfigUpdater struct pointer
+func NewConfigUpdater(conf *LiveConfiguration, simulation *Simulation) *ConfigUpdater {
+
+	u := &ConfigUpdater{}
+
+	u.conf = conf
+	u.simulation = simulation
+
+	return u
+}
+
+// Configure is the command handler receiving a JSON merge patch
+// of the device configuration
+func (u *ConfigUpdater) Configure(args json.RawMessage) (interface{}, error) {
+
+	if len(args) == 0 {
+		return nil, fmt.Errorf("a configuration patch is required")
+	}
+
+	version, err := u.Update(args)
+	if err != nil {
+		return nil, err
+	}
+
+	return configureData{Version: version}, nil
+}
+
+// Update validates a configuration patch, persists the resulting configuration
+// and applies it to the running device. It returns the new configuration version.
+func (u *ConfigUpdater) Update(patch []byte) (int64, error) {
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	var version int64
+	var state *simulationState
+
+	// the configuration is replaced, never changed, so the virtual clock,
+	// data list and dial read a consistent snapshot at every iteration,
+	// a new data path moves the data log at the next save
+	err := u.conf.Update(func(current *Configuration) (*Configuration, error) {
+
+		patched, err := current.Patch(patch)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := patched.Validate(); err != nil {
+			return nil, err
+		}
+
+		// build the sensors and scenario of the new configuration
+		// so an invalid sensor configuration is refused, they're
+		// only applied once the configuration is stored
+		if !sameJSON(current.Sensors, patched.Sensors) || current.Scenario != patched.Scenario || !sameJSON(current.Clock.Seed, patched.Clock.Seed) {
+			if state, err = u.simulation.prepare(patched); err != nil {
+				return nil, err
+			}
+		}
+
+		patched.Version = current.Version + 1
+		version = patched.Version
+
+		// persist before applying so the running device never
+		// has a configuration that isn't stored
+		if err := patched.Write(); err != nil {
+			return nil, err
+		}
+
+		return patched, nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	// only the changed sensors are created again,
+	// the others keep their state
+	if state != nil {
+		u.simulation.apply(state)
+	}
+
+	log.Printf("INFO: [CONFIGURATION] configuration version %d applied", version)
+
+	return version, nil
+}
+
+// sameJSON returns true if both values have the same JSON representation
+func sameJSON(a interface{}, b interface{}) bool {
+
+	aBytes, errA := json.Marshal(a)
+	bBytes, errB := json.Marshal(b)
+
+	return errA == nil && errB == nil && bytes.Equal(aBytes, bBytes)
+}
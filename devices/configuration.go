@@ -6,13 +6,28 @@ import (
 	"log"
 	"os"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/joaoribeirodasilva/mqtt-course/shared/broker"
 )
 
 type ClockConf struct {
-	Interval uint64 `json:"interval"`
-	Multiplier uint64 `json:"multiplier"`
+	Interval   uint64     `json:"interval"`
+	Multiplier uint64     `json:"multiplier"`
+	StartTime  *time.Time `json:"startTime"`
+	Seed       *int64     `json:"seed"`
+}
+
+type SensorConf struct {
+	Name     string          `json:"name"`
+	Type     string          `json:"type"`
+	Settings json.RawMessage `json:"settings"`
 }
 
+type SensorsConf []SensorConf
+
 type SensorDoorConf struct {
 	Chance  float64 `json:"chance"`
 	MaxTime int64   `json:"maxTime"`
@@ -24,25 +39,63 @@ type SensorNumericConf struct {
 	Increase float64 `json:"increase"`
 	Decrease float64 `json:"decrease"`
 	Max      float64 `json:"max"`
+	Door     string  `json:"door"`
+	Defrost  string  `json:"defrost"`
+}
+
+type SensorThermalConf struct {
+	Setpoint     float64  `json:"setpoint"`
+	Hysteresis   float64  `json:"hysteresis"`
+	Ambient      float64  `json:"ambient"`
+	ThermalMass  float64  `json:"thermalMass"`
+	Insulation   float64  `json:"insulation"`
+	CoolingPower float64  `json:"coolingPower"`
+	DoorExchange float64  `json:"doorExchange"`
+	Initial      *float64 `json:"initial"`
+	Door         string   `json:"door"`
+	Defrost      string   `json:"defrost"`
+}
+
+type SensorHumidityConf struct {
+	Normal             float64 `json:"normal"`
+	AmbientTemperature float64 `json:"ambientTemperature"`
+	AmbientHumidity    float64 `json:"ambientHumidity"`
+	DoorExchangeRate   float64 `json:"doorExchangeRate"`
+	DryingRate         float64 `json:"dryingRate"`
+	DefrostRate        float64 `json:"defrostRate"`
+	Temperature        string  `json:"temperature"`
+	Door               string  `json:"door"`
+	Defrost            string  `json:"defrost"`
 }
 
-type SensorsConf struct {
-	DoorOpen    SensorDoorConf    `json:"doorOpen"`
-	Temperature SensorNumericConf `json:"temperature"`
-	Humidity    SensorNumericConf `json:"humidity"`
+type SensorDefrostConf struct {
+	Interval    int64   `json:"interval"`
+	Duration    int64   `json:"duration"`
+	Offset      int64   `json:"offset"`
+	HeaterPower float64 `json:"heaterPower"`
 }
 
 type DataConf struct {
-	Path         string `json:"path"`
-	SaveInterval int64  `json:"saveInterval"`
-	MaxMessages  uint32 `json:"maxMessages"`
+	Path         string       `json:"path"`
+	SaveInterval int64        `json:"saveInterval"`
+	MaxMessages  uint32       `json:"maxMessages"`
+	Sync         string       `json:"sync"`
+	SegmentSize  int64        `json:"segmentSize"`
+	Overflow     OverflowConf `json:"overflow"`
+}
+
+type OverflowConf struct {
+	Policy     string `json:"policy"`
+	Factor     int    `json:"factor"`
+	BucketSize int    `json:"bucketSize"`
 }
 
 type TLSConf struct {
-	Use  bool   `json:"use"`
-	Root string `json:"root"`
-	Crt  string `json:"ctr"`
-	Key  string `json:"key"`
+	Use      bool   `json:"use"`
+	Insecure bool   `json:"insecure"`
+	Root     string `json:"root"`
+	Crt      string `json:"crt"`
+	Key      string `json:"key"`
 }
 
 type TopicConf struct {
@@ -51,6 +104,32 @@ type TopicConf struct {
 }
 
 
+type WebsocketConf struct {
+	Path    string            `json:"path"`
+	Headers map[string]string `json:"headers"`
+	Proxy   string            `json:"proxy"`
+}
+
+type BatchConf struct {
+	Size     int `json:"size"`
+	MaxBytes int `json:"maxBytes"`
+}
+
+type SessionConf struct {
+	Persistent   bool   `json:"persistent"`
+	CleanSession bool   `json:"cleanSession"`
+	KeepAlive    int64  `json:"keepAlive"`
+	ReconnectMin int64  `json:"reconnectMin"`
+	ReconnectMax int64  `json:"reconnectMax"`
+	Expiry       uint32 `json:"expiry"`
+}
+
+type PropertiesConf struct {
+	MessageExpiry uint32 `json:"messageExpiry"`
+	SchemaVersion string `json:"schemaVersion"`
+	ContentType   string `json:"contentType"`
+}
+
 type AuthConf struct {
 	Use      bool   `json:"use"`
 	Username string `json:"username"`
@@ -58,32 +137,50 @@ type AuthConf struct {
 }
 
 type MQTTConf struct {
-	ClientID       string    `json:"clientId"`
-	Host           string    `json:"host"`
-	Port           int       `json:"port"`
+	ClientID        string         `json:"clientId"`
+	Host            string         `json:"host"`
+	Port            int            `json:"port"`
+	ProtocolVersion int            `json:"protocolVersion"`
+	Transport       string         `json:"transport"`
+	Websocket       WebsocketConf  `json:"websocket"`
 	Interval int64 `json:"interval"`
-	Publish        TopicConf `json:"publish"`
-	Subscribe      TopicConf `json:"subscribe"`
-	Authentication AuthConf  `json:"authentication"`
-	Tls            TLSConf   `json:"tls"`
+	Publish         TopicConf      `json:"publish"`
+	Subscribe       TopicConf      `json:"subscribe"`
+	Response        TopicConf      `json:"response"`
+	Batch           BatchConf      `json:"batch"`
+	Session         SessionConf    `json:"session"`
+	Properties      PropertiesConf `json:"properties"`
+	Authentication  AuthConf       `json:"authentication"`
+	Tls             TLSConf        `json:"tls"`
 }
 
 type ApiConf struct {
-	Host  string `json:"certificates"`
+	Host  string `json:"host"`
 	Port  int    `json:"port"`
 	Token string `json:"token"`
 }
 
 type Configuration struct {
 	device         int                  `json:"-"`
+	Version        int64                `json:"version"`
 	ID             string               `json:"id"`
 	Account        string               `json:"account"`
 	Clock          ClockConf          `json:"clock"`
 	Sensors        SensorsConf        `json:"sensors"`
+	Scenario       string             `json:"scenario"`
 	Data           DataConf                 `json:"data"`
 	MQTT 		   MQTTConf  			`json:"mqtt"`
+	Api            ApiConf              `json:"api"`
 	Options        *Options             `json:"-"`
 	configPath     string
+	startOverride  *time.Time
+}
+
+// LiveConfiguration holds the configuration of the running device, an update
+// replaces the whole configuration so readers take a snapshot with Get
+type LiveConfiguration struct {
+	mu      sync.Mutex
+	current atomic.Pointer[Configuration]
 }
 
 const (
@@ -121,22 +218,244 @@ func (conf *Configuration) Read() error {
 		return fmt.Errorf("ERROR: failed to parse configuration file: %s REASON: %s", conf.configPath, err.Error())
 	}
 
+	// the command line options override the configuration file
+	// without being written back to it
+	if conf.Options.startTime != "" {
+		startTime, err := time.Parse(time.RFC3339, conf.Options.startTime)
+		if err != nil {
+			return fmt.Errorf("ERROR: invalid start time: %s REASON: %s", conf.Options.startTime, err.Error())
+		}
+		conf.startOverride = &startTime
+	}
+
 	return nil
 }
 
+// Seed returns the simulation random seed, the -seed option
+// overrides the configured one
+func (conf *Configuration) Seed() *int64 {
+
+	if conf.Options != nil && conf.Options.seed != nil {
+		seed := *conf.Options.seed
+		return &seed
+	}
+
+	return conf.Clock.Seed
+}
+
+// StartTime returns the virtual clock start time, the -start option
+// overrides the configured one
+func (conf *Configuration) StartTime() *time.Time {
+
+	if conf.startOverride != nil {
+		return conf.startOverride
+	}
+
+	return conf.Clock.StartTime
+}
+
+// Write writes the configuration file atomically, the data is written
+// to a temporary file that replaces the configuration file once synced
 func (conf *Configuration) Write() error {
 
 	log.Println("INFO: [CONFIGURATION] writing client configuration")
 
-	data, err := json.Marshal(conf)
+	data, err := json.MarshalIndent(conf, "", "    ")
 	if err != nil {
 		return fmt.Errorf("ERROR: failed to create JSON for configuration file REASON: %s", err.Error())
 	}
 
-	err = os.WriteFile(conf.configPath, data, os.ModePerm)
+	tmpPath := conf.configPath + ".tmp"
+
+	file, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, os.ModePerm)
+	if err != nil {
+		return fmt.Errorf("ERROR: failed to write configuration file: %s REASON: %s", tmpPath, err.Error())
+	}
+
+	if _, err = file.Write(data); err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("ERROR: failed to write configuration file: %s REASON: %s", tmpPath, err.Error())
+	}
+
+	if err = os.Rename(tmpPath, conf.configPath); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("ERROR: failed to replace configuration file: %s REASON: %s", conf.configPath, err.Error())
+	}
+
+	return nil
+}
+
+// Patch returns a copy of the configuration with a JSON merge patch (RFC 7386)
+// applied, objects are merged, null values remove keys and arrays are replaced
+func (conf *Configuration) Patch(patch []byte) (*Configuration, error) {
+
+	var patchDoc interface{}
+	if err := json.Unmarshal(patch, &patchDoc); err != nil {
+		return nil, fmt.Errorf("ERROR: invalid configuration patch REASON: %s", err.Error())
+	}
+
+	if _, ok := patchDoc.(map[string]interface{}); !ok {
+		return nil, fmt.Errorf("ERROR: invalid configuration patch REASON: the patch must be a JSON object")
+	}
+
+	current, err := json.Marshal(conf)
 	if err != nil {
-		return fmt.Errorf("ERROR: failed to write configuration file: %s REASON: %s", conf.configPath, err.Error())
+		return nil, fmt.Errorf("ERROR: failed to create JSON for configuration REASON: %s", err.Error())
 	}
 
+	var currentDoc interface{}
+	if err := json.Unmarshal(current, &currentDoc); err != nil {
+		return nil, fmt.Errorf("ERROR: failed to parse configuration REASON: %s", err.Error())
+	}
+
+	merged, err := json.Marshal(mergePatch(currentDoc, patchDoc))
+	if err != nil {
+		return nil, fmt.Errorf("ERROR: failed to create JSON for configuration REASON: %s", err.Error())
+	}
+
+	patched := &Configuration{}
+	if err := json.Unmarshal(merged, patched); err != nil {
+		return nil, fmt.Errorf("ERROR: invalid configuration patch REASON: %s", err.Error())
+	}
+
+	if patched.ID != conf.ID {
+		return nil, fmt.Errorf("ERROR: invalid configuration patch REASON: the device id can't be changed")
+	}
+
+	patched.device = conf.device
+	patched.Options = conf.Options
+	patched.configPath = conf.configPath
+	patched.startOverride = conf.startOverride
+
+	return patched, nil
+}
+
+// Validate checks the configuration values
+func (conf *Configuration) Validate() error {
+
+	if conf.Clock.Interval == 0 || conf.Clock.Multiplier == 0 {
+		return fmt.Errorf("ERROR: clock interval and multiplier must be greater than 0")
+	}
+
+	if conf.Data.Path == "" || conf.Data.SaveInterval <= 0 || conf.Data.MaxMessages == 0 {
+		return fmt.Errorf("ERROR: data path, saveInterval and maxMessages are required")
+	}
+
+	if conf.Data.Sync != "" && conf.Data.Sync != walSyncAlways && conf.Data.Sync != walSyncInterval && conf.Data.Sync != walSyncNever {
+		return fmt.Errorf("ERROR: invalid data sync policy %s", conf.Data.Sync)
+	}
+
+	if conf.Data.SegmentSize < 0 {
+		return fmt.Errorf("ERROR: data segmentSize can't be negative")
+	}
+
+	switch conf.Data.Overflow.Policy {
+	case "", overflowDropOldest, overflowDropNewest, overflowDownsample, overflowAggregate:
+	default:
+		return fmt.Errorf("ERROR: invalid data overflow policy %s", conf.Data.Overflow.Policy)
+	}
+
+	if conf.Data.Overflow.Factor < 0 || conf.Data.Overflow.BucketSize < 0 {
+		return fmt.Errorf("ERROR: data overflow factor and bucketSize can't be negative")
+	}
+
+	if conf.MQTT.Host == "" || conf.MQTT.Port <= 0 || conf.MQTT.Port > 65535 {
+		return fmt.Errorf("ERROR: invalid MQTT host or port")
+	}
+
+	endpoint := broker.Endpoint{Transport: conf.MQTT.Transport}
+	if _, err := endpoint.Scheme(); err != nil {
+		return err
+	}
+
+	switch conf.MQTT.ProtocolVersion {
+	case 0, broker.ProtocolV3, 4, broker.ProtocolV5:
+	default:
+		return fmt.Errorf("ERROR: invalid MQTT protocol version %d", conf.MQTT.ProtocolVersion)
+	}
+
+	if conf.MQTT.Interval <= 0 {
+		return fmt.Errorf("ERROR: MQTT interval must be greater than 0")
+	}
+
+	if conf.MQTT.Publish.Topic == "" || conf.MQTT.Subscribe.Topic == "" {
+		return fmt.Errorf("ERROR: MQTT publish and subscribe topics are required")
+	}
+
+	if conf.MQTT.Batch.Size < 0 || conf.MQTT.Batch.MaxBytes < 0 {
+		return fmt.Errorf("ERROR: MQTT batch size and maxBytes can't be negative")
+	}
+
+	if conf.MQTT.Session.KeepAlive < 0 || conf.MQTT.Session.ReconnectMin < 0 || conf.MQTT.Session.ReconnectMax < 0 {
+		return fmt.Errorf("ERROR: MQTT session keepAlive, reconnectMin and reconnectMax can't be negative")
+	}
+
+	if conf.MQTT.Publish.Qos > 2 || conf.MQTT.Subscribe.Qos > 2 || conf.MQTT.Response.Qos > 2 {
+		return fmt.Errorf("ERROR: MQTT QOS must be between 0 and 2")
+	}
+
+	return nil
+}
+
+// mergePatch applies a JSON merge patch document to a target document
+func mergePatch(target interface{}, patch interface{}) interface{} {
+
+	patchObj, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+
+	targetObj, ok := target.(map[string]interface{})
+	if !ok {
+		targetObj = make(map[string]interface{})
+	}
+
+	for key, value := range patchObj {
+		if value == nil {
+			delete(targetObj, key)
+		} else {
+			targetObj[key] = mergePatch(targetObj[key], value)
+		}
+	}
+
+	return targetObj
+}
+
+// NewLiveConfiguration creates a new LiveConfiguration struct pointer
+func NewLiveConfiguration(conf *Configuration) *LiveConfiguration {
+
+	lc := &LiveConfiguration{}
+
+	lc.current.Store(conf)
+
+	return lc
+}
+
+// Get returns the current configuration, it must not be changed
+func (lc *LiveConfiguration) Get() *Configuration {
+
+	return lc.current.Load()
+}
+
+// Update calls change with the current configuration and replaces it with
+// the returned configuration unless an error is returned, updates are serialized
+func (lc *LiveConfiguration) Update(change func(current *Configuration) (*Configuration, error)) error {
+
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+
+	updated, err := change(lc.current.Load())
+	if err != nil {
+		return err
+	}
+
+	lc.current.Store(updated)
+
 	return nil
 }
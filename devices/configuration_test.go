@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMergePatch(t *testing.T) {
+
+	// the examples of the RFC 7386 appendix A
+	tests := []struct {
+		name   string
+		target string
+		patch  string
+		want   string
+	}{
+		{"replace value", `{"a":"b"}`, `{"a":"c"}`, `{"a":"c"}`},
+		{"add key", `{"a":"b"}`, `{"b":"c"}`, `{"a":"b","b":"c"}`},
+		{"remove key", `{"a":"b"}`, `{"a":null}`, `{}`},
+		{"remove one of two keys", `{"a":"b","b":"c"}`, `{"a":null}`, `{"b":"c"}`},
+		{"replace array with value", `{"a":["b"]}`, `{"a":"c"}`, `{"a":"c"}`},
+		{"replace value with array", `{"a":"c"}`, `{"a":["b"]}`, `{"a":["b"]}`},
+		{"merge nested object", `{"a":{"b":"c"}}`, `{"a":{"b":"d","c":null}}`, `{"a":{"b":"d"}}`},
+		{"replace array of objects", `{"a":[{"b":"c"}]}`, `{"a":[1]}`, `{"a":[1]}`},
+		{"replace array", `["a","b"]`, `["c","d"]`, `["c","d"]`},
+		{"replace object with array", `{"a":"b"}`, `["c"]`, `["c"]`},
+		{"replace object with null", `{"a":"foo"}`, `null`, `null`},
+		{"replace object with string", `{"a":"foo"}`, `"bar"`, `"bar"`},
+		{"keep null value", `{"e":null}`, `{"a":1}`, `{"a":1,"e":null}`},
+		{"replace array with object", `[1,2]`, `{"a":"b","c":null}`, `{"a":"b"}`},
+		{"create nested object", `{}`, `{"a":{"bb":{"ccc":null}}}`, `{"a":{"bb":{}}}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			var target, patch interface{}
+			if err := json.Unmarshal([]byte(tt.target), &target); err != nil {
+				t.Fatalf("invalid target: %s", err.Error())
+			}
+			if err := json.Unmarshal([]byte(tt.patch), &patch); err != nil {
+				t.Fatalf("invalid patch: %s", err.Error())
+			}
+
+			got, err := json.Marshal(mergePatch(target, patch))
+			if err != nil {
+				t.Fatalf("failed to marshal the result: %s", err.Error())
+			}
+
+			if string(got) != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConfigurationPatch(t *testing.T) {
+
+	seed := int64(7)
+	override := int64(42)
+	startTime := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	conf := &Configuration{ID: "device-1", Options: &Options{seed: &override}, startOverride: &startTime}
+	conf.Clock.Interval = 1000
+	conf.Clock.Seed = &seed
+	conf.MQTT.Host = "localhost"
+
+	tests := []struct {
+		name    string
+		patch   string
+		wantErr string
+		check   func(t *testing.T, patched *Configuration)
+	}{
+		{
+			name:  "merge nested value",
+			patch: `{"clock":{"interval":500}}`,
+			check: func(t *testing.T, patched *Configuration) {
+				if patched.Clock.Interval != 500 {
+					t.Errorf("interval is %d, want 500", patched.Clock.Interval)
+				}
+				if patched.MQTT.Host != "localhost" {
+					t.Errorf("host is %q, want localhost", patched.MQTT.Host)
+				}
+			},
+		},
+		{
+			name:  "remove value",
+			patch: `{"clock":{"seed":null}}`,
+			check: func(t *testing.T, patched *Configuration) {
+				if patched.Clock.Seed != nil {
+					t.Errorf("seed is %d, want none", *patched.Clock.Seed)
+				}
+			},
+		},
+		{
+			name:  "keep command line overrides",
+			patch: `{"clock":{"seed":9}}`,
+			check: func(t *testing.T, patched *Configuration) {
+				if *patched.Clock.Seed != 9 {
+					t.Errorf("configured seed is %d, want 9", *patched.Clock.Seed)
+				}
+				if *patched.Seed() != 42 {
+					t.Errorf("seed is %d, want the -seed override 42", *patched.Seed())
+				}
+				if !patched.StartTime().Equal(startTime) {
+					t.Errorf("start time is %s, want the -start override %s", patched.StartTime(), startTime)
+				}
+			},
+		},
+		{name: "change id", patch: `{"id":"device-2"}`, wantErr: "device id can't be changed"},
+		{name: "not an object", patch: `[1]`, wantErr: "must be a JSON object"},
+		{name: "invalid JSON", patch: `{`, wantErr: "invalid configuration patch"},
+		{name: "invalid type", patch: `{"clock":{"interval":"fast"}}`, wantErr: "invalid configuration patch"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			patched, err := conf.Patch([]byte(tt.patch))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			}
+
+			tt.check(t, patched)
+
+			if conf.Clock.Interval != 1000 || *conf.Clock.Seed != 7 {
+				t.Errorf("the original configuration was changed")
+			}
+		})
+	}
+}
+
+func TestConfigurationSeed(t *testing.T) {
+
+	configured := int64(7)
+	zero := int64(0)
+	override := int64(42)
+
+	tests := []struct {
+		name       string
+		configured *int64
+		override   *int64
+		want       *int64
+	}{
+		{"no seed", nil, nil, nil},
+		{"configured seed", &configured, nil, &configured},
+		{"override", &configured, &override, &override},
+		{"zero override", &configured, &zero, &zero},
+		{"override without configured seed", nil, &override, &override},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			conf := &Configuration{ID: "device", Options: &Options{seed: tt.override}}
+			conf.Clock.Seed = tt.configured
+
+			got := conf.Seed()
+			if (got == nil) != (tt.want == nil) || (got != nil && *got != *tt.want) {
+				t.Errorf("seed is %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -2,24 +2,55 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
 	"log"
+	"math/rand"
+	"os"
+	"os/signal"
 	"syscall"
 	"time"
 
+	"github.com/joaoribeirodasilva/mqtt-course/shared/broker"
 	"github.com/joaoribeirodasilva/wait_signals"
 )
 
 type Dial struct {
-	conf          *Configuration
+	conf          *LiveConfiguration
 	broker        *MQTTClient
 	statusList    *DataList
+	commander     *Commander
+	commands      chan *broker.Message
+	wake          chan bool
+	attempts      int
+	nextAttempt   time.Time
 	isStarted     bool
 	stopRequested bool
 	finished      chan bool
 }
 
+// MessageBatch is the envelope of several messages published at once
+type MessageBatch struct {
+	DeviceID string            `json:"deviceId"`
+	Count    int               `json:"count"`
+	Messages []json.RawMessage `json:"messages"`
+}
+
+type setIntervalArgs struct {
+	Interval int64 `json:"interval"`
+}
+
+type flushData struct {
+	Published int `json:"published"`
+}
+
+const (
+	maxPendingCommands  = 100
+	defaultReconnectMin = 1000
+	defaultReconnectMax = 60000
+)
+
 // NewDial create a new Dial struct pointer
-func NewDial(conf *Configuration, list *DataList) *Dial {
+func NewDial(conf *LiveConfiguration, list *DataList, commander *Commander) *Dial {
 
 	d := &Dial{}
 
@@ -27,7 +58,14 @@ func NewDial(conf *Configuration, list *DataList) *Dial {
 	d.isStarted = false
 	d.stopRequested = false
 	d.statusList = list
-	d.broker = NewMQTTClient(conf)
+	d.commander = commander
+	d.commands = make(chan *broker.Message, maxPendingCommands)
+	d.wake = make(chan bool, 1)
+	d.broker = NewMQTTClient(conf, d.onMessageReceived)
+
+	// commands changing the dial itself
+	d.commander.Register("setInterval", d.setInterval)
+	d.commander.Register("flush", d.flush)
 
 	return d
 }
@@ -50,28 +88,38 @@ func (d *Dial) Start() error {
 
 		for !d.stopRequested {
 
+			// keep a long-lived connection
+			if d.conf.Get().MQTT.Session.Persistent {
+				if d.keepConnected() {
+					break
+				}
+				continue
+			}
+
 			if d.statusList.IsDirty() {
 				if err := d.broker.Connect(); err == nil {
 					d.broker.Subscribe()
 					d.Publish()
+					d.processCommands()
 					d.broker.Disconnect()
 				} else {
 					log.Printf("ERROR: [DIAL] MQTT failed to connect REASON: %s", err.Error())
 				}
 			}
 
-			if sig := wait_signals.SleepWait(time.Duration(d.conf.MQTT.Interval)*time.Millisecond, syscall.SIGINT, syscall.SIGTERM); sig != nil {
+			if sig := wait_signals.SleepWait(time.Duration(d.conf.Get().MQTT.Interval)*time.Millisecond, syscall.SIGINT, syscall.SIGTERM); sig != nil {
 				break
 			}
 		}
 
-		if d.conf.Options.debug {
+		if d.conf.Get().Options.debug {
 			log.Println("INFO: [DIAL] MQTT dial stopping")
 		}
 
 		if err := d.broker.Connect(); err == nil {
 			d.Publish()
-			if d.conf.Options.unsubscribe {
+			d.processCommands()
+			if d.conf.Get().Options.unsubscribe {
 				d.broker.Unsubscribe()
 			}
 			d.broker.Disconnect()
@@ -86,12 +134,114 @@ func (d *Dial) Start() error {
 	return nil
 }
 
+// keepConnected runs an iteration of the persistent session mode, it reconnects
+// with backoff when disconnected, publishes and executes the received commands.
+// It returns true if a stop signal was received.
+func (d *Dial) keepConnected() bool {
+
+	// the connection settings changed so connect again
+	if d.broker.IsConnected() && d.broker.IsStale() {
+		log.Println("INFO: [DIAL] MQTT connection settings changed, reconnecting")
+		d.broker.Disconnect()
+	}
+
+	if !d.broker.IsConnected() && !time.Now().Before(d.nextAttempt) {
+
+		if err := d.broker.Connect(); err != nil {
+
+			d.attempts++
+			delay := d.reconnectDelay(d.attempts)
+			d.nextAttempt = time.Now().Add(delay)
+
+			log.Printf("ERROR: [DIAL] MQTT failed to connect, retrying in %s REASON: %s", delay.Round(time.Millisecond), err.Error())
+
+		} else {
+
+			if d.attempts > 0 {
+				log.Printf("INFO: [DIAL] MQTT reconnected after %d attempts", d.attempts)
+			}
+			d.attempts = 0
+
+			if err := d.broker.Subscribe(); err != nil {
+				log.Printf("ERROR: [DIAL] MQTT failed to subscribe REASON: %s", err.Error())
+			}
+		}
+	}
+
+	wait := time.Duration(d.conf.Get().MQTT.Interval) * time.Millisecond
+
+	if d.broker.IsConnected() {
+
+		if d.statusList.IsDirty() {
+			if err := d.Publish(); err != nil {
+				log.Printf("ERROR: [DIAL] MQTT failed to publish REASON: %s", err.Error())
+			}
+		}
+		d.processCommands()
+
+	} else if untilAttempt := time.Until(d.nextAttempt); untilAttempt < wait {
+
+		// wake up for the next connection attempt
+		wait = untilAttempt
+	}
+
+	return d.sleep(wait)
+}
+
+// reconnectDelay returns the delay before a reconnection attempt, it doubles
+// with every failed attempt up to the maximum and has a random jitter so
+// many devices don't reconnect at the same time after a broker restart
+func (d *Dial) reconnectDelay(attempt int) time.Duration {
+
+	min := d.conf.Get().MQTT.Session.ReconnectMin
+	if min <= 0 {
+		min = defaultReconnectMin
+	}
+
+	max := d.conf.Get().MQTT.Session.ReconnectMax
+	if max <= 0 {
+		max = defaultReconnectMax
+	}
+
+	delay := min
+	for i := 1; i < attempt && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+
+	// equal jitter, between half and the whole delay
+	half := delay / 2
+	delay = half + rand.Int63n(half+1)
+
+	return time.Duration(delay) * time.Millisecond
+}
+
+// sleep waits for the given duration or until a command is received,
+// it returns true if a stop signal was received
+func (d *Dial) sleep(duration time.Duration) bool {
+
+	signalChannel := make(chan os.Signal, 1)
+	signal.Notify(signalChannel, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signalChannel)
+
+	select {
+	case <-time.After(duration):
+		return false
+	case <-d.wake:
+		return false
+	case <-signalChannel:
+		return true
+	}
+}
+
 // Start request to stop the auto MQTT communication functionality
 func (d *Dial) Stop() {
 
 	if d.isStarted {
 
-		if d.conf.Options.debug {
+		if d.conf.Get().Options.debug {
 			log.Println("INFO: [DIAL] MQTT dial requested to stop... waiting")
 		}
 
@@ -107,6 +257,14 @@ func (d *Dial) Stop() {
 // and removes the data sent from the array
 func (d *Dial) Publish() error {
 
+	_, err := d.publish()
+
+	return err
+}
+
+// publish publishes the DataList items and returns how many were published
+func (d *Dial) publish() (int, error) {
+
 	// store how many messages were publish
 	// to the MQTT Broker
 	messageCount := 0
@@ -115,29 +273,207 @@ func (d *Dial) Publish() error {
 	// send them to the MQTT Broker
 	for d.statusList.Len() > 0 {
 
-		// get the list first item
-		head := d.statusList.GetHead()
+		var bytes []byte
+		var err error
+		count := 1
+		var last uint64
+
+		if d.conf.Get().MQTT.Batch.Size > 1 {
+
+			// pack the oldest items into a batch
+			bytes, count, last, err = d.nextBatch()
+			if err == nil && count == 0 {
+				break
+			}
+
+		} else {
+
+			// get the list first item
+			head := d.statusList.GetHead()
+			if head == nil {
+				break
+			}
+			last = head.Sequence
 
-		// transform the list oldest item
-		// into JSON bytes
-		bytes, err := json.Marshal(head)
+			// transform the list oldest item
+			// into JSON bytes
+			bytes, err = json.Marshal(head)
+		}
 		if err != nil {
-			return err
+			return messageCount, err
 		}
 
 		// publish the item into the MQTT Broker
 		if err = d.broker.Publish(bytes); err != nil {
-			return err
+			return messageCount, err
 		}
 
-		// remove the first item from the list
-		d.statusList.Remove(1)
-		messageCount++
+		// remove the published items from the list by the sequence of the
+		// last one, the overflow policy may have removed or merged items
+		// while publishing
+		d.statusList.RemoveThrough(last)
+		messageCount += count
 	}
 
-	if d.conf.Options.debug {
+	if d.conf.Get().Options.debug {
 		log.Printf("INFO: [DIAL] published %d messages", messageCount)
 	}
 
-	return nil
+	return messageCount, nil
+}
+
+// nextBatch returns the JSON bytes of a batch with the oldest list items,
+// the number of items in it and the sequence of the last one. The batch holds
+// up to the batch size items and up to maxBytes bytes, but always at least one
+// item unless the list is empty.
+func (d *Dial) nextBatch() ([]byte, int, uint64, error) {
+
+	conf := d.conf.Get()
+
+	items := d.statusList.GetHeadN(conf.MQTT.Batch.Size)
+
+	batch := MessageBatch{
+		DeviceID: conf.ID,
+		Count:    len(items),
+		Messages: make([]json.RawMessage, 0),
+	}
+
+	// the envelope size without the messages
+	envelope, err := json.Marshal(batch)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	size := len(envelope)
+
+	for _, item := range items {
+
+		bytes, err := json.Marshal(item)
+		if err != nil {
+			return nil, 0, 0, err
+		}
+
+		// the messages are separated by commas
+		if len(batch.Messages) > 0 {
+			if conf.MQTT.Batch.MaxBytes > 0 && size+len(bytes)+1 > conf.MQTT.Batch.MaxBytes {
+				break
+			}
+			size++
+		}
+
+		batch.Messages = append(batch.Messages, bytes)
+		size += len(bytes)
+	}
+
+	batch.Count = len(batch.Messages)
+	if batch.Count == 0 {
+		return nil, 0, 0, nil
+	}
+
+	bytes, err := json.Marshal(batch)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+
+	return bytes, batch.Count, items[batch.Count-1].Sequence, nil
+}
+
+// onMessageReceived queues the commands received from the MQTT Broker,
+// they are executed by the dial loop because paho doesn't allow waiting
+// for a publish inside a message callback
+func (d *Dial) onMessageReceived(message *broker.Message) {
+
+	select {
+	case d.commands <- message:
+
+		// wake the dial so the command is executed
+		select {
+		case d.wake <- true:
+		default:
+		}
+
+	default:
+		log.Printf("WARNING: [DIAL] command queue is full, dropping command received in %s", message.Topic)
+	}
+}
+
+// processCommands executes the queued commands and
+// publishes their responses
+func (d *Dial) processCommands() {
+
+	for {
+		select {
+		case message := <-d.commands:
+
+			response := d.commander.Handle(message.Payload)
+			if !response.Success {
+				log.Printf("WARNING: [DIAL] command %s request %s failed REASON: %s", response.Command, response.RequestID, response.Error)
+			}
+
+			bytes, err := json.Marshal(response)
+			if err != nil {
+				log.Printf("ERROR: [DIAL] failed to create command response REASON: %s", err.Error())
+				continue
+			}
+
+			// MQTT 5 requests can set the topic of their response
+			// and the correlation data to match it with the request
+			topic := d.responseTopic()
+			options := d.broker.publishOptions(d.conf.Get().MQTT.Response.Qos)
+			if message.ResponseTopic != "" {
+				topic = message.ResponseTopic
+				options.CorrelationData = message.CorrelationData
+			}
+
+			if err := d.broker.PublishTo(topic, options, bytes); err != nil {
+				log.Printf("ERROR: [DIAL] failed to publish command response REASON: %s", err.Error())
+			}
+
+		default:
+			return
+		}
+	}
+}
+
+// responseTopic returns the command response topic, by default
+// the subscribe topic followed by /response
+func (d *Dial) responseTopic() string {
+
+	conf := d.conf.Get()
+
+	if conf.MQTT.Response.Topic != "" {
+		return conf.MQTT.Response.Topic
+	}
+
+	return conf.MQTT.Subscribe.Topic + "/response"
+}
+
+func (d *Dial) setInterval(args json.RawMessage) (interface{}, error) {
+
+	interval := setIntervalArgs{}
+	if err := decodeCommandArgs(args, &interval); err != nil {
+		return nil, err
+	}
+
+	if interval.Interval <= 0 {
+		return nil, fmt.Errorf("interval argument must be greater than 0")
+	}
+
+	// the configuration is replaced, never changed, as other goroutines read it
+	d.conf.Update(func(current *Configuration) (*Configuration, error) {
+		updated := *current
+		updated.MQTT.Interval = interval.Interval
+		return &updated, nil
+	})
+
+	return interval, nil
+}
+
+func (d *Dial) flush(args json.RawMessage) (interface{}, error) {
+
+	published, err := d.publish()
+	if err != nil {
+		return nil, err
+	}
+
+	return flushData{Published: published}, nil
 }
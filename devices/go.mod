@@ -2,13 +2,15 @@ module github.com/joaoribeirodasilva/mqtt-course/devices
 
 go 1.21.4
 
-require (
-	github.com/eclipse/paho.mqtt.golang v1.4.3
-	github.com/joaoribeirodasilva/wait_signals v0.1.0
-)
+require github.com/joaoribeirodasilva/wait_signals v0.1.0
 
 require (
-	github.com/gorilla/websocket v1.5.0 // indirect
-	golang.org/x/net v0.8.0 // indirect
+	github.com/eclipse/paho.golang v0.21.0 // indirect
+	github.com/eclipse/paho.mqtt.golang v1.4.3 // indirect
+	github.com/gorilla/websocket v1.5.1 // indirect
+	github.com/joaoribeirodasilva/mqtt-course/shared v0.0.0
+	golang.org/x/net v0.21.0 // indirect
 	golang.org/x/sync v0.1.0 // indirect
 )
+
+replace github.com/joaoribeirodasilva/mqtt-course/shared => ../shared
@@ -1,10 +1,8 @@
 package main
 
 import (
-	"encoding/json"
 	"fmt"
 	"log"
-	"os"
 	"sync"
 	"syscall"
 	"time"
@@ -15,21 +13,29 @@ import (
 // TODO: define base message
 
 type Message struct {
-	DeviceID    string    `json:"deviceId"`
-	Sensors     Sensors   `json:"sensors"`
-	CollectedAt time.Time `json:"collectedAt"`
+	DeviceID    string            `json:"deviceId"`
+	Sequence    uint64            `json:"sequence,omitempty"`
+	Sensors     Sensors           `json:"sensors"`
+	CollectedAt time.Time         `json:"collectedAt"`
+	Aggregate   *MessageAggregate `json:"aggregate,omitempty"`
 }
 
-type Sensors struct {
-	Door        SensorDoor    `json:"door"`
-	Temperature SensorNumeric `json:"temperature"`
-	Humidity    SensorNumeric `json:"humidity"`
+// Sensors holds the sensor readings keyed by sensor name
+type Sensors map[string]interface{}
+
+// MessageAppender stores the sensor readings produced by the simulation
+type MessageAppender interface {
+	Append(item *Sensors, collectedAt time.Time)
 }
 
 type DataList struct {
-	conf          *Configuration
+	conf          *LiveConfiguration
 	mu            sync.Mutex
 	list          []*Message
+	wal           *WAL
+	sequence      uint64
+	overflow      OverflowStats
+	isFull        bool
 	isStarted     bool
 	stopRequested bool
 	isDirty       bool
@@ -37,11 +43,13 @@ type DataList struct {
 }
 
 // NewDataList creates a new thread safe and auto save list pointer
-func NewDataList(conf *Configuration) *DataList {
+func NewDataList(conf *LiveConfiguration) *DataList {
 
 	dl := &DataList{}
 	dl.conf = conf
 	dl.list = make([]*Message, 0)
+	data := conf.Get().Data
+	dl.wal = NewWAL(data.Path, data.Sync, data.SegmentSize)
 	dl.isStarted = false
 	dl.stopRequested = false
 	dl.isDirty = false
@@ -81,16 +89,16 @@ func (dl *DataList) Start() error {
 				fmt.Printf("WARNING: [LIST] failed save data file REASON: %s\n", err.Error())
 			}
 
-			if sig := wait_signals.SleepWait(time.Duration(dl.conf.Data.SaveInterval)*time.Millisecond, syscall.SIGINT, syscall.SIGTERM); sig != nil {
+			if sig := wait_signals.SleepWait(time.Duration(dl.conf.Get().Data.SaveInterval)*time.Millisecond, syscall.SIGINT, syscall.SIGTERM); sig != nil {
 				break
 			}
 
-			if dl.conf.Options.debug {
+			if dl.conf.Get().Options.debug {
 				log.Printf("INFO: [LIST] buffer has %d messages stored\n", dl.Len())
 			}
 		}
 
-		if dl.conf.Options.debug {
+		if dl.conf.Get().Options.debug {
 			log.Println("INFO: [LIST] data list stopping")
 		}
 		// here the stop request flag was set
@@ -105,6 +113,10 @@ func (dl *DataList) Start() error {
 			fmt.Printf("ERROR: [LIST] failed save data file REASON: %s", err.Error())
 		}
 
+		if err := dl.Close(); err != nil {
+			fmt.Printf("ERROR: [LIST] failed to close the data log REASON: %s", err.Error())
+		}
+
 		// sets the is dirty flag to false
 		dl.isDirty = false
 
@@ -122,7 +134,7 @@ func (dl *DataList) Stop() {
 	// if it's started
 	if dl.isStarted {
 
-		if dl.conf.Options.debug {
+		if dl.conf.Get().Options.debug {
 			log.Println("INFO: [LIST] data list stop requested... waiting")
 		}
 
@@ -138,8 +150,22 @@ func (dl *DataList) Stop() {
 	}
 }
 
-// Append ands a new Sensors struct to the DataList array
-func (dl *DataList) Append(item *Sensors) {
+// initialSequence returns the sequence a device without stored history starts
+// from. A run with a virtual start time starts at its start time in microseconds
+// so two runs with the same configuration publish the same messages, otherwise
+// it starts at the current time so a device that lost its data log still
+// publishes sequences greater than the ones already consumed
+func initialSequence(conf *Configuration) uint64 {
+
+	if startTime := conf.StartTime(); startTime != nil {
+		return uint64(startTime.UnixMicro())
+	}
+
+	return uint64(time.Now().UnixMicro())
+}
+
+// Append ands a new Sensors map collected at the given time to the DataList array
+func (dl *DataList) Append(item *Sensors, collectedAt time.Time) {
 
 	if item == nil {
 		return
@@ -149,25 +175,36 @@ func (dl *DataList) Append(item *Sensors) {
 	// can have exclusive access
 	dl.mu.Lock()
 
-	//if the list is full
-	if uint32(len(dl.list)) >= dl.conf.Data.MaxMessages {
+	//if the list is full make room using the overflow policy
+	if uint32(len(dl.list)) >= dl.conf.Get().Data.MaxMessages && !dl.makeRoom() {
 
-		// print a warning to the console
-		//log.Printf("WARNING: sensor list reached it's limit of %d messages stored", dl.conf.Data.MaxMessages)
+		// the policy drops the new item
+		dl.mu.Unlock()
+		return
+	}
 
-		// remove the oldest item from the list
-		dl.list = dl.list[1:]
+	if dl.sequence == 0 {
+		dl.sequence = initialSequence(dl.conf.Get())
 	}
+	dl.sequence++
 
 	msg := Message{
-		DeviceID:    dl.conf.ID,
+		DeviceID:    dl.conf.Get().ID,
+		Sequence:    dl.sequence,
 		Sensors:     *item,
-		CollectedAt: time.Now().UTC(),
+		CollectedAt: collectedAt.UTC(),
 	}
 
 	// add the item to the list
 	dl.list = append(dl.list, &msg)
 
+	// write it to the log so it survives a crash
+	if dl.wal.IsOpen() {
+		if err := dl.wal.Append(&msg); err != nil {
+			log.Printf("WARNING: [LIST] failed to write message to the data log REASON: %s", err.Error())
+		}
+	}
+
 	// set is dirty flag to true so
 	// we know there are new items in
 	// the list
@@ -178,31 +215,31 @@ func (dl *DataList) Append(item *Sensors) {
 	dl.mu.Unlock()
 }
 
-// Removes n items from the head of the DataList array
-func (dl *DataList) Remove(items int) {
+// RemoveThrough removes the items from the head of the DataList array up to
+// the one with the given sequence. The overflow policy may drop or merge items
+// while they are published so the published items are found by sequence.
+func (dl *DataList) RemoveThrough(sequence uint64) {
 
-	// lock the list so the thread inserting
-	// can have exclusive access
 	dl.mu.Lock()
+	defer dl.mu.Unlock()
 
-	// if the number of items to remove is greater
-	// than the items list
-	if items > len(dl.list) {
+	// the sequences grow from the head to the tail
+	items := 0
+	for items < len(dl.list) && dl.list[items].Sequence <= sequence {
+		items++
+	}
 
-		// set the items to remove equal to the
-		// items list length
-		items = len(dl.list)
+	if items == 0 {
+		return
 	}
 
-	// remove the oldest items from the list
 	dl.list = dl.list[items:]
+	dl.logRemove(items)
 
-	// set the flag is dirty to true
-	dl.isDirty = true
+	// warn again the next time the list is full
+	dl.isFull = false
 
-	// unlock the exclusive thread access
-	// to the list
-	dl.mu.Unlock()
+	dl.isDirty = true
 }
 
 // GetHead returns a copy of the first list item
@@ -226,14 +263,37 @@ func (dl *DataList) GetHead() *Message {
 	// that is processor intensive
 	s := &Message{
 		DeviceID:    dl.list[0].DeviceID,
+		Sequence:    dl.list[0].Sequence,
 		Sensors:     dl.list[0].Sensors,
 		CollectedAt: dl.list[0].CollectedAt,
+		Aggregate:   dl.list[0].Aggregate,
 	}
 
 	// return the copied list item
 	return s
 }
 
+// GetHeadN returns a copy of the first n list items
+func (dl *DataList) GetHeadN(n int) []*Message {
+
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+
+	if n > len(dl.list) {
+		n = len(dl.list)
+	}
+
+	// copy the items so the caller doesn't
+	// see the changes made to the list
+	items := make([]*Message, n)
+	for i := 0; i < n; i++ {
+		item := *dl.list[i]
+		items[i] = &item
+	}
+
+	return items
+}
+
 // Len returns the list size
 func (dl *DataList) Len() int {
 
@@ -249,7 +309,77 @@ func (dl *DataList) Len() int {
 	return len(dl.list)
 }
 
-// Save saves the DataList array into a JSON file
+// Overflow returns the counters of the readings dropped or merged
+// because the list was full
+func (dl *DataList) Overflow() OverflowStats {
+
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+
+	return dl.overflow
+}
+
+// makeRoom applies the overflow policy to the full list and returns
+// false if the new item must be dropped instead, the caller holds the lock
+func (dl *DataList) makeRoom() bool {
+
+	conf := dl.conf.Get()
+
+	policy := conf.Data.Overflow.Policy
+	if policy == "" {
+		policy = overflowDropOldest
+	}
+
+	// print a warning to the console once until
+	// the list has room again
+	if !dl.isFull {
+		log.Printf("WARNING: [LIST] list reached it's limit of %d messages stored, applying the %s policy", conf.Data.MaxMessages, policy)
+		dl.isFull = true
+	}
+
+	dl.overflow.Events++
+
+	switch policy {
+	case overflowDropNewest:
+		dl.overflow.Dropped++
+		return false
+
+	case overflowDownsample:
+		factor := conf.Data.Overflow.Factor
+		if factor < 2 {
+			factor = defaultDownsampleFactor
+		}
+		if list, dropped := downsampleMessages(dl.list, factor); dropped > 0 {
+			dl.list = list
+			dl.overflow.Dropped += uint64(dropped)
+			dl.logRewrite()
+			return true
+		}
+
+	case overflowAggregate:
+		bucketSize := conf.Data.Overflow.BucketSize
+		if bucketSize < 2 {
+			bucketSize = defaultBucketSize
+		}
+		if list, merged := aggregateMessages(dl.list, bucketSize); merged > 0 {
+			dl.list = list
+			dl.overflow.Merged += uint64(merged)
+			dl.logRewrite()
+			return true
+		}
+	}
+
+	// drop the oldest item, also used when the list
+	// is too small to downsample or aggregate
+	dl.list = dl.list[1:]
+	dl.logRemove(1)
+	dl.overflow.Dropped++
+
+	return true
+}
+
+// Save flushes the data log to the disk, the messages are written to the
+// log as they are appended so only the disk sync depends on the save interval
 func (dl *DataList) Save() error {
 
 	// lock the list so the thread inserting
@@ -260,33 +390,27 @@ func (dl *DataList) Save() error {
 	// to the list
 	defer dl.mu.Unlock()
 
-	// if there are no changes to the list
-	// return
-	if !dl.isDirty {
-		return nil
-	}
-
-	// transform the list data into a JSON array
-	// of bytes
-	data, err := json.Marshal(dl.list)
-	if err != nil {
-		return err
+	// the data path changed so move the
+	// messages to a log in the new path
+	if dl.wal.Dir() != dl.conf.Get().Data.Path {
+		if err := dl.relocate(); err != nil {
+			return err
+		}
 	}
 
-	if dl.conf.Options.debug {
-		log.Printf("INFO: [LIST] saving data to file")
+	if !dl.wal.IsOpen() {
+		return nil
 	}
 
-	// write this JSON byte array to a data file
-	err = os.WriteFile(dl.conf.Data.Path, data, os.ModePerm)
-	if err != nil {
-		return err
+	if dl.conf.Get().Options.debug && dl.isDirty {
+		log.Printf("INFO: [LIST] syncing data log")
 	}
 
-	return nil
+	return dl.wal.Sync()
 }
 
-// Reads reads the DataList array from a JSON file
+// Reads reads the DataList array from the data log, torn records
+// left by a crash are skipped
 func (dl *DataList) Read() error {
 
 	// lock the list so the thread inserting
@@ -297,28 +421,103 @@ func (dl *DataList) Read() error {
 	// to the list
 	defer dl.mu.Unlock()
 
-	if dl.conf.Options.debug {
-		log.Printf("INFO: [LIST] reading data from file")
+	if dl.conf.Get().Options.debug {
+		log.Printf("INFO: [LIST] reading data from log %s", dl.wal.Dir())
 	}
 
-	// read the JSON file into the a byte array
-	bytes, err := os.ReadFile(dl.conf.Data.Path)
-	if err != nil {
+	if err := dl.wal.Close(); err != nil {
 		return err
 	}
 
-	// transform the JSON bytes into a memory list
-	err = json.Unmarshal([]byte(bytes), &dl.list)
+	list, err := dl.wal.Open()
 	if err != nil {
 		return err
 	}
 
+	dl.list = list
+
+	// continue the sequence of the messages already logged
+	if last := dl.wal.LastSequence(); last > dl.sequence {
+		dl.sequence = last
+	}
+
 	// sets the flag is dirty equals to false
 	dl.isDirty = false
 
 	return nil
 }
 
+// Close syncs and closes the data log
+func (dl *DataList) Close() error {
+
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+
+	return dl.wal.Close()
+}
+
+// logRemove writes the removal of the n oldest messages to the log
+func (dl *DataList) logRemove(items int) {
+
+	if !dl.wal.IsOpen() {
+		return
+	}
+
+	if err := dl.wal.Remove(items); err != nil {
+		log.Printf("WARNING: [LIST] failed to write removal to the data log REASON: %s", err.Error())
+	}
+}
+
+// logRewrite replaces the log content with the current list
+func (dl *DataList) logRewrite() {
+
+	if !dl.wal.IsOpen() {
+		return
+	}
+
+	if err := dl.wal.Rewrite(dl.list); err != nil {
+		log.Printf("WARNING: [LIST] failed to rewrite the data log REASON: %s", err.Error())
+	}
+}
+
+// relocate moves the list messages to a log in the configured data path,
+// messages already stored in the new path are kept before them
+func (dl *DataList) relocate() error {
+
+	conf := dl.conf.Get()
+
+	wal := NewWAL(conf.Data.Path, conf.Data.Sync, conf.Data.SegmentSize)
+
+	list, err := wal.Open()
+	if err != nil {
+		return err
+	}
+
+	for _, msg := range dl.list {
+		if err := wal.Append(msg); err != nil {
+			wal.Close()
+			return err
+		}
+	}
+
+	if err := wal.Sync(); err != nil {
+		wal.Close()
+		return err
+	}
+
+	log.Printf("INFO: [LIST] data log moved from %s to %s", dl.wal.Dir(), wal.Dir())
+
+	if err := dl.wal.Destroy(); err != nil {
+		log.Printf("WARNING: [LIST] failed to delete data log %s REASON: %s", dl.wal.Dir(), err.Error())
+	}
+
+	dl.wal = wal
+	dl.list = append(list, dl.list...)
+	dl.isDirty = true
+
+	return nil
+}
+
 func (dl *DataList) IsDirty() bool {
 
 	// lock the list so the thread inserting
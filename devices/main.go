@@ -6,18 +6,27 @@ import (
 	"log"
 	"os"
 	"os/signal"
+	"strconv"
 	"syscall"
 )
 
 type Options struct {
-	device      int
-	debug       bool
-	subscribe   bool
-	unsubscribe bool
-	configFile  string
-	noTls       bool
-	qos         int
-	help        bool
+	device       int
+	debug        bool
+	subscribe    bool
+	unsubscribe  bool
+	configFile   string
+	scenarioFile string
+	seed         *int64
+	startTime    string
+	batch        bool
+	batchEnd     string
+	batchOut     string
+	batchFormat  string
+	batchPublish bool
+	noTls        bool
+	qos          int
+	help         bool
 }
 
 func main() {
@@ -39,7 +48,7 @@ func main() {
 
 		exitStatus := 0
 
-		client := NewMQTTClient(conf)
+		client := NewMQTTClient(NewLiveConfiguration(conf), nil)
 		if err := client.Connect(); err != nil {
 
 			exitStatus = 1
@@ -62,20 +71,42 @@ func main() {
 		os.Exit(exitStatus)
 	}
 
+	// Offline batch generation
+	if conf.Options.batch {
+
+		batch := NewBatch(conf)
+		if err := batch.Run(); err != nil {
+			log.Fatal(err.Error())
+		}
+		os.Exit(0)
+	}
+
+	// the running configuration, replaced by remote configuration updates
+	live := NewLiveConfiguration(conf)
+
 	// Initialize the simulation list
-	list := NewDataList(conf)
-	list.Read()
+	list := NewDataList(live)
 	list.Start()
 
 	// Initialize the simulation structure
-	simulation := NewSimulation(conf, list)
+	simulation := NewSimulation(live, list)
+	if err := simulation.Load(); err != nil {
+		log.Fatal(err.Error())
+	}
 
 	// Start the virtual clock
-	clock := NewVirtualClock(conf, simulation)
+	clock := NewVirtualClock(live, simulation)
 	clock.Start()
 
+	// Remote commands received from the MQTT Broker
+	commander := NewCommander(live, simulation, list)
+
+	// Remote configuration updates
+	updater := NewConfigUpdater(live, simulation)
+	commander.Register("configure", updater.Configure)
+
 	// Start the communication with MQTT Broker
-	dial := NewDial(conf, list)
+	dial := NewDial(live, list, commander)
 	dial.Start()
 
 	// wait SIGTERM or SIGINT
@@ -103,6 +134,21 @@ func cmdOptions() *Options {
 	flag.BoolVar(&opts.debug, "debug", false, "prints debug information while running")
 	flag.BoolVar(&opts.help, "h", false, "help")
 	flag.BoolVar(&opts.noTls, "no-tls", false, "don't use tls certificates")
+	flag.StringVar(&opts.scenarioFile, "scenario", "", "fault scenario file path")
+	flag.Func("seed", "simulation random seed (overrides the configuration)", func(value string) error {
+		seed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return err
+		}
+		opts.seed = &seed
+		return nil
+	})
+	flag.StringVar(&opts.startTime, "start", "", "virtual clock start time in RFC3339 format (overrides the configuration)")
+	flag.BoolVar(&opts.batch, "batch", false, "generate messages offline from the start time until the -end time and exit")
+	flag.StringVar(&opts.batchEnd, "end", "", "batch mode virtual end time in RFC3339 format")
+	flag.StringVar(&opts.batchOut, "out", "", "batch mode output file path")
+	flag.StringVar(&opts.batchFormat, "format", "jsonl", "batch mode output format [jsonl, csv]")
+	flag.BoolVar(&opts.batchPublish, "publish", false, "batch mode publishes the messages to the MQTT Broker instead of writing them")
 	flag.IntVar(&opts.qos, "q", 2, "MQTT QOS level")
 	flag.BoolVar(&opts.subscribe, "s", false, "should subscribe topic on startup")
 	flag.BoolVar(&opts.unsubscribe, "u", false, "should unsubscribe topic on startup")
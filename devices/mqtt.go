@@ -3,81 +3,192 @@ package main
 import (
 	"fmt"
 	"log"
+	"strings"
+	"time"
 
-	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/joaoribeirodasilva/mqtt-course/shared/broker"
+	"github.com/joaoribeirodasilva/mqtt-course/shared/tls"
 )
 
 type MQTTClient struct {
-	conf        *Configuration
-	mqttClient  mqtt.Client
-	mqttToken   mqtt.Token
-	isConnected bool
+	conf             *LiveConfiguration
+	mqttClient       broker.Client
+	onReceiveMessage broker.MessageHandler
+	isConnected      bool
+	settings         string
 }
 
-func NewMQTTClient(conf *Configuration) *MQTTClient {
+const (
+	defaultKeepAlive     = 30
+	defaultContentType   = "application/json"
+	defaultSchemaVersion = "1"
+	// MQTT 5 session expiry meaning the session never expires
+	sessionNeverExpires = 0xFFFFFFFF
+)
+
+func NewMQTTClient(conf *LiveConfiguration, onReceiveMessage broker.MessageHandler) *MQTTClient {
 
 	c := &MQTTClient{}
 
 	c.conf = conf
 	c.isConnected = false
+	c.onReceiveMessage = onReceiveMessage
 
 	return c
 }
 
+// Connect connects to the MQTT Broker. The client is kept between connections
+// so a persistent session resumes the messages in flight, it's only created
+// again when the connection settings change.
 func (c *MQTTClient) Connect() error {
 
-	if c.isConnected {
+	if c.IsConnected() {
 
 		return nil
 	}
 
-	auth := ""
-	if c.conf.MQTT.Authentication.Use {
-		auth = fmt.Sprintf("%s:%s@", c.conf.MQTT.Authentication.Username, c.conf.MQTT.Authentication.Password)
+	brokerUrl, err := c.endpoint().URL()
+	if err != nil {
+		return err
+	}
+
+	if c.mqttClient == nil || c.IsStale() {
+
+		options, err := c.clientOptions()
+		if err != nil {
+			return err
+		}
+
+		if c.mqttClient, err = broker.NewClient(c.conf.Get().MQTT.ProtocolVersion, options); err != nil {
+			return err
+		}
+		c.settings = c.currentSettings()
+	}
+
+	if err := c.mqttClient.Connect(); err != nil {
+
+		return fmt.Errorf("ERROR: [MQTT CLIENT] failed to connect to MQTT Broker at %s. REASON: %s", brokerUrl, err.Error())
 	}
 
-	brokerUrl := fmt.Sprintf("tcp://%s%s:%d", auth, c.conf.MQTT.Host, c.conf.MQTT.Port)
+	c.isConnected = true
 
-	//log.Printf("connecting to MQTT broker at %s ...", brokerUrl)
+	if c.conf.Get().Options.debug {
+		log.Println("INFO: [MQTT CLIENT] connected to MQTT Broker")
+	}
 
-	options := mqtt.NewClientOptions()
+	return nil
+}
 
-	options.AddBroker(brokerUrl)
+// IsStale returns true if the connection settings changed
+// since the client was created
+func (c *MQTTClient) IsStale() bool {
 
-	options.SetClientID(c.conf.MQTT.ClientID)
-	options.SetDefaultPublishHandler(c.onMessagePublishedHandler)
+	return c.settings != c.currentSettings()
+}
 
-	options.OnConnect = c.onConnectHandler
-	options.OnConnectionLost = c.onConnectLostHandler
+// currentSettings returns the configured settings the client depends on
+func (c *MQTTClient) currentSettings() string {
 
-	if c.conf.MQTT.Authentication.Use {
+	conf := c.conf.Get()
 
-		options.SetUsername(c.conf.MQTT.Authentication.Username)
-		options.SetPassword(c.conf.MQTT.Authentication.Password)
+	return fmt.Sprintf("%+v|%d|%s|%+v|%+v|%+v", *c.endpoint(), conf.MQTT.ProtocolVersion, conf.MQTT.ClientID, conf.MQTT.Authentication, conf.MQTT.Session, conf.MQTT.Tls)
+}
+
+// endpoint returns the MQTT Broker endpoint
+func (c *MQTTClient) endpoint() *broker.Endpoint {
+
+	conf := c.conf.Get()
+
+	// the -no-tls option also disables the secure transports
+	transport := strings.ToLower(conf.MQTT.Transport)
+	if conf.Options.noTls {
+		switch transport {
+		case broker.TransportSSL:
+			transport = broker.TransportTCP
+		case broker.TransportWSS:
+			transport = broker.TransportWS
+		}
 	}
 
-	options.SetCleanSession(c.conf.Options.subscribe)
+	return &broker.Endpoint{
+		Transport: transport,
+		Host:      conf.MQTT.Host,
+		Port:      conf.MQTT.Port,
+		Path:      conf.MQTT.Websocket.Path,
+		Headers:   conf.MQTT.Websocket.Headers,
+		Proxy:     conf.MQTT.Websocket.Proxy,
+		Tls:       c.useTls(),
+	}
+}
 
-	// Add tls code
+// useTls returns true if TLS is enabled and not disabled by the -no-tls option
+func (c *MQTTClient) useTls() bool {
 
-	c.mqttClient = mqtt.NewClient(options)
-	if c.mqttToken = c.mqttClient.Connect(); c.mqttToken.Wait() && c.mqttToken.Error() != nil {
+	conf := c.conf.Get()
+
+	return conf.MQTT.Tls.Use && !conf.Options.noTls
+}
 
-		return fmt.Errorf("ERROR: [MQTT CLIENT] failed to connect to MQTT Broker at %s. REASON: %s", brokerUrl, c.mqttToken.Error().Error())
+// clientOptions returns the MQTT client options
+func (c *MQTTClient) clientOptions() (broker.ClientOptions, error) {
+
+	conf := c.conf.Get()
+
+	endpoint := c.endpoint()
+
+	options := broker.ClientOptions{
+		Endpoint:         endpoint,
+		ClientID:         conf.MQTT.ClientID,
+		DefaultHandler:   c.onMessagePublishedHandler,
+		OnConnectionLost: c.onConnectLostHandler,
 	}
 
-	return nil
+	if conf.MQTT.Authentication.Use {
+
+		options.Username = conf.MQTT.Authentication.Username
+		options.Password = conf.MQTT.Authentication.Password
+	}
+
+	// without a clean session the broker keeps the subscription
+	// and queues the commands sent while the device is offline,
+	// with MQTT 5 only until the session expires
+	options.CleanSession = conf.MQTT.Session.CleanSession
+	options.SessionExpiry = conf.MQTT.Session.Expiry
+	if !options.CleanSession && options.SessionExpiry == 0 {
+		options.SessionExpiry = sessionNeverExpires
+	}
+
+	keepAlive := conf.MQTT.Session.KeepAlive
+	if keepAlive <= 0 {
+		keepAlive = defaultKeepAlive
+	}
+	options.KeepAlive = time.Duration(keepAlive) * time.Second
+
+	// TLS, with a client certificate for mutual TLS
+	if endpoint.IsSecure() {
+
+		tlsConf := tls.NewTlsConfig(conf.MQTT.Tls.Crt, conf.MQTT.Tls.Key, conf.MQTT.Tls.Root, conf.MQTT.Tls.Insecure)
+		if err := tlsConf.Create(); err != nil {
+			return options, err
+		}
+
+		options.TLSConfig = tlsConf.Config
+	}
+
+	return options, nil
 }
 
 func (c *MQTTClient) Subscribe() error {
 
-	if c.conf.Options.debug {
-		log.Printf("subscribing MQTT topic %s with QOS %d ...", c.conf.MQTT.Subscribe.Topic, c.conf.MQTT.Subscribe.Qos)
+	conf := c.conf.Get()
+
+	if conf.Options.debug {
+		log.Printf("subscribing MQTT topic %s with QOS %d ...", conf.MQTT.Subscribe.Topic, conf.MQTT.Subscribe.Qos)
 	}
 
-	if c.mqttToken = c.mqttClient.Subscribe(c.conf.MQTT.Subscribe.Topic, c.conf.MQTT.Subscribe.Qos, c.onMessageReceived); c.mqttToken.Wait() && c.mqttToken.Error() != nil {
+	if err := c.mqttClient.Subscribe(conf.MQTT.Subscribe.Topic, conf.MQTT.Subscribe.Qos, c.onReceiveMessage); err != nil {
 
-		return c.mqttToken.Error()
+		return err
 	}
 
 	// log.Println(" subscribed")
@@ -87,13 +198,15 @@ func (c *MQTTClient) Subscribe() error {
 
 func (c *MQTTClient) Unsubscribe() error {
 
-	if c.conf.Options.debug {
-		log.Printf("unsubscribing from MQTT topic %s  ...", c.conf.MQTT.Subscribe.Topic)
+	conf := c.conf.Get()
+
+	if conf.Options.debug {
+		log.Printf("unsubscribing from MQTT topic %s  ...", conf.MQTT.Subscribe.Topic)
 	}
 
-	if c.mqttToken = c.mqttClient.Unsubscribe(c.conf.MQTT.Subscribe.Topic); c.mqttToken.Wait() && c.mqttToken.Error() != nil {
+	if err := c.mqttClient.Unsubscribe(conf.MQTT.Subscribe.Topic); err != nil {
 
-		return c.mqttToken.Error()
+		return err
 	}
 
 	//log.Println(" unsubscribed")
@@ -103,6 +216,8 @@ func (c *MQTTClient) Unsubscribe() error {
 
 func (c *MQTTClient) Publish(data []byte) error {
 
+	conf := c.conf.Get()
+
 	// if !c.isConnected {
 
 	// 	if err := c.Connect(); err != nil {
@@ -113,11 +228,22 @@ func (c *MQTTClient) Publish(data []byte) error {
 
 	// Get the list of stored metrics
 
-	//log.Printf("publishing MQTT message into topic %s with QOS %d ...", c.conf.Communications.MQTT.Publish.Topic, c.conf.Communications.MQTT.Publish.Qos)
+	//log.Printf("publishing MQTT message into topic %s with QOS %d ...", conf.Communications.MQTT.Publish.Topic, conf.Communications.MQTT.Publish.Qos)
+
+	// with MQTT 5 the broker discards the readings not delivered
+	// before they expire instead of sending stale readings
+	options := c.publishOptions(conf.MQTT.Publish.Qos)
+	options.MessageExpiry = conf.MQTT.Properties.MessageExpiry
+
+	return c.PublishTo(conf.MQTT.Publish.Topic, options, data)
+}
 
-	if c.mqttToken = c.mqttClient.Publish(c.conf.MQTT.Publish.Topic, c.conf.MQTT.Publish.Qos, false, data); c.mqttToken.Wait() && c.mqttToken.Error() != nil {
+// PublishTo publishes data into the given topic
+func (c *MQTTClient) PublishTo(topic string, options broker.PublishOptions, data []byte) error {
 
-		return c.mqttToken.Error()
+	if err := c.mqttClient.Publish(topic, data, options); err != nil {
+
+		return err
 	}
 
 	//log.Println(" published")
@@ -125,11 +251,42 @@ func (c *MQTTClient) Publish(data []byte) error {
 	return nil
 }
 
+// publishOptions returns the options of the messages published with the
+// MQTT 5 properties identifying the device and the payload schema
+func (c *MQTTClient) publishOptions(qos byte) broker.PublishOptions {
+
+	conf := c.conf.Get()
+
+	contentType := conf.MQTT.Properties.ContentType
+	if contentType == "" {
+		contentType = defaultContentType
+	}
+
+	schemaVersion := conf.MQTT.Properties.SchemaVersion
+	if schemaVersion == "" {
+		schemaVersion = defaultSchemaVersion
+	}
+
+	options := broker.PublishOptions{
+		Qos:         qos,
+		ContentType: contentType,
+		UserProperties: map[string]string{
+			"schemaVersion": schemaVersion,
+		},
+	}
+
+	if conf.ID != "" {
+		options.UserProperties["deviceId"] = conf.ID
+	}
+
+	return options
+}
+
 func (c *MQTTClient) Disconnect() {
 
 	if c.isConnected {
-		c.mqttClient.Disconnect(250)
-		if c.conf.Options.debug {
+		c.mqttClient.Disconnect()
+		if c.conf.Get().Options.debug {
 			log.Println("INFO: [MQTT CLIENT] disconnected from MQTT Broker")
 		}
 		c.isConnected = false
@@ -138,29 +295,20 @@ func (c *MQTTClient) Disconnect() {
 
 func (c *MQTTClient) IsConnected() bool {
 
-	return c.isConnected
+	return c.isConnected && c.mqttClient != nil && c.mqttClient.IsConnectionOpen()
 }
 
-func (c *MQTTClient) onMessagePublishedHandler(client mqtt.Client, msg mqtt.Message) {
+func (c *MQTTClient) onMessagePublishedHandler(msg *broker.Message) {
 
-	// Message published to the broker
-}
-
-func (c *MQTTClient) onConnectHandler(client mqtt.Client) {
-
-	if c.conf.Options.debug {
-		log.Println("INFO: [MQTT CLIENT] connected to MQTT Broker")
+	// messages queued by a persistent session can arrive
+	// before the subscription handler is registered again
+	if c.onReceiveMessage != nil {
+		c.onReceiveMessage(msg)
 	}
-	c.isConnected = true
 }
 
-func (c *MQTTClient) onConnectLostHandler(client mqtt.Client, err error) {
+func (c *MQTTClient) onConnectLostHandler(err error) {
 
+	log.Printf("WARNING: [MQTT CLIENT] connection to MQTT Broker lost REASON: %s", err.Error())
 	c.isConnected = false
 }
-
-func (c *MQTTClient) onMessageReceived(client mqtt.Client, message mqtt.Message) {
-
-	// Received message from the broker
-	// Switch for operation to perform
-}
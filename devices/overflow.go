@@ -0,0 +1,219 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"time"
+)
+
+// OverflowStats counts the readings lost or merged
+// because the DataList was full
+type OverflowStats struct {
+	Events  uint64 `json:"events"`
+	Dropped uint64 `json:"dropped"`
+	Merged  uint64 `json:"merged"`
+}
+
+// MessageAggregate describes a message holding the aggregation
+// of several readings, the sensors values are the averages
+type MessageAggregate struct {
+	Count int                `json:"count"`
+	From  time.Time          `json:"from"`
+	To    time.Time          `json:"to"`
+	Min   map[string]float64 `json:"min"`
+	Max   map[string]float64 `json:"max"`
+}
+
+const (
+	overflowDropOldest = "dropOldest"
+	overflowDropNewest = "dropNewest"
+	overflowDownsample = "downsample"
+	overflowAggregate  = "aggregate"
+
+	defaultDownsampleFactor = 2
+	defaultBucketSize       = 10
+)
+
+// downsampleMessages keeps every factor-th message of the oldest half
+// of the list and returns the new list and the number of dropped messages
+func downsampleMessages(list []*Message, factor int) ([]*Message, int) {
+
+	half := len(list) / 2
+
+	kept := make([]*Message, 0, len(list))
+	for i := 0; i < half; i++ {
+		if i%factor == 0 {
+			kept = append(kept, list[i])
+		}
+	}
+	kept = append(kept, list[half:]...)
+
+	return kept, len(list) - len(kept)
+}
+
+// aggregateMessages collapses the oldest half of the list into buckets of
+// bucketSize messages and returns the new list and the number of merged messages
+func aggregateMessages(list []*Message, bucketSize int) ([]*Message, int) {
+
+	half := len(list) / 2
+
+	merged := make([]*Message, 0, len(list))
+	for start := 0; start < half; start += bucketSize {
+
+		end := start + bucketSize
+		if end > half {
+			end = half
+		}
+
+		if end-start == 1 {
+			merged = append(merged, list[start])
+			continue
+		}
+
+		merged = append(merged, mergeMessages(list[start:end]))
+	}
+	merged = append(merged, list[half:]...)
+
+	return merged, len(list) - len(merged)
+}
+
+// mergeMessages returns a message with the min, max and average of the numeric
+// values of the messages. Booleans are true if any reading was true and other
+// values keep the latest reading.
+func mergeMessages(messages []*Message) *Message {
+
+	first := messages[0]
+	last := messages[len(messages)-1]
+
+	aggregate := &MessageAggregate{
+		From: first.CollectedAt,
+		To:   last.CollectedAt,
+		Min:  make(map[string]float64),
+		Max:  make(map[string]float64),
+	}
+	if first.Aggregate != nil {
+		aggregate.From = first.Aggregate.From
+	}
+	if last.Aggregate != nil {
+		aggregate.To = last.Aggregate.To
+	}
+
+	sums := make(map[string]float64)
+	counts := make(map[string]int)
+	values := make(map[string]map[string]interface{})
+	scalars := make(map[string]interface{})
+
+	for _, msg := range messages {
+
+		count := 1
+		if msg.Aggregate != nil {
+			count = msg.Aggregate.Count
+		}
+		aggregate.Count += count
+
+		for name, reading := range msg.Sensors {
+
+			fields, isObject := readingFields(reading)
+			if !isObject {
+				scalars[name] = mergeValue(name, scalars[name], reading, count, msg.Aggregate, aggregate, sums, counts)
+				continue
+			}
+
+			if values[name] == nil {
+				values[name] = make(map[string]interface{})
+			}
+
+			for field, value := range fields {
+				values[name][field] = mergeValue(name+"."+field, values[name][field], value, count, msg.Aggregate, aggregate, sums, counts)
+			}
+		}
+	}
+
+	sensors := make(Sensors, len(values)+len(scalars))
+	for name, value := range scalars {
+		sensors[name] = averageValue(name, value, sums, counts)
+	}
+	for name, fields := range values {
+		for field, value := range fields {
+			fields[field] = averageValue(name+"."+field, value, sums, counts)
+		}
+		sensors[name] = fields
+	}
+
+	// the merged messages were never published so the
+	// aggregate reuses the sequence of the newest one
+	return &Message{
+		DeviceID:    first.DeviceID,
+		Sequence:    last.Sequence,
+		Sensors:     sensors,
+		CollectedAt: aggregate.From,
+		Aggregate:   aggregate,
+	}
+}
+
+// mergeValue merges a reading value into the current merged value
+func mergeValue(key string, current interface{}, value interface{}, count int, source *MessageAggregate, aggregate *MessageAggregate, sums map[string]float64, counts map[string]int) interface{} {
+
+	switch v := value.(type) {
+	case float64:
+		min, max := v, v
+		if source != nil {
+			if m, ok := source.Min[key]; ok {
+				min = m
+			}
+			if m, ok := source.Max[key]; ok {
+				max = m
+			}
+		}
+
+		if _, ok := counts[key]; !ok {
+			aggregate.Min[key] = min
+			aggregate.Max[key] = max
+		}
+		aggregate.Min[key] = math.Min(aggregate.Min[key], min)
+		aggregate.Max[key] = math.Max(aggregate.Max[key], max)
+
+		sums[key] += v * float64(count)
+		counts[key] += count
+
+		return v
+	case bool:
+		if b, ok := current.(bool); ok && b {
+			return true
+		}
+		return v
+	default:
+		return v
+	}
+}
+
+// averageValue returns the average of a numeric key or the merged value
+func averageValue(key string, value interface{}, sums map[string]float64, counts map[string]int) interface{} {
+
+	if count, ok := counts[key]; ok && count > 0 {
+		return sums[key] / float64(count)
+	}
+
+	return value
+}
+
+// readingFields returns the JSON fields of a sensor reading
+// and false if the reading isn't an object
+func readingFields(reading interface{}) (map[string]interface{}, bool) {
+
+	if fields, ok := reading.(map[string]interface{}); ok {
+		return fields, true
+	}
+
+	bytes, err := json.Marshal(reading)
+	if err != nil {
+		return nil, false
+	}
+
+	fields := make(map[string]interface{})
+	if err := json.Unmarshal(bytes, &fields); err != nil {
+		return nil, false
+	}
+
+	return fields, true
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// testMessages returns n messages collected a second apart with
+// the sequences 1 to n and a numeric and a boolean reading
+func testMessages(n int) []*Message {
+
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	messages := make([]*Message, n)
+	for i := range messages {
+		messages[i] = &Message{
+			DeviceID: "device",
+			Sequence: uint64(i + 1),
+			Sensors: Sensors{
+				"temperature": map[string]interface{}{"CurrentValue": float64(i)},
+				"open":        i == 1,
+			},
+			CollectedAt: start.Add(time.Duration(i) * time.Second),
+		}
+	}
+
+	return messages
+}
+
+func sequences(messages []*Message) []uint64 {
+
+	seqs := make([]uint64, len(messages))
+	for i, msg := range messages {
+		seqs[i] = msg.Sequence
+	}
+
+	return seqs
+}
+
+func sameSequences(a []uint64, b []uint64) bool {
+
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func TestDownsampleMessages(t *testing.T) {
+
+	tests := []struct {
+		name        string
+		size        int
+		factor      int
+		wantSeqs    []uint64
+		wantDropped int
+	}{
+		{"too small", 1, 2, []uint64{1}, 0},
+		{"factor 2", 8, 2, []uint64{1, 3, 5, 6, 7, 8}, 2},
+		{"factor 3", 8, 3, []uint64{1, 4, 5, 6, 7, 8}, 2},
+		{"odd size", 7, 2, []uint64{1, 3, 4, 5, 6, 7}, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			list, dropped := downsampleMessages(testMessages(tt.size), tt.factor)
+
+			if dropped != tt.wantDropped {
+				t.Errorf("dropped %d messages, want %d", dropped, tt.wantDropped)
+			}
+			if got := sequences(list); !sameSequences(got, tt.wantSeqs) {
+				t.Errorf("kept sequences %v, want %v", got, tt.wantSeqs)
+			}
+		})
+	}
+}
+
+func TestAggregateMessages(t *testing.T) {
+
+	tests := []struct {
+		name       string
+		size       int
+		bucketSize int
+		wantSeqs   []uint64
+		wantCounts []int
+		wantMerged int
+	}{
+		{"too small", 2, 2, []uint64{1, 2}, []int{1, 1}, 0},
+		{"one bucket", 8, 4, []uint64{4, 5, 6, 7, 8}, []int{4, 1, 1, 1, 1}, 3},
+		{"two buckets", 8, 2, []uint64{2, 4, 5, 6, 7, 8}, []int{2, 2, 1, 1, 1, 1}, 2},
+		{"partial bucket", 10, 3, []uint64{3, 5, 6, 7, 8, 9, 10}, []int{3, 2, 1, 1, 1, 1, 1}, 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			list, merged := aggregateMessages(testMessages(tt.size), tt.bucketSize)
+
+			if merged != tt.wantMerged {
+				t.Errorf("merged %d messages, want %d", merged, tt.wantMerged)
+			}
+			if got := sequences(list); !sameSequences(got, tt.wantSeqs) {
+				t.Fatalf("kept sequences %v, want %v", got, tt.wantSeqs)
+			}
+			for i, msg := range list {
+				count := 1
+				if msg.Aggregate != nil {
+					count = msg.Aggregate.Count
+				}
+				if count != tt.wantCounts[i] {
+					t.Errorf("message %d holds %d readings, want %d", i, count, tt.wantCounts[i])
+				}
+			}
+		})
+	}
+}
+
+func TestMergeMessages(t *testing.T) {
+
+	messages := testMessages(4)
+
+	// merging an aggregate again keeps its range and weight
+	again := mergeMessages([]*Message{mergeMessages(messages[:3]), messages[3]})
+
+	tests := []struct {
+		name      string
+		msg       *Message
+		wantCount int
+		wantAvg   float64
+		wantMin   float64
+		wantMax   float64
+		wantOpen  bool
+		wantFrom  time.Time
+		wantTo    time.Time
+	}{
+		{"readings", mergeMessages(messages[:3]), 3, 1, 0, 2, true, messages[0].CollectedAt, messages[2].CollectedAt},
+		{"aggregate and reading", again, 4, 1.5, 0, 3, true, messages[0].CollectedAt, messages[3].CollectedAt},
+		{"no true boolean", mergeMessages(messages[2:]), 2, 2.5, 2, 3, false, messages[2].CollectedAt, messages[3].CollectedAt},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			aggregate := tt.msg.Aggregate
+			if aggregate == nil {
+				t.Fatalf("the merged message has no aggregate")
+			}
+			if aggregate.Count != tt.wantCount {
+				t.Errorf("count is %d, want %d", aggregate.Count, tt.wantCount)
+			}
+			if !aggregate.From.Equal(tt.wantFrom) || !aggregate.To.Equal(tt.wantTo) {
+				t.Errorf("range is %s to %s, want %s to %s", aggregate.From, aggregate.To, tt.wantFrom, tt.wantTo)
+			}
+			if aggregate.Min["temperature.CurrentValue"] != tt.wantMin || aggregate.Max["temperature.CurrentValue"] != tt.wantMax {
+				t.Errorf("min and max are %v and %v, want %v and %v", aggregate.Min["temperature.CurrentValue"], aggregate.Max["temperature.CurrentValue"], tt.wantMin, tt.wantMax)
+			}
+
+			temperature := tt.msg.Sensors["temperature"].(map[string]interface{})
+			if temperature["CurrentValue"] != tt.wantAvg {
+				t.Errorf("average is %v, want %v", temperature["CurrentValue"], tt.wantAvg)
+			}
+			if tt.msg.Sensors["open"] != tt.wantOpen {
+				t.Errorf("open is %v, want %v", tt.msg.Sensors["open"], tt.wantOpen)
+			}
+		})
+	}
+}
+
+func TestDataListOverflow(t *testing.T) {
+
+	tests := []struct {
+		name      string
+		overflow  OverflowConf
+		appends   int
+		wantSeqs  []uint64
+		wantStats OverflowStats
+	}{
+		{"drop oldest", OverflowConf{Policy: overflowDropOldest}, 6, []uint64{3, 4, 5, 6}, OverflowStats{Events: 2, Dropped: 2}},
+		{"default policy", OverflowConf{}, 5, []uint64{2, 3, 4, 5}, OverflowStats{Events: 1, Dropped: 1}},
+		{"drop newest", OverflowConf{Policy: overflowDropNewest}, 6, []uint64{1, 2, 3, 4}, OverflowStats{Events: 2, Dropped: 2}},
+		{"downsample", OverflowConf{Policy: overflowDownsample, Factor: 2}, 5, []uint64{1, 3, 4, 5}, OverflowStats{Events: 1, Dropped: 1}},
+		{"aggregate", OverflowConf{Policy: overflowAggregate, BucketSize: 2}, 5, []uint64{2, 3, 4, 5}, OverflowStats{Events: 1, Merged: 1}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			conf := &Configuration{ID: "device", Options: &Options{}}
+			conf.Data.MaxMessages = 4
+			conf.Data.Overflow = tt.overflow
+
+			// the sequences are compared as offsets from a known start
+			dl := NewDataList(NewLiveConfiguration(conf))
+			dl.sequence = 1000
+			for i := 0; i < tt.appends; i++ {
+				dl.Append(&Sensors{"temperature": float64(i)}, time.Now())
+			}
+
+			got := sequences(dl.GetHeadN(dl.Len()))
+			for i := range got {
+				got[i] -= 1000
+			}
+
+			if !sameSequences(got, tt.wantSeqs) {
+				t.Errorf("kept sequences %v, want %v", got, tt.wantSeqs)
+			}
+			if dl.Overflow() != tt.wantStats {
+				t.Errorf("overflow counters %+v, want %+v", dl.Overflow(), tt.wantStats)
+			}
+		})
+	}
+}
+
+func TestDataListRemoveThrough(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		overflow func(list []*Message) []*Message
+		through  uint64
+		wantSeqs []uint64
+	}{
+		{"published head", nil, 2, []uint64{3, 4, 5, 6, 7, 8}},
+		{"nothing published", nil, 0, []uint64{1, 2, 3, 4, 5, 6, 7, 8}},
+		{
+			name:     "head dropped while publishing",
+			overflow: func(list []*Message) []*Message { return list[1:] },
+			through:  2,
+			wantSeqs: []uint64{3, 4, 5, 6, 7, 8},
+		},
+		{
+			name:     "head downsampled while publishing",
+			overflow: func(list []*Message) []*Message { l, _ := downsampleMessages(list, 2); return l },
+			through:  2,
+			wantSeqs: []uint64{3, 5, 6, 7, 8},
+		},
+		{
+			name:     "head aggregated while publishing",
+			overflow: func(list []*Message) []*Message { l, _ := aggregateMessages(list, 4); return l },
+			through:  1,
+			wantSeqs: []uint64{4, 5, 6, 7, 8},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			conf := &Configuration{ID: "device", Options: &Options{}}
+			dl := NewDataList(NewLiveConfiguration(conf))
+			dl.list = testMessages(8)
+
+			if tt.overflow != nil {
+				dl.list = tt.overflow(dl.list)
+			}
+			dl.RemoveThrough(tt.through)
+
+			if got := sequences(dl.list); !sameSequences(got, tt.wantSeqs) {
+				t.Errorf("kept sequences %v, want %v", got, tt.wantSeqs)
+			}
+		})
+	}
+}
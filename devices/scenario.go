@@ -0,0 +1,280 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"time"
+)
+
+type FaultSettingsConf struct {
+	Value     *float64 `json:"value"`
+	Amplitude float64  `json:"amplitude"`
+	Rate      float64  `json:"rate"`
+	Period    int64    `json:"period"`
+}
+
+type FaultConf struct {
+	Sensor   string            `json:"sensor"`
+	Type     string            `json:"type"`
+	Start    int64             `json:"start"`
+	End      int64             `json:"end"`
+	Settings FaultSettingsConf `json:"settings"`
+}
+
+type ScenarioConf struct {
+	Name   string      `json:"name"`
+	Faults []FaultConf `json:"faults"`
+}
+
+// numericReading is implemented by readings holding a single numeric value
+type numericReading interface {
+	value() float64
+	withValue(value float64) interface{}
+}
+
+type fault struct {
+	conf     FaultConf
+	isActive bool
+	stuck    interface{}
+}
+
+// Scenario holds the faults injected on top of the sensors simulation.
+// Fault start and end times are milliseconds of virtual time since
+// the simulation start.
+type Scenario struct {
+	conf   *Configuration
+	random *rand.Rand
+	path   string
+	name   string
+	faults []*fault
+}
+
+const (
+	faultStuck             = "stuck"
+	faultDropout           = "dropout"
+	faultNoise             = "noise"
+	faultDrift             = "drift"
+	faultCompressorFailure = "compressorFailure"
+	faultFlapping          = "flapping"
+)
+
+// NewScenario creates a new empty fault scenario
+func NewScenario(conf *Configuration, random *rand.Rand) *Scenario {
+
+	sc := &Scenario{}
+
+	sc.conf = conf
+	sc.random = random
+	sc.faults = make([]*fault, 0)
+
+	// the command line option overrides the configuration file
+	sc.path = conf.Scenario
+	if conf.Options.scenarioFile != "" {
+		sc.path = conf.Options.scenarioFile
+	}
+
+	return sc
+}
+
+// Read reads and validates the scenario file if one is set
+func (sc *Scenario) Read() error {
+
+	if sc.path == "" {
+		return nil
+	}
+
+	log.Printf("INFO: [SCENARIO] reading fault scenario %s", sc.path)
+
+	file, err := os.ReadFile(sc.path)
+	if err != nil {
+		return fmt.Errorf("ERROR: [SCENARIO] failed to read scenario file: %s REASON: %s", sc.path, err.Error())
+	}
+
+	scenarioConf := ScenarioConf{}
+	if err := json.Unmarshal(file, &scenarioConf); err != nil {
+		return fmt.Errorf("ERROR: [SCENARIO] failed to parse scenario file: %s REASON: %s", sc.path, err.Error())
+	}
+
+	for _, faultConf := range scenarioConf.Faults {
+
+		if err := validateFault(faultConf); err != nil {
+			return err
+		}
+
+		sc.faults = append(sc.faults, &fault{conf: faultConf})
+	}
+
+	sc.name = scenarioConf.Name
+
+	log.Printf("INFO: [SCENARIO] scenario %s loaded with %d faults", sc.name, len(sc.faults))
+
+	return nil
+}
+
+func validateFault(conf FaultConf) error {
+
+	switch conf.Type {
+	case faultStuck, faultDropout, faultDrift, faultCompressorFailure:
+	case faultNoise:
+		if conf.Settings.Amplitude <= 0 {
+			return fmt.Errorf("ERROR: [SCENARIO] noise fault on %s requires an amplitude greater than 0", conf.Sensor)
+		}
+	case faultFlapping:
+		if conf.Settings.Period <= 0 {
+			return fmt.Errorf("ERROR: [SCENARIO] flapping fault on %s requires a period greater than 0", conf.Sensor)
+		}
+	default:
+		return fmt.Errorf("ERROR: [SCENARIO] unknown fault type %s on sensor %s", conf.Type, conf.Sensor)
+	}
+
+	if conf.Start < 0 || (conf.End != 0 && conf.End <= conf.Start) {
+		return fmt.Errorf("ERROR: [SCENARIO] %s fault on %s end must be after start", conf.Type, conf.Sensor)
+	}
+
+	return nil
+}
+
+// IsActive returns true if a fault of the given type is active for the sensor
+func (sc *Scenario) IsActive(sensor string, faultType string, since time.Duration) bool {
+
+	if sc == nil {
+		return false
+	}
+
+	for _, f := range sc.faults {
+		if f.conf.Sensor == sensor && f.conf.Type == faultType && f.inRange(since) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Apply applies the active faults of a sensor to its reading
+func (sc *Scenario) Apply(sensor string, reading interface{}, virtualTime time.Time, since time.Duration) interface{} {
+
+	if sc == nil {
+		return reading
+	}
+
+	for _, f := range sc.faults {
+
+		if f.conf.Sensor != sensor {
+			continue
+		}
+
+		active := f.inRange(since)
+		if active != f.isActive {
+
+			f.isActive = active
+			f.stuck = nil
+
+			if active {
+				log.Printf("INFO: [SCENARIO] %s fault on sensor %s started", f.conf.Type, sensor)
+			} else {
+				log.Printf("INFO: [SCENARIO] %s fault on sensor %s ended", f.conf.Type, sensor)
+			}
+		}
+
+		if active {
+			reading = f.apply(reading, sc.random, virtualTime, since)
+		}
+	}
+
+	return reading
+}
+
+// FlappingDoor returns if a flapping fault is active for the door sensor
+// and if it holds the door open, the simulated physics follows the door
+// the fault reports
+func (sc *Scenario) FlappingDoor(sensor string, since time.Duration) (isOpen bool, active bool) {
+
+	if sc == nil {
+		return false, false
+	}
+
+	for _, f := range sc.faults {
+		if f.conf.Sensor == sensor && f.conf.Type == faultFlapping && f.inRange(since) {
+			isOpen, _ = f.flap(since)
+			return isOpen, true
+		}
+	}
+
+	return false, false
+}
+
+// flap returns if a flapping door is open and the
+// virtual time passed since it last opened or closed
+func (f *fault) flap(since time.Duration) (bool, time.Duration) {
+
+	faultTime := since - time.Duration(f.conf.Start)*time.Millisecond
+	period := time.Duration(f.conf.Settings.Period) * time.Millisecond
+
+	return (faultTime/period)%2 == 0, faultTime % period
+}
+
+// inRange returns true if the virtual time is inside the fault window,
+// a fault with no end lasts until the simulation stops
+func (f *fault) inRange(since time.Duration) bool {
+
+	start := time.Duration(f.conf.Start) * time.Millisecond
+	end := time.Duration(f.conf.End) * time.Millisecond
+
+	return since >= start && (f.conf.End == 0 || since < end)
+}
+
+func (f *fault) apply(reading interface{}, random *rand.Rand, virtualTime time.Time, since time.Duration) interface{} {
+
+	// the time passed since the fault started
+	faultTime := since - time.Duration(f.conf.Start)*time.Millisecond
+
+	switch f.conf.Type {
+	case faultStuck:
+		// the sensor reports a fixed value or, if none is set,
+		// keeps reporting the reading it had when the fault started
+		if f.stuck == nil {
+			f.stuck = reading
+			if numeric, ok := reading.(numericReading); ok && f.conf.Settings.Value != nil {
+				f.stuck = numeric.withValue(*f.conf.Settings.Value)
+			}
+		}
+		return f.stuck
+
+	case faultDropout:
+		// the sensor reports null readings
+		return nil
+
+	case faultNoise:
+		if numeric, ok := reading.(numericReading); ok {
+			noise := (random.Float64()*2 - 1) * f.conf.Settings.Amplitude
+			return numeric.withValue(numeric.value() + noise)
+		}
+
+	case faultDrift:
+		// the rate is the value drift per hour of virtual time
+		if numeric, ok := reading.(numericReading); ok {
+			return numeric.withValue(numeric.value() + f.conf.Settings.Rate*faultTime.Hours())
+		}
+
+	case faultFlapping:
+		// the door sensor alternates between open and closed every period
+		if door, ok := reading.(SensorDoor); ok {
+			isOpen, flapped := f.flap(since)
+			flapTime := virtualTime.Add(-flapped)
+			door.IsOpen = isOpen
+			door.OpenTime = nil
+			door.CloseTime = nil
+			if door.IsOpen {
+				door.OpenTime = &flapTime
+			} else {
+				door.CloseTime = &flapTime
+			}
+			return door
+		}
+	}
+
+	return reading
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Sensor is a simulated device sensor
+type Sensor interface {
+	// Name returns the sensor name used as the key in the message payload
+	Name() string
+	// Simulate advances the sensor state to the given virtual time,
+	// elapsed is the virtual time passed since the previous simulation
+	Simulate(virtualTime time.Time, elapsed time.Duration)
+	// Reading returns a copy of the current sensor reading
+	Reading() interface{}
+}
+
+// DoorState is implemented by sensors that report a door status
+type DoorState interface {
+	IsOpen() bool
+}
+
+// NumericState is implemented by sensors that report a single numeric value
+type NumericState interface {
+	Value() float64
+}
+
+// SetpointSetter is implemented by sensors with a changeable setpoint
+type SetpointSetter interface {
+	SetSetpoint(value float64) error
+}
+
+// DoorOpener is implemented by door sensors that can be forced open
+type DoorOpener interface {
+	ForceOpen(duration time.Duration)
+}
+
+// DefrostState is implemented by sensors that report a defrost cycle
+type DefrostState interface {
+	IsDefrosting() bool
+	HeaterPower() float64
+}
+
+// SensorFactory creates a sensor from its configuration
+type SensorFactory func(simulation *Simulation, conf SensorConf) (Sensor, error)
+
+var sensorFactories = map[string]SensorFactory{}
+
+// RegisterSensor registers a sensor factory for the given sensor type
+func RegisterSensor(sensorType string, factory SensorFactory) {
+
+	if _, ok := sensorFactories[sensorType]; ok {
+		panic(fmt.Sprintf("sensor type %s already registered", sensorType))
+	}
+
+	sensorFactories[sensorType] = factory
+}
+
+// SensorTypes returns the registered sensor types sorted by name
+func SensorTypes() []string {
+
+	types := make([]string, 0, len(sensorFactories))
+	for t := range sensorFactories {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+
+	return types
+}
+
+// NewSensor creates a new sensor using the factory registered for its type
+func NewSensor(simulation *Simulation, conf SensorConf) (Sensor, error) {
+
+	if conf.Name == "" {
+		return nil, fmt.Errorf("ERROR: [SENSOR] sensor of type %s has no name", conf.Type)
+	}
+
+	factory, ok := sensorFactories[conf.Type]
+	if !ok {
+		return nil, fmt.Errorf("ERROR: [SENSOR] unknown sensor type %s for sensor %s, available types: %v", conf.Type, conf.Name, SensorTypes())
+	}
+
+	return factory(simulation, conf)
+}
+
+// decodeSensorSettings decodes the sensor type specific settings
+func decodeSensorSettings(conf SensorConf, settings interface{}) error {
+
+	if len(conf.Settings) == 0 {
+		return nil
+	}
+
+	if err := json.Unmarshal(conf.Settings, settings); err != nil {
+		return fmt.Errorf("ERROR: [SENSOR] invalid settings for sensor %s REASON: %s", conf.Name, err.Error())
+	}
+
+	return nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+type SensorDefrost struct {
+	IsActive  bool       `json:"IsActive"`
+	StartTime *time.Time `json:"StartTime"`
+	EndTime   *time.Time `json:"EndTime"`
+}
+
+// DefrostSensor simulates the periodic defrost cycles of a freezer.
+// The first cycle starts offset milliseconds after the simulation
+// start and then repeats every interval milliseconds.
+type DefrostSensor struct {
+	name       string
+	conf       SensorDefrostConf
+	simulation *Simulation
+	status     SensorDefrost
+}
+
+func init() {
+	RegisterSensor("defrost", NewDefrostSensor)
+}
+
+// NewDefrostSensor creates a new defrost cycle sensor
+func NewDefrostSensor(simulation *Simulation, conf SensorConf) (Sensor, error) {
+
+	ds := &DefrostSensor{}
+
+	ds.name = conf.Name
+	ds.simulation = simulation
+
+	if err := decodeSensorSettings(conf, &ds.conf); err != nil {
+		return nil, err
+	}
+
+	if ds.conf.Interval <= 0 || ds.conf.Duration <= 0 || ds.conf.Duration >= ds.conf.Interval {
+		return nil, fmt.Errorf("ERROR: [SENSOR] defrost sensor %s duration must be greater than 0 and lower than interval", conf.Name)
+	}
+
+	if ds.conf.Offset < 0 || ds.conf.HeaterPower < 0 {
+		return nil, fmt.Errorf("ERROR: [SENSOR] defrost sensor %s offset and heaterPower can't be negative", conf.Name)
+	}
+
+	ds.status.IsActive = false
+	ds.status.StartTime = nil
+	ds.status.EndTime = nil
+
+	return ds, nil
+}
+
+func (ds *DefrostSensor) Name() string {
+
+	return ds.name
+}
+
+func (ds *DefrostSensor) IsDefrosting() bool {
+
+	return ds.status.IsActive
+}
+
+func (ds *DefrostSensor) HeaterPower() float64 {
+
+	return ds.conf.HeaterPower
+}
+
+func (ds *DefrostSensor) Reading() interface{} {
+
+	return ds.status
+}
+
+func (ds *DefrostSensor) Simulate(virtualTime time.Time, elapsed time.Duration) {
+
+	ds.status.IsActive = false
+	ds.status.StartTime = nil
+	ds.status.EndTime = nil
+
+	since := ds.simulation.Since(virtualTime) - time.Duration(ds.conf.Offset)*time.Millisecond
+	if since < 0 {
+		return
+	}
+
+	interval := time.Duration(ds.conf.Interval) * time.Millisecond
+	duration := time.Duration(ds.conf.Duration) * time.Millisecond
+
+	// position inside the current defrost cycle
+	phase := since % interval
+	if phase >= duration {
+		return
+	}
+
+	start := virtualTime.Add(-phase)
+	end := start.Add(duration)
+
+	ds.status.IsActive = true
+	ds.status.StartTime = &start
+	ds.status.EndTime = &end
+}
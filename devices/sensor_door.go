@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+type SensorDoor struct {
+	OpenTime  *time.Time `json:"OpenTime"`
+	CloseTime *time.Time `json:"CloseTime"`
+	IsOpen    bool       `json:"IsOpen"`
+}
+
+// DoorSensor simulates a door that opens randomly and
+// stays open for a random amount of time
+type DoorSensor struct {
+	name       string
+	conf       SensorDoorConf
+	simulation *Simulation
+	status     SensorDoor
+	forceOpen  *time.Duration
+}
+
+func init() {
+	RegisterSensor("door", NewDoorSensor)
+}
+
+// NewDoorSensor creates a new door sensor
+func NewDoorSensor(simulation *Simulation, conf SensorConf) (Sensor, error) {
+
+	ds := &DoorSensor{}
+
+	ds.name = conf.Name
+	ds.simulation = simulation
+
+	if err := decodeSensorSettings(conf, &ds.conf); err != nil {
+		return nil, err
+	}
+
+	if ds.conf.MaxTime <= ds.conf.MinTime {
+		return nil, fmt.Errorf("ERROR: [SENSOR] door sensor %s maxTime must be greater than minTime", conf.Name)
+	}
+
+	ds.status.OpenTime = nil
+	ds.status.CloseTime = nil
+	ds.status.IsOpen = false
+
+	return ds, nil
+}
+
+func (ds *DoorSensor) Name() string {
+
+	return ds.name
+}
+
+func (ds *DoorSensor) IsOpen() bool {
+
+	return ds.status.IsOpen
+}
+
+// ForceOpen opens the door at the next simulation for the given duration
+func (ds *DoorSensor) ForceOpen(duration time.Duration) {
+
+	ds.forceOpen = &duration
+}
+
+func (ds *DoorSensor) Reading() interface{} {
+
+	// if the door sensor is marked as open
+	// we don't want to send the time the door
+	// is set to close
+	item := ds.status
+	if item.IsOpen {
+		item.CloseTime = nil
+	}
+
+	return item
+}
+
+func (ds *DoorSensor) Simulate(virtualTime time.Time, elapsed time.Duration) {
+
+	// if the door was forced open by a command it stays
+	// open for the requested time
+	if ds.forceOpen != nil {
+
+		calculatedClose := virtualTime.Add(*ds.forceOpen)
+		ds.forceOpen = nil
+
+		if !ds.status.IsOpen {
+			ds.status.OpenTime = &virtualTime
+		}
+		ds.status.CloseTime = &calculatedClose
+		ds.status.IsOpen = true
+
+		return
+	}
+
+	// if the door is closed
+	if !ds.status.IsOpen {
+
+		// door is not open so set the close time to zero
+		ds.status.CloseTime = nil
+
+		// check if the door opens now
+		rnd := ds.simulation.random.Float64()
+		if rnd <= ds.conf.Chance {
+
+			// if the door opens then calculate the amount of time it will remain open
+			randomTimeOpen := ds.simulation.random.Int63n(ds.conf.MaxTime-ds.conf.MinTime) + ds.conf.MinTime
+
+			if ds.simulation.conf.Get().Options.debug {
+				log.Printf("INFO: [SIMULATE] %s will be open for %d milliseconds", ds.name, randomTimeOpen)
+			}
+
+			calculatedClose := virtualTime.Add(time.Duration(randomTimeOpen) * time.Millisecond)
+
+			ds.status.CloseTime = &calculatedClose
+			// set the door to open
+			ds.status.IsOpen = true
+			ds.status.OpenTime = &virtualTime
+		}
+	} else if ds.status.IsOpen && ds.status.CloseTime.Sub(virtualTime) < 0 {
+
+		// if the door is open and it's time to close the door
+
+		// if the door is open check if it's time to the door to close
+		// if so close the door
+		ds.status.IsOpen = false
+
+		// set the time the metric is being closed
+		ds.status.CloseTime = &virtualTime
+		// set the open time to zero
+		ds.status.OpenTime = nil
+	}
+}
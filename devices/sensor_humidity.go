@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+type SensorHumidity struct {
+	CurrentValue float64 `json:"CurrentValue"`
+	DewPoint     float64 `json:"DewPoint"`
+	Condensing   bool    `json:"Condensing"`
+}
+
+// HumiditySensor simulates the relative humidity inside a freezer
+// derived from the cabinet temperature. The water vapour pressure
+// moves towards the ambient one while the door is open, towards
+// saturation while defrosting (melting frost) and is dried by the
+// evaporator back to the normal humidity while the door is closed.
+// Any vapour above saturation condenses.
+type HumiditySensor struct {
+	name          string
+	conf          SensorHumidityConf
+	simulation    *Simulation
+	status        SensorHumidity
+	vapour        float64
+	isInitialized bool
+}
+
+// the lowest vapour pressure in hPa used for the dew point
+const minVapourPressure = 1e-6
+
+func init() {
+	RegisterSensor("humidity", NewHumiditySensor)
+}
+
+// NewHumiditySensor creates a new temperature correlated humidity sensor
+func NewHumiditySensor(simulation *Simulation, conf SensorConf) (Sensor, error) {
+
+	hs := &HumiditySensor{}
+
+	hs.name = conf.Name
+	hs.simulation = simulation
+
+	if err := decodeSensorSettings(conf, &hs.conf); err != nil {
+		return nil, err
+	}
+
+	if hs.conf.Normal <= 0 || hs.conf.Normal > 1 || hs.conf.AmbientHumidity < 0 || hs.conf.AmbientHumidity > 1 {
+		return nil, fmt.Errorf("ERROR: [SENSOR] humidity sensor %s normal and ambientHumidity must be between 0 and 1", conf.Name)
+	}
+
+	if hs.conf.DoorExchangeRate < 0 || hs.conf.DryingRate < 0 || hs.conf.DefrostRate < 0 {
+		return nil, fmt.Errorf("ERROR: [SENSOR] humidity sensor %s rates can't be negative", conf.Name)
+	}
+
+	if hs.conf.Temperature == "" {
+		hs.conf.Temperature = defaultTemperatureSensor
+	}
+
+	if hs.conf.Door == "" {
+		hs.conf.Door = defaultDoorSensor
+	}
+
+	if hs.conf.Defrost == "" {
+		hs.conf.Defrost = defaultDefrostSensor
+	}
+
+	hs.isInitialized = false
+
+	return hs, nil
+}
+
+func (hs *HumiditySensor) Name() string {
+
+	return hs.name
+}
+
+func (hs *HumiditySensor) Value() float64 {
+
+	return hs.status.CurrentValue
+}
+
+func (hs *HumiditySensor) SetSetpoint(value float64) error {
+
+	if value <= 0 || value > 1 {
+		return fmt.Errorf("ERROR: [SENSOR] humidity sensor %s setpoint must be between 0 and 1", hs.name)
+	}
+
+	hs.conf.Normal = value
+
+	return nil
+}
+
+func (sh SensorHumidity) value() float64 {
+
+	return sh.CurrentValue
+}
+
+func (sh SensorHumidity) withValue(value float64) interface{} {
+
+	sh.CurrentValue = value
+	return sh
+}
+
+func (hs *HumiditySensor) Reading() interface{} {
+
+	return hs.status
+}
+
+func (hs *HumiditySensor) Simulate(virtualTime time.Time, elapsed time.Duration) {
+
+	temperature, ok := hs.simulation.Sensor(hs.conf.Temperature).(NumericState)
+	if !ok {
+		return
+	}
+
+	saturation := saturationVapourPressure(temperature.Value())
+
+	// start with the normal humidity at the current temperature
+	if !hs.isInitialized {
+		hs.vapour = hs.conf.Normal * saturation
+		hs.isInitialized = true
+	}
+
+	// choose the vapour pressure the cabinet air is moving towards
+	target := hs.conf.Normal * saturation
+	rate := hs.conf.DryingRate
+	if hs.simulation.isDoorOpen(hs.conf.Door) {
+		target = hs.conf.AmbientHumidity * saturationVapourPressure(hs.conf.AmbientTemperature)
+		rate = hs.conf.DoorExchangeRate
+	} else if hs.simulation.defrost(hs.conf.Defrost) != nil {
+		target = saturation
+		rate = hs.conf.DefrostRate
+	}
+
+	hs.vapour = target + (hs.vapour-target)*math.Exp(-rate*elapsed.Seconds())
+
+	// vapour above the saturation pressure condenses
+	hs.status.Condensing = false
+	if hs.vapour > saturation {
+		hs.vapour = saturation
+		hs.status.Condensing = true
+	}
+
+	hs.status.CurrentValue = hs.vapour / saturation
+	hs.status.DewPoint = dewPoint(hs.vapour)
+}
+
+// saturationVapourPressure returns the water saturation vapour pressure
+// in hPa for a temperature in °C using the Magnus formula
+func saturationVapourPressure(temperature float64) float64 {
+
+	return 6.112 * math.Exp(17.62*temperature/(243.12+temperature))
+}
+
+// dewPoint returns the dew point in °C for a vapour pressure in hPa,
+// a dry air vapour pressure is clamped so the logarithm stays finite
+func dewPoint(vapour float64) float64 {
+
+	vapour = math.Max(vapour, minVapourPressure)
+
+	gamma := math.Log(vapour / 6.112)
+
+	return 243.12 * gamma / (17.62 - gamma)
+}
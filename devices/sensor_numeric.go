@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+type SensorNumeric struct {
+	CurrentValue float64 `json:"CurrentValue"`
+}
+
+// NumericSensor simulates a value that rises by a fixed step
+// while a door is open and falls back to normal when it closes
+type NumericSensor struct {
+	name       string
+	conf       SensorNumericConf
+	simulation *Simulation
+	status     SensorNumeric
+}
+
+const (
+	defaultDoorSensor        = "door"
+	defaultDefrostSensor     = "defrost"
+	defaultTemperatureSensor = "temperature"
+)
+
+func init() {
+	RegisterSensor("numeric", NewNumericSensor)
+}
+
+// NewNumericSensor creates a new linear numeric sensor
+func NewNumericSensor(simulation *Simulation, conf SensorConf) (Sensor, error) {
+
+	ns := &NumericSensor{}
+
+	ns.name = conf.Name
+	ns.simulation = simulation
+
+	if err := decodeSensorSettings(conf, &ns.conf); err != nil {
+		return nil, err
+	}
+
+	if ns.conf.Door == "" {
+		ns.conf.Door = defaultDoorSensor
+	}
+
+	if ns.conf.Defrost == "" {
+		ns.conf.Defrost = defaultDefrostSensor
+	}
+
+	ns.status.CurrentValue = ns.conf.Normal
+
+	return ns, nil
+}
+
+func (ns *NumericSensor) Name() string {
+
+	return ns.name
+}
+
+func (ns *NumericSensor) Value() float64 {
+
+	return ns.status.CurrentValue
+}
+
+func (ns *NumericSensor) SetSetpoint(value float64) error {
+
+	if value > ns.conf.Max {
+		return fmt.Errorf("ERROR: [SENSOR] sensor %s setpoint can't be greater than %f", ns.name, ns.conf.Max)
+	}
+
+	ns.conf.Normal = value
+
+	return nil
+}
+
+func (sn SensorNumeric) value() float64 {
+
+	return sn.CurrentValue
+}
+
+func (sn SensorNumeric) withValue(value float64) interface{} {
+
+	sn.CurrentValue = value
+	return sn
+}
+
+func (ns *NumericSensor) Reading() interface{} {
+
+	return ns.status
+}
+
+func (ns *NumericSensor) Simulate(virtualTime time.Time, elapsed time.Duration) {
+
+	// calculate the value if door is open, a defrost is running,
+	// the compressor failed or the value is != normal
+	if ns.simulation.isDoorOpen(ns.conf.Door) || ns.simulation.defrost(ns.conf.Defrost) != nil || ns.simulation.hasCompressorFailure(ns.name, virtualTime) {
+
+		// if the door is open we must increase the value until it's maximum
+		ns.status.CurrentValue += ns.conf.Increase
+		if ns.status.CurrentValue > ns.conf.Max {
+
+			ns.status.CurrentValue = ns.conf.Max
+		}
+
+	} else if ns.status.CurrentValue > ns.conf.Normal {
+
+		// if door is closed and the current value is higher that the
+		// normal value we need to decrease the value until it
+		// reaches the normal value
+		ns.status.CurrentValue -= ns.conf.Decrease
+		if ns.status.CurrentValue < ns.conf.Normal {
+
+			ns.status.CurrentValue = ns.conf.Normal
+		}
+	}
+}
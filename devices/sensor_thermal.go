@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+type SensorThermal struct {
+	CurrentValue float64 `json:"CurrentValue"`
+	CompressorOn bool    `json:"CompressorOn"`
+}
+
+// ThermalSensor simulates a freezer temperature using Newton's law of cooling.
+// The cabinet exchanges heat with the ambient through its insulation and,
+// while the door is open, through the door opening. A thermostat switches the
+// compressor on and off around the setpoint.
+type ThermalSensor struct {
+	name       string
+	conf       SensorThermalConf
+	simulation *Simulation
+	status     SensorThermal
+}
+
+const (
+	// maximum integration step so the curves don't depend
+	// on the virtual clock interval and multiplier
+	thermalMaxStep = time.Second
+)
+
+func init() {
+	RegisterSensor("thermal", NewThermalSensor)
+}
+
+// NewThermalSensor creates a new physically based temperature sensor
+func NewThermalSensor(simulation *Simulation, conf SensorConf) (Sensor, error) {
+
+	ts := &ThermalSensor{}
+
+	ts.name = conf.Name
+	ts.simulation = simulation
+
+	if err := decodeSensorSettings(conf, &ts.conf); err != nil {
+		return nil, err
+	}
+
+	if ts.conf.ThermalMass <= 0 {
+		return nil, fmt.Errorf("ERROR: [SENSOR] thermal sensor %s thermalMass must be greater than 0", conf.Name)
+	}
+
+	if ts.conf.Insulation < 0 || ts.conf.DoorExchange < 0 || ts.conf.CoolingPower < 0 || ts.conf.Hysteresis < 0 {
+		return nil, fmt.Errorf("ERROR: [SENSOR] thermal sensor %s coefficients can't be negative", conf.Name)
+	}
+
+	if ts.conf.Door == "" {
+		ts.conf.Door = defaultDoorSensor
+	}
+
+	if ts.conf.Defrost == "" {
+		ts.conf.Defrost = defaultDefrostSensor
+	}
+
+	ts.status.CurrentValue = ts.conf.Setpoint
+	if ts.conf.Initial != nil {
+		ts.status.CurrentValue = *ts.conf.Initial
+	}
+	ts.status.CompressorOn = false
+
+	return ts, nil
+}
+
+func (ts *ThermalSensor) Name() string {
+
+	return ts.name
+}
+
+func (ts *ThermalSensor) Value() float64 {
+
+	return ts.status.CurrentValue
+}
+
+func (ts *ThermalSensor) SetSetpoint(value float64) error {
+
+	ts.conf.Setpoint = value
+
+	return nil
+}
+
+func (st SensorThermal) value() float64 {
+
+	return st.CurrentValue
+}
+
+func (st SensorThermal) withValue(value float64) interface{} {
+
+	st.CurrentValue = value
+	return st
+}
+
+func (ts *ThermalSensor) Reading() interface{} {
+
+	return ts.status
+}
+
+func (ts *ThermalSensor) Simulate(virtualTime time.Time, elapsed time.Duration) {
+
+	doorOpen := ts.simulation.isDoorOpen(ts.conf.Door)
+	compressorFailure := ts.simulation.hasCompressorFailure(ts.name, virtualTime)
+
+	// while defrosting the compressor is stopped and
+	// the defrost heater warms the cabinet
+	heater := 0.0
+	defrost := ts.simulation.defrost(ts.conf.Defrost)
+	if defrost != nil {
+		heater = defrost.HeaterPower()
+	}
+
+	// integrate in small steps so the thermostat can switch
+	// the compressor in the middle of a long clock interval
+	for elapsed > 0 {
+
+		step := elapsed
+		if step > thermalMaxStep {
+			step = thermalMaxStep
+		}
+		elapsed -= step
+
+		ts.thermostat()
+		if defrost != nil || compressorFailure {
+			ts.status.CompressorOn = false
+		}
+		ts.status.CurrentValue = ts.integrate(ts.status.CurrentValue, step.Seconds(), doorOpen, heater)
+	}
+}
+
+// thermostat switches the compressor on above the setpoint plus
+// hysteresis and off below the setpoint minus hysteresis
+func (ts *ThermalSensor) thermostat() {
+
+	if ts.status.CurrentValue >= ts.conf.Setpoint+ts.conf.Hysteresis {
+		ts.status.CompressorOn = true
+	} else if ts.status.CurrentValue <= ts.conf.Setpoint-ts.conf.Hysteresis {
+		ts.status.CompressorOn = false
+	}
+}
+
+// integrate returns the temperature after seconds using the exact solution of
+// C dT/dt = k (Tambient - T) - P, which converges exponentially to the
+// equilibrium temperature Tambient - P / k. P is the compressor heat removal
+// minus the defrost heater power.
+func (ts *ThermalSensor) integrate(temperature float64, seconds float64, doorOpen bool, heater float64) float64 {
+
+	// heat exchange coefficient with the ambient (W/K)
+	k := ts.conf.Insulation
+	if doorOpen {
+		k += ts.conf.DoorExchange
+	}
+
+	// net heat removal by the compressor and the defrost heater (W)
+	power := -heater
+	if ts.status.CompressorOn {
+		power += ts.conf.CoolingPower
+	}
+
+	// without heat exchange the temperature changes linearly
+	if k == 0 {
+		return temperature - power*seconds/ts.conf.ThermalMass
+	}
+
+	equilibrium := ts.conf.Ambient - power/k
+
+	return equilibrium + (temperature-equilibrium)*math.Exp(-k*seconds/ts.conf.ThermalMass)
+}
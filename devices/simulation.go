@@ -1,180 +1,267 @@
 package main
 
 import (
+	"fmt"
 	"log"
 	"math/rand"
+	"sync"
 	"time"
 )
 
-type SensorDoor struct {
-	OpenTime  *time.Time `json:"OpenTime"`
-	CloseTime *time.Time `json:"CloseTime"`
-	IsOpen    bool       `json:"IsOpen"`
-}
-
-type SensorNumeric struct {
-	CurrentValue float64 `json:"CurrentValue"`
-}
-
 type Simulation struct {
-	conf          *Configuration
-	currentStatus Sensors
-	statusList    *DataList
+	conf        *LiveConfiguration
+	mu          sync.Mutex
+	sensors     []Sensor
+	byName      map[string]Sensor
+	sensorConfs map[string]SensorConf
+	scenario    *Scenario
+	random      *rand.Rand
+	seed        *int64
+	startTime   *time.Time
+	lastTime    *time.Time
+	simulating  time.Time
+	last        Sensors
+	statusList  MessageAppender
 }
 
 // New simulation creates a new simulation struct
-func NewSimulation(conf *Configuration, list *DataList) *Simulation {
+func NewSimulation(conf *LiveConfiguration, list MessageAppender) *Simulation {
 
 	s := &Simulation{}
 
 	s.conf = conf
 	s.statusList = list
-
-	s.currentStatus.Door.OpenTime = nil
-	s.currentStatus.Door.CloseTime = nil
-	s.currentStatus.Door.IsOpen = false
-
-	s.currentStatus.Temperature.CurrentValue = conf.Sensors.Temperature.Normal
-
-	s.currentStatus.Humidity.CurrentValue = conf.Sensors.Humidity.Normal
+	s.sensors = make([]Sensor, 0)
+	s.byName = make(map[string]Sensor)
+	s.startTime = nil
 
 	return s
 }
 
-// Simulate runs a sensor simulation and store the results in the DataList object
-func (s *Simulation) Simulate(virtualTime time.Time) {
-
-	// strTime := virtualTime.Format(time.RFC3339)
-	// log.Printf("INFO: [SIMULATE] Time now: %s\n", strTime)
-
-	s.door(virtualTime)
-	s.temperature(virtualTime)
-	s.humidity(virtualTime)
-
-	// log.Printf("INFO: [SIMULATE] Door is open: %t\n", s.currentStatus.Door.IsOpen)
-	// if s.currentStatus.Door.OpenTime != nil {
-	// 	strTime := s.currentStatus.Door.OpenTime.Format(time.RFC3339)
-	// 	log.Printf("INFO: [SIMULATE] Door open time: %s\n", strTime)
-	// } else {
-	// 	log.Println("INFO: [SIMULATE] Door open time: nil")
-	// }
-
-	// if s.currentStatus.Door.CloseTime != nil {
-	// 	strTime := s.currentStatus.Door.CloseTime.Format(time.RFC3339)
-	// 	log.Printf("INFO: [SIMULATE] Door close time: %s\n", strTime)
-	// } else {
-	// 	log.Println("INFO: [SIMULATE] Door close time: nil")
-	// }
-
-	// log.Printf("INFO: [SIMULATE] Temperature: %.2f\n", s.currentStatus.Temperature.CurrentValue)
-	// log.Printf("INFO: [SIMULATE] Humidity: %.2f\n", s.currentStatus.Humidity.CurrentValue)
-
-	// if the door sensor is marked as open
-	// we don't want to send the time the door
-	// is set to close
-
-	item := s.currentStatus
-	if item.Door.IsOpen {
-		item.Door.CloseTime = nil
+// simulationState holds the sensors and scenario built from a configuration
+// before they replace the ones of the simulation
+type simulationState struct {
+	random      *rand.Rand
+	randomSeed  int64
+	seed        *int64
+	sensors     []Sensor
+	byName      map[string]Sensor
+	sensorConfs map[string]SensorConf
+	scenario    *Scenario
+}
+
+// Load creates the sensors declared in the configuration
+// and reads the fault scenario file if one is set
+func (s *Simulation) Load() error {
+
+	state, err := s.prepare(s.conf.Get())
+	if err != nil {
+		return err
 	}
 
-	s.statusList.Append(&item)
+	s.apply(state)
 
+	return nil
 }
 
-func (s *Simulation) door(virtualTime time.Time) {
-
-	// if the door is closed
-	if !s.currentStatus.Door.IsOpen {
+// prepare builds the sensors and scenario of a configuration without
+// changing the simulation so an invalid configuration is refused
+// before it's applied
+func (s *Simulation) prepare(conf *Configuration) (*simulationState, error) {
+
+	state := &simulationState{}
+
+	// with a configured seed every run produces the same readings,
+	// the random source is only replaced when the seed changes
+	state.random = s.random
+	state.seed = conf.Seed()
+	if state.random == nil || !sameJSON(conf.Seed(), s.seed) {
+		state.randomSeed = time.Now().UnixNano()
+		if conf.Seed() != nil {
+			state.randomSeed = *conf.Seed()
+		}
+		state.random = rand.New(rand.NewSource(state.randomSeed))
+	}
 
-		// door is not open so set the close time to zero
-		s.currentStatus.Door.CloseTime = nil
+	state.sensors = make([]Sensor, 0, len(conf.Sensors))
+	state.byName = make(map[string]Sensor)
+	state.sensorConfs = make(map[string]SensorConf)
 
-		// check if the door opens now
-		rnd := rand.Float64()
-		if rnd <= s.conf.Sensors.DoorOpen.Chance {
+	for _, sensorConf := range conf.Sensors {
 
-			// if the door opens then calculate the amount of time it will remain open
-			randomTimeOpen := rand.Int63n(s.conf.Sensors.DoorOpen.MaxTime-s.conf.Sensors.DoorOpen.MinTime) + s.conf.Sensors.DoorOpen.MinTime
+		if _, ok := state.byName[sensorConf.Name]; ok {
+			return nil, fmt.Errorf("ERROR: [SIMULATE] duplicated sensor name %s", sensorConf.Name)
+		}
 
-			if s.conf.Options.debug {
-				log.Printf("INFO: [SIMULATE] door will be open for %d milliseconds", randomTimeOpen)
+		// an unchanged sensor keeps its state, like an open door or
+		// a temperature, only new or changed sensors are created
+		sensor, ok := s.byName[sensorConf.Name]
+		if !ok || !sameJSON(s.sensorConfs[sensorConf.Name], sensorConf) {
+			var err error
+			if sensor, err = NewSensor(s, sensorConf); err != nil {
+				return nil, err
 			}
+		}
 
-			calculatedClose := virtualTime.Add(time.Duration(randomTimeOpen) * time.Millisecond)
+		state.sensors = append(state.sensors, sensor)
+		state.byName[sensorConf.Name] = sensor
+		state.sensorConfs[sensorConf.Name] = sensorConf
+	}
 
-			s.currentStatus.Door.CloseTime = &calculatedClose
-			// set the door to open
-			s.currentStatus.Door.IsOpen = true
+	state.scenario = NewScenario(conf, state.random)
+	if err := state.scenario.Read(); err != nil {
+		return nil, err
+	}
 
+	for _, f := range state.scenario.faults {
+		if _, ok := state.byName[f.conf.Sensor]; !ok {
+			return nil, fmt.Errorf("ERROR: [SCENARIO] fault %s references unknown sensor %s", f.conf.Type, f.conf.Sensor)
 		}
-	} else if s.currentStatus.Door.IsOpen && s.currentStatus.Door.CloseTime.Sub(virtualTime) < 0 {
+	}
 
-		// if the door is open and it's time to close the door
+	return state, nil
+}
 
-		// set the open time to nil
-		s.currentStatus.Door.OpenTime = nil
+// apply replaces the sensors and scenario of the simulation
+// with the ones built by prepare
+func (s *Simulation) apply(state *simulationState) {
 
-		// if the door is open check if it's time to the door to close
-		// if so close the door
-		s.currentStatus.Door.IsOpen = false
+	// lock the simulation so a running clock
+	// doesn't simulate while the sensors change
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-		// set the time the metric is being closed
-		s.currentStatus.Door.CloseTime = &virtualTime
-		// set the open time to zero
-		s.currentStatus.Door.OpenTime = nil
+	if state.random != s.random {
+		log.Printf("INFO: [SIMULATE] using random seed %d", state.randomSeed)
 	}
 
+	s.random = state.random
+	s.seed = state.seed
+	s.sensors = state.sensors
+	s.byName = state.byName
+	s.sensorConfs = state.sensorConfs
+	s.scenario = state.scenario
 }
 
-func (s *Simulation) temperature(virtualTime time.Time) {
+// Sensor returns the sensor with the given name or nil if it doesn't exist
+func (s *Simulation) Sensor(name string) Sensor {
 
-	// calculate temperature if door is open or temperature is != normal
-	if s.currentStatus.Door.IsOpen {
+	return s.byName[name]
+}
 
-		// if the door is open we must increase the temperature until it's maximum
-		s.currentStatus.Temperature.CurrentValue += s.conf.Sensors.Temperature.Increase
-		if s.currentStatus.Temperature.CurrentValue > s.conf.Sensors.Temperature.Max {
+// Since returns the virtual time passed since the first simulation
+func (s *Simulation) Since(virtualTime time.Time) time.Duration {
 
-			s.currentStatus.Temperature.CurrentValue = s.conf.Sensors.Temperature.Max
-		}
+	if s.startTime == nil {
+		return 0
+	}
+
+	return virtualTime.Sub(*s.startTime)
+}
 
-	} else if s.currentStatus.Temperature.CurrentValue > s.conf.Sensors.Temperature.Normal {
+// Simulate runs a sensor simulation and store the results in the DataList object,
+// elapsed is the virtual time passed since the previous simulation
+func (s *Simulation) Simulate(virtualTime time.Time, elapsed time.Duration) {
 
-		// if door is closed and the current temperature is higher that the
-		// normal temperature we need to decrease the temperature until it
-		// reaches the normal temperature
-		s.currentStatus.Temperature.CurrentValue -= s.conf.Sensors.Temperature.Decrease
-		if s.currentStatus.Temperature.CurrentValue < s.conf.Sensors.Temperature.Normal {
+	s.mu.Lock()
 
-			s.currentStatus.Temperature.CurrentValue = s.conf.Sensors.Temperature.Normal
-		}
+	// the simulation starts at the first simulated virtual time
+	if s.startTime == nil {
+		start := virtualTime
+		s.startTime = &start
+	}
+
+	since := s.Since(virtualTime)
+	s.simulating = virtualTime
+
+	// sensors are simulated in the configuration order
+	// so sensors depending on others must be declared after them
+	item := make(Sensors, len(s.sensors))
+	for _, sensor := range s.sensors {
+
+		sensor.Simulate(virtualTime, elapsed)
+
+		// faults are applied on top of the sensor reading
+		item[sensor.Name()] = s.scenario.Apply(sensor.Name(), sensor.Reading(), virtualTime, since)
 	}
 
+	s.last = item
+	s.lastTime = &virtualTime
+
+	s.mu.Unlock()
+
+	s.statusList.Append(&item, virtualTime)
 }
 
-func (s *Simulation) humidity(virtualTime time.Time) {
+// Status returns the last simulated readings and their virtual time
+func (s *Simulation) Status() (Sensors, *time.Time) {
 
-	// calculate humidity if door is open or humidity is != normal
-	if s.currentStatus.Door.IsOpen {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-		// if the door is open we must increase the humidity until it's maximum
-		s.currentStatus.Humidity.CurrentValue += s.conf.Sensors.Humidity.Increase
-		if s.currentStatus.Humidity.CurrentValue > s.conf.Sensors.Humidity.Max {
+	return s.last, s.lastTime
+}
 
-			s.currentStatus.Humidity.CurrentValue = s.conf.Sensors.Humidity.Max
-		}
+// SetSetpoint changes the setpoint of the named sensor
+func (s *Simulation) SetSetpoint(name string, value float64) error {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	} else if s.currentStatus.Humidity.CurrentValue > s.conf.Sensors.Humidity.Normal {
+	sensor, ok := s.Sensor(name).(SetpointSetter)
+	if !ok {
+		return fmt.Errorf("ERROR: [SIMULATE] sensor %s doesn't exist or has no setpoint", name)
+	}
+
+	return sensor.SetSetpoint(value)
+}
 
-		// if door is closed and the current humidity is higher that the
-		// normal humidity we need to decrease the humidity until it
-		// reaches the normal humidity
-		s.currentStatus.Humidity.CurrentValue -= s.conf.Sensors.Humidity.Decrease
-		if s.currentStatus.Humidity.CurrentValue < s.conf.Sensors.Humidity.Normal {
+// OpenDoor forces the named door sensor open for the given duration
+func (s *Simulation) OpenDoor(name string, duration time.Duration) error {
 
-			s.currentStatus.Humidity.CurrentValue = s.conf.Sensors.Humidity.Normal
-		}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	door, ok := s.Sensor(name).(DoorOpener)
+	if !ok {
+		return fmt.Errorf("ERROR: [SIMULATE] sensor %s doesn't exist or isn't a door", name)
+	}
+
+	door.ForceOpen(duration)
+
+	return nil
+}
+
+// isDoorOpen returns true if the named door sensor exists and is open,
+// a flapping door is open or closed as the fault reports it
+func (s *Simulation) isDoorOpen(name string) bool {
+
+	door, ok := s.Sensor(name).(DoorState)
+	if !ok {
+		return false
+	}
+
+	if isOpen, flapping := s.scenario.FlappingDoor(name, s.Since(s.simulating)); flapping {
+		return isOpen
+	}
+
+	return door.IsOpen()
+}
+
+// defrost returns the named defrost sensor if it exists and is defrosting
+func (s *Simulation) defrost(name string) DefrostState {
+
+	defrost, ok := s.Sensor(name).(DefrostState)
+	if !ok || !defrost.IsDefrosting() {
+		return nil
 	}
 
+	return defrost
+}
+
+// hasCompressorFailure returns true if a compressor failure
+// fault is active for the named sensor
+func (s *Simulation) hasCompressorFailure(name string, virtualTime time.Time) bool {
+
+	return s.scenario.IsActive(name, faultCompressorFailure, s.Since(virtualTime))
 }
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func doorConf(name string, maxTime int) SensorConf {
+
+	settings, _ := json.Marshal(map[string]int{"minTime": 1, "maxTime": maxTime})
+
+	return SensorConf{Name: name, Type: "door", Settings: settings}
+}
+
+func TestSimulationPrepare(t *testing.T) {
+
+	seed := int64(1)
+
+	tests := []struct {
+		name        string
+		sensors     SensorsConf
+		scenario    string
+		wantErr     bool
+		wantKept    []string
+		wantCreated []string
+	}{
+		{"unchanged", SensorsConf{doorConf("door1", 10), doorConf("door2", 10)}, "", false, []string{"door1", "door2"}, nil},
+		{"changed sensor", SensorsConf{doorConf("door1", 20), doorConf("door2", 10)}, "", false, []string{"door2"}, []string{"door1"}},
+		{"new sensor", SensorsConf{doorConf("door1", 10), doorConf("door3", 10)}, "", false, []string{"door1"}, []string{"door3"}},
+		{"invalid sensor", SensorsConf{doorConf("door1", 0)}, "", true, nil, nil},
+		{"duplicated sensor", SensorsConf{doorConf("door1", 10), doorConf("door1", 10)}, "", true, nil, nil},
+		{"missing scenario", SensorsConf{doorConf("door1", 10)}, "missing.json", true, nil, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			conf := &Configuration{ID: "device", Options: &Options{}, Sensors: SensorsConf{doorConf("door1", 10), doorConf("door2", 10)}}
+			conf.Clock.Seed = &seed
+
+			simulation := NewSimulation(NewLiveConfiguration(conf), nil)
+			if err := simulation.Load(); err != nil {
+				t.Fatalf("load failed: %s", err.Error())
+			}
+			loaded := simulation.byName
+
+			patched := *conf
+			patched.Sensors = tt.sensors
+			patched.Scenario = tt.scenario
+
+			state, err := simulation.prepare(&patched)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %t", err, tt.wantErr)
+			}
+
+			// preparing never changes the running simulation
+			if len(simulation.byName) != 2 || simulation.byName["door1"] != loaded["door1"] || simulation.byName["door2"] != loaded["door2"] {
+				t.Fatalf("the simulation sensors changed before the configuration was applied")
+			}
+			if err != nil {
+				return
+			}
+
+			simulation.apply(state)
+
+			if len(simulation.sensors) != len(tt.sensors) {
+				t.Errorf("simulation has %d sensors, want %d", len(simulation.sensors), len(tt.sensors))
+			}
+			for _, name := range tt.wantKept {
+				if simulation.Sensor(name) != loaded[name] {
+					t.Errorf("sensor %s was created again, want it kept", name)
+				}
+			}
+			for _, name := range tt.wantCreated {
+				if simulation.Sensor(name) == nil || simulation.Sensor(name) == loaded[name] {
+					t.Errorf("sensor %s wasn't created", name)
+				}
+			}
+			if simulation.random != state.random || state.random == nil {
+				t.Errorf("the random source of an unchanged seed was replaced")
+			}
+		})
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"log"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -9,21 +10,21 @@ import (
 )
 
 type VirtualClock struct {
-	conf          *Configuration
+	conf          *LiveConfiguration
 	virtualTime   time.Time
 	isStarted     bool
-	stopRequested bool
+	stopRequested atomic.Bool
 	simulation    *Simulation
 	finished      chan bool
 }
 
-func NewVirtualClock(conf *Configuration, simulation *Simulation) *VirtualClock {
+func NewVirtualClock(conf *LiveConfiguration, simulation *Simulation) *VirtualClock {
 
 	vc := &VirtualClock{}
 
 	vc.conf = conf
 	vc.isStarted = false
-	vc.stopRequested = false
+	vc.stopRequested.Store(false)
 	vc.simulation = simulation
 
 	return vc
@@ -43,24 +44,22 @@ func (vc *VirtualClock) Start() error {
 
 		log.Println("INFO: [VIRTUAL CLOCK] virtual clock started")
 
-		vc.virtualTime = time.Now()
+		vc.virtualTime = vc.startTime()
 
-		for !vc.stopRequested {
+		for !vc.stopRequested.Load() {
 
-			if sig := wait_signals.SleepWait(time.Duration(vc.conf.Clock.Interval)*time.Millisecond, syscall.SIGINT, syscall.SIGTERM); sig != nil {
+			if sig := wait_signals.SleepWait(time.Duration(vc.conf.Get().Clock.Interval)*time.Millisecond, syscall.SIGINT, syscall.SIGTERM); sig != nil {
 				break
 			}
 
-			vc.virtualTime = vc.virtualTime.Add(time.Duration(vc.conf.Clock.Interval*vc.conf.Clock.Multiplier) * time.Millisecond)
-			vc.simulation.Simulate(vc.virtualTime)
-
+			vc.tick()
 		}
 
-		if vc.conf.Options.debug {
+		if vc.conf.Get().Options.debug {
 			log.Println("INFO: [VIRTUAL CLOCK] virtual clock requested to stop")
 		}
 		vc.isStarted = false
-		vc.stopRequested = false
+		vc.stopRequested.Store(false)
 
 		// set the channel so the Stop function can stop waiting
 		// for loop termination
@@ -71,15 +70,58 @@ func (vc *VirtualClock) Start() error {
 
 }
 
+// Run runs the simulation from the start virtual time until the
+// end virtual time as fast as possible without real time sleeping
+func (vc *VirtualClock) Run(start time.Time, end time.Time) {
+
+	vc.virtualTime = start
+
+	for !vc.stopRequested.Load() && vc.virtualTime.Before(end) {
+
+		vc.tick()
+	}
+
+	vc.stopRequested.Store(false)
+}
+
+// RequestStop requests a running clock to stop without waiting for it
+func (vc *VirtualClock) RequestStop() {
+
+	vc.stopRequested.Store(true)
+}
+
+// tick advances the virtual time one interval and runs the simulation
+func (vc *VirtualClock) tick() {
+
+	conf := vc.conf.Get()
+
+	elapsed := time.Duration(conf.Clock.Interval*conf.Clock.Multiplier) * time.Millisecond
+	vc.virtualTime = vc.virtualTime.Add(elapsed)
+	vc.simulation.Simulate(vc.virtualTime, elapsed)
+}
+
+// startTime returns the configured start time or the current time
+func (vc *VirtualClock) startTime() time.Time {
+
+	conf := vc.conf.Get()
+
+	// a configured start time makes the virtual time reproducible
+	if startTime := conf.StartTime(); startTime != nil {
+		return *startTime
+	}
+
+	return time.Now()
+}
+
 func (vc *VirtualClock) Stop() {
 
 	if vc.isStarted {
 
-		if vc.conf.Options.debug {
+		if vc.conf.Get().Options.debug {
 			log.Println("INFO: [VIRTUAL CLOCK] virtual clock stop requested")
 		}
 
-		vc.stopRequested = true
+		vc.stopRequested.Store(true)
 
 		<-vc.finished
 
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingAppender counts the simulated readings and requests
+// the clock to stop from another goroutine after stopAfter readings
+type countingAppender struct {
+	count     atomic.Int64
+	stopAfter int64
+	stop      chan struct{}
+}
+
+func (a *countingAppender) Append(item *Sensors, collectedAt time.Time) {
+
+	if a.count.Add(1) == a.stopAfter {
+		close(a.stop)
+	}
+}
+
+func TestVirtualClockRun(t *testing.T) {
+
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name      string
+		end       time.Time
+		stopAfter int64
+		wantTicks int64
+	}{
+		{"runs until the end", start.Add(10 * time.Second), 0, 10},
+		{"end before start", start.Add(-time.Second), 0, 0},
+		{"stop requested while running", start.Add(24 * time.Hour), 3, 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			conf := &Configuration{ID: "device", Options: &Options{}}
+			conf.Clock.Interval = 1000
+			conf.Clock.Multiplier = 1
+			live := NewLiveConfiguration(conf)
+
+			appender := &countingAppender{stopAfter: tt.stopAfter, stop: make(chan struct{})}
+			simulation := NewSimulation(live, appender)
+			if err := simulation.Load(); err != nil {
+				t.Fatalf("load failed: %s", err.Error())
+			}
+			clock := NewVirtualClock(live, simulation)
+
+			stopped := make(chan struct{})
+			go func() {
+				select {
+				case <-appender.stop:
+					clock.RequestStop()
+				case <-stopped:
+				}
+			}()
+
+			clock.Run(start, tt.end)
+			close(stopped)
+
+			// the stop is requested concurrently so a few
+			// more readings may be simulated before it's seen
+			ticks := appender.count.Load()
+			if ticks < tt.wantTicks || (tt.stopAfter == 0 && ticks != tt.wantTicks) {
+				t.Errorf("simulated %d readings, want %d", ticks, tt.wantTicks)
+			}
+			if tt.stopAfter > 0 && ticks >= int64(24*time.Hour/time.Second) {
+				t.Errorf("the clock ran until the end, want it stopped")
+			}
+		})
+	}
+}
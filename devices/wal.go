@@ -0,0 +1,591 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// WAL is the append-only write-ahead log storing the DataList messages.
+// The log is split in segment files, every record is checksummed so a
+// record torn by a power loss is detected and skipped when reading.
+//
+// Record layout (little endian):
+//
+//	length uint32 | crc32c uint32 | type byte | seq uint64 | payload
+//
+// length and crc32c cover the type, seq and payload bytes. Append records
+// carry a message, head records carry the sequence of the first message
+// not yet removed from the list.
+type WAL struct {
+	dir         string
+	sync        string
+	segmentSize int64
+	segments    []*walSegment
+	file        *os.File
+	size        int64
+	seqs        []uint64
+	next        uint64
+	unsynced    bool
+}
+
+type walSegment struct {
+	id         uint64
+	path       string
+	lastSeq    uint64
+	hasAppends bool
+}
+
+const (
+	walRecordAppend byte = 1
+	walRecordHead   byte = 2
+
+	walHeaderSize         = 8
+	walBodyHeaderSize     = 9
+	walMaxRecordSize      = 16 * 1024 * 1024
+	walSegmentExt         = ".wal"
+	walMigrateExt         = ".migrate"
+	walBackupExt          = ".bak"
+	walDefaultSegmentSize = 4 * 1024 * 1024
+
+	walSyncAlways   = "always"
+	walSyncInterval = "interval"
+	walSyncNever    = "never"
+)
+
+var walCrcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// NewWAL creates a new write-ahead log struct pointer for the given directory
+func NewWAL(dir string, sync string, segmentSize int64) *WAL {
+
+	w := &WAL{}
+
+	w.dir = dir
+	w.sync = sync
+	if w.sync == "" {
+		w.sync = walSyncInterval
+	}
+	w.segmentSize = segmentSize
+	if w.segmentSize <= 0 {
+		w.segmentSize = walDefaultSegmentSize
+	}
+	w.segments = make([]*walSegment, 0)
+	w.seqs = make([]uint64, 0)
+	w.next = 1
+
+	return w
+}
+
+// Dir returns the log directory
+func (w *WAL) Dir() string {
+
+	return w.dir
+}
+
+// IsOpen returns true if the log is open for writing
+func (w *WAL) IsOpen() bool {
+
+	return w.file != nil
+}
+
+// Open recovers the log and returns the messages not yet removed,
+// a new segment is started so torn records are never appended to
+func (w *WAL) Open() ([]*Message, error) {
+
+	if err := w.migrate(); err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(w.dir, os.ModePerm); err != nil {
+		return nil, fmt.Errorf("ERROR: [WAL] failed to create log directory: %s REASON: %s", w.dir, err.Error())
+	}
+
+	segments, err := w.listSegments()
+	if err != nil {
+		return nil, err
+	}
+
+	messages := make([]*Message, 0)
+	seqs := make([]uint64, 0)
+	head := uint64(0)
+	lastSeq := uint64(0)
+
+	for _, segment := range segments {
+
+		data, err := os.ReadFile(segment.path)
+		if err != nil {
+			return nil, fmt.Errorf("ERROR: [WAL] failed to read segment: %s REASON: %s", segment.path, err.Error())
+		}
+
+		valid, err := readWALRecords(data, func(kind byte, seq uint64, payload []byte) error {
+
+			switch kind {
+			case walRecordHead:
+				if seq > head {
+					head = seq
+				}
+			case walRecordAppend:
+				// sequences only grow, anything else is a duplicate
+				if seq <= lastSeq {
+					return nil
+				}
+				msg := &Message{}
+				if err := json.Unmarshal(payload, msg); err != nil {
+					return err
+				}
+				// messages of previous versions have no sequence, they
+				// take the log one so they can be removed by sequence
+				if msg.Sequence == 0 {
+					msg.Sequence = seq
+				}
+				messages = append(messages, msg)
+				seqs = append(seqs, seq)
+				lastSeq = seq
+				segment.lastSeq = seq
+				segment.hasAppends = true
+			}
+
+			return nil
+		})
+
+		if err != nil {
+			log.Printf("WARNING: [WAL] skipping %d bytes of segment %s REASON: %s", len(data)-valid, segment.path, err.Error())
+		}
+	}
+
+	// keep only the messages after the last head
+	first := sort.Search(len(seqs), func(i int) bool { return seqs[i] >= head })
+
+	w.segments = segments
+	w.seqs = seqs[first:]
+	w.next = lastSeq + 1
+	if head > w.next {
+		w.next = head
+	}
+
+	if err := w.roll(); err != nil {
+		return nil, err
+	}
+
+	w.compact()
+
+	return messages[first:], nil
+}
+
+// Append writes a message to the log
+func (w *WAL) Append(msg *Message) error {
+
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	// the log sequence never falls behind the message sequence so
+	// the message sequences are recovered even without messages left
+	seq := w.next
+	if msg.Sequence > seq {
+		seq = msg.Sequence
+	}
+
+	if err := w.write(walRecordAppend, seq, payload); err != nil {
+		return err
+	}
+
+	w.next = seq + 1
+	w.seqs = append(w.seqs, seq)
+
+	active := w.segments[len(w.segments)-1]
+	active.lastSeq = seq
+	active.hasAppends = true
+
+	if w.size >= w.segmentSize {
+		return w.roll()
+	}
+
+	return nil
+}
+
+// LastSequence returns the last sequence written to the log
+func (w *WAL) LastSequence() uint64 {
+
+	return w.next - 1
+}
+
+// Remove records the removal of the n oldest messages
+// and deletes the segments holding only removed messages
+func (w *WAL) Remove(n int) error {
+
+	if n > len(w.seqs) {
+		n = len(w.seqs)
+	}
+
+	w.seqs = w.seqs[n:]
+
+	if err := w.write(walRecordHead, w.head(), nil); err != nil {
+		return err
+	}
+
+	w.compact()
+
+	return nil
+}
+
+// Rewrite replaces the log content with the given messages. The messages
+// are appended before the head moves past the previous ones so a crash
+// while rewriting duplicates messages instead of losing them.
+func (w *WAL) Rewrite(messages []*Message) error {
+
+	if err := w.roll(); err != nil {
+		return err
+	}
+
+	// the previous messages stay in the log until the new head
+	// is written, segments rolled meanwhile keep the previous head
+	first := w.next
+	previous := len(w.seqs)
+
+	for _, msg := range messages {
+		if err := w.Append(msg); err != nil {
+			return err
+		}
+	}
+
+	w.seqs = w.seqs[previous:]
+
+	if err := w.write(walRecordHead, first, nil); err != nil {
+		return err
+	}
+
+	if err := w.Sync(); err != nil {
+		return err
+	}
+
+	w.compact()
+
+	return nil
+}
+
+// Sync flushes the log to the disk if there are unsynced records
+func (w *WAL) Sync() error {
+
+	if w.file == nil || !w.unsynced || w.sync == walSyncNever {
+		return nil
+	}
+
+	if err := w.file.Sync(); err != nil {
+		return fmt.Errorf("ERROR: [WAL] failed to sync segment: %s REASON: %s", w.file.Name(), err.Error())
+	}
+
+	w.unsynced = false
+
+	return nil
+}
+
+// Close syncs and closes the active segment
+func (w *WAL) Close() error {
+
+	if w.file == nil {
+		return nil
+	}
+
+	err := w.Sync()
+	if closeErr := w.file.Close(); err == nil {
+		err = closeErr
+	}
+	w.file = nil
+
+	return err
+}
+
+// Destroy closes the log and deletes its segments, the directory
+// is only removed if nothing else is stored in it
+func (w *WAL) Destroy() error {
+
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	for _, segment := range w.segments {
+		if err := os.Remove(segment.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	w.segments = w.segments[:0]
+
+	os.Remove(w.dir)
+
+	return nil
+}
+
+// head returns the sequence of the first message not yet removed
+func (w *WAL) head() uint64 {
+
+	if len(w.seqs) == 0 {
+		return w.next
+	}
+
+	return w.seqs[0]
+}
+
+// write writes a single record to the active segment
+func (w *WAL) write(kind byte, seq uint64, payload []byte) error {
+
+	if w.file == nil {
+		return fmt.Errorf("ERROR: [WAL] log %s isn't open", w.dir)
+	}
+
+	record := encodeWALRecord(kind, seq, payload)
+
+	if _, err := w.file.Write(record); err != nil {
+		return fmt.Errorf("ERROR: [WAL] failed to write segment: %s REASON: %s", w.file.Name(), err.Error())
+	}
+
+	w.size += int64(len(record))
+	w.unsynced = true
+
+	if w.sync == walSyncAlways {
+		return w.Sync()
+	}
+
+	return nil
+}
+
+// roll closes the active segment and starts a new one
+// beginning with the current head
+func (w *WAL) roll() error {
+
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	id := uint64(1)
+	if len(w.segments) > 0 {
+		id = w.segments[len(w.segments)-1].id + 1
+	}
+
+	segment := &walSegment{
+		id:   id,
+		path: filepath.Join(w.dir, fmt.Sprintf("%020d%s", id, walSegmentExt)),
+	}
+
+	file, err := os.OpenFile(segment.path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, os.ModePerm)
+	if err != nil {
+		return fmt.Errorf("ERROR: [WAL] failed to create segment: %s REASON: %s", segment.path, err.Error())
+	}
+
+	w.file = file
+	w.size = 0
+	w.segments = append(w.segments, segment)
+
+	if err := w.write(walRecordHead, w.head(), nil); err != nil {
+		return err
+	}
+
+	// the new segment file must survive a power loss
+	if w.sync != walSyncNever {
+		if err := w.Sync(); err != nil {
+			return err
+		}
+		syncDir(w.dir)
+	}
+
+	return nil
+}
+
+// compact deletes the closed segments holding only removed messages
+func (w *WAL) compact() {
+
+	head := w.head()
+
+	kept := make([]*walSegment, 0, len(w.segments))
+	for i, segment := range w.segments {
+
+		isActive := i == len(w.segments)-1
+		if !isActive && (!segment.hasAppends || segment.lastSeq < head) {
+			if err := os.Remove(segment.path); err != nil && !os.IsNotExist(err) {
+				log.Printf("WARNING: [WAL] failed to delete segment %s REASON: %s", segment.path, err.Error())
+				kept = append(kept, segment)
+			}
+			continue
+		}
+
+		kept = append(kept, segment)
+	}
+
+	w.segments = kept
+}
+
+// listSegments returns the log segments sorted by id
+func (w *WAL) listSegments() ([]*walSegment, error) {
+
+	entries, err := os.ReadDir(w.dir)
+	if err != nil {
+		return nil, fmt.Errorf("ERROR: [WAL] failed to read log directory: %s REASON: %s", w.dir, err.Error())
+	}
+
+	segments := make([]*walSegment, 0)
+	for _, entry := range entries {
+
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), walSegmentExt) {
+			continue
+		}
+
+		id, err := strconv.ParseUint(strings.TrimSuffix(entry.Name(), walSegmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+
+		segments = append(segments, &walSegment{id: id, path: filepath.Join(w.dir, entry.Name())})
+	}
+
+	sort.Slice(segments, func(i, j int) bool { return segments[i].id < segments[j].id })
+
+	return segments, nil
+}
+
+// migrate converts a JSON data file written by previous versions
+// into a log stored in a directory with the same path
+func (w *WAL) migrate() error {
+
+	// a crash during a previous migration is finished first
+	if err := w.finishMigration(); err != nil {
+		return err
+	}
+
+	info, err := os.Stat(w.dir)
+	if err != nil || info.IsDir() {
+		return nil
+	}
+
+	log.Printf("INFO: [WAL] migrating JSON data file %s to a write-ahead log", w.dir)
+
+	data, err := os.ReadFile(w.dir)
+	if err != nil {
+		return fmt.Errorf("ERROR: [WAL] failed to read data file: %s REASON: %s", w.dir, err.Error())
+	}
+
+	messages := make([]*Message, 0)
+	if err := json.Unmarshal(data, &messages); err != nil {
+		return fmt.Errorf("ERROR: [WAL] failed to parse data file: %s REASON: %s", w.dir, err.Error())
+	}
+
+	// write the log aside so a crash while migrating
+	// keeps the data file untouched
+	tmp := NewWAL(w.dir+walMigrateExt, walSyncInterval, w.segmentSize)
+	if err := os.RemoveAll(tmp.dir); err != nil {
+		return err
+	}
+
+	if _, err := tmp.Open(); err != nil {
+		return err
+	}
+
+	for _, msg := range messages {
+		if err := tmp.Append(msg); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	syncDir(tmp.dir)
+
+	// the data file is only moved aside once the log is complete,
+	// its backup tells the next open to finish a crashed migration
+	if err := os.Rename(w.dir, w.dir+walBackupExt); err != nil {
+		return fmt.Errorf("ERROR: [WAL] failed to move data file: %s REASON: %s", w.dir, err.Error())
+	}
+	syncDir(filepath.Dir(w.dir))
+
+	return w.finishMigration()
+}
+
+// finishMigration moves a migrated log to the data path and deletes
+// the data file backup, the backup only exists once the log is complete
+func (w *WAL) finishMigration() error {
+
+	backup := w.dir + walBackupExt
+	if _, err := os.Stat(backup); err != nil {
+		return nil
+	}
+
+	if _, err := os.Stat(w.dir); os.IsNotExist(err) {
+		if err := os.Rename(w.dir+walMigrateExt, w.dir); err != nil {
+			return fmt.Errorf("ERROR: [WAL] failed to move migrated log: %s REASON: %s", w.dir, err.Error())
+		}
+		syncDir(filepath.Dir(w.dir))
+	}
+
+	if err := os.Remove(backup); err != nil {
+		log.Printf("WARNING: [WAL] failed to delete data file backup %s REASON: %s", backup, err.Error())
+	}
+
+	return nil
+}
+
+// encodeWALRecord returns the bytes of a log record
+func encodeWALRecord(kind byte, seq uint64, payload []byte) []byte {
+
+	record := make([]byte, walHeaderSize+walBodyHeaderSize+len(payload))
+
+	body := record[walHeaderSize:]
+	body[0] = kind
+	binary.LittleEndian.PutUint64(body[1:], seq)
+	copy(body[walBodyHeaderSize:], payload)
+
+	binary.LittleEndian.PutUint32(record[0:], uint32(len(body)))
+	binary.LittleEndian.PutUint32(record[4:], crc32.Checksum(body, walCrcTable))
+
+	return record
+}
+
+// readWALRecords calls fn for every valid record of a segment and returns
+// the number of valid bytes read, reading stops at the first torn record
+func readWALRecords(data []byte, fn func(kind byte, seq uint64, payload []byte) error) (int, error) {
+
+	offset := 0
+	for offset < len(data) {
+
+		if len(data)-offset < walHeaderSize {
+			return offset, fmt.Errorf("truncated record header at offset %d", offset)
+		}
+
+		length := int(binary.LittleEndian.Uint32(data[offset:]))
+		checksum := binary.LittleEndian.Uint32(data[offset+4:])
+
+		if length < walBodyHeaderSize || length > walMaxRecordSize || length > len(data)-offset-walHeaderSize {
+			return offset, fmt.Errorf("invalid record length %d at offset %d", length, offset)
+		}
+
+		body := data[offset+walHeaderSize : offset+walHeaderSize+length]
+		if crc32.Checksum(body, walCrcTable) != checksum {
+			return offset, fmt.Errorf("record checksum mismatch at offset %d", offset)
+		}
+
+		if err := fn(body[0], binary.LittleEndian.Uint64(body[1:]), body[walBodyHeaderSize:]); err != nil {
+			return offset, fmt.Errorf("invalid record at offset %d: %s", offset, err.Error())
+		}
+
+		offset += walHeaderSize + length
+	}
+
+	return offset, nil
+}
+
+// syncDir flushes a directory entry changes to the disk
+func syncDir(dir string) {
+
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+}
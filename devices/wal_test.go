@@ -0,0 +1,268 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWALRecords(t *testing.T) {
+
+	first := encodeWALRecord(walRecordAppend, 1, []byte(`{"deviceId":"a"}`))
+	second := encodeWALRecord(walRecordHead, 2, nil)
+	valid := append(append([]byte{}, first...), second...)
+
+	corrupted := append([]byte{}, valid...)
+	corrupted[len(first)+walHeaderSize+1] ^= 0xFF
+
+	tests := []struct {
+		name      string
+		data      []byte
+		wantValid int
+		wantSeqs  []uint64
+		wantErr   bool
+	}{
+		{"empty", nil, 0, nil, false},
+		{"valid records", valid, len(valid), []uint64{1, 2}, false},
+		{"torn header", valid[:len(first)+3], len(first), []uint64{1}, true},
+		{"torn body", valid[:len(valid)-1], len(first), []uint64{1}, true},
+		{"checksum mismatch", corrupted, len(first), []uint64{1}, true},
+		{"invalid length", append(append([]byte{}, first...), 0xFF, 0xFF, 0xFF, 0xFF, 0, 0, 0, 0), len(first), []uint64{1}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			seqs := make([]uint64, 0)
+			read, err := readWALRecords(tt.data, func(kind byte, seq uint64, payload []byte) error {
+				seqs = append(seqs, seq)
+				return nil
+			})
+
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %t", err, tt.wantErr)
+			}
+			if read != tt.wantValid {
+				t.Errorf("read %d valid bytes, want %d", read, tt.wantValid)
+			}
+			if len(seqs) != len(tt.wantSeqs) {
+				t.Fatalf("read sequences %v, want %v", seqs, tt.wantSeqs)
+			}
+			for i := range seqs {
+				if seqs[i] != tt.wantSeqs[i] {
+					t.Errorf("read sequences %v, want %v", seqs, tt.wantSeqs)
+				}
+			}
+		})
+	}
+}
+
+func TestWALRecovery(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		appends  int
+		removes  int
+		wantSeqs []uint64
+	}{
+		{"no messages", 0, 0, nil},
+		{"all kept", 3, 0, []uint64{1, 2, 3}},
+		{"some removed", 5, 2, []uint64{3, 4, 5}},
+		{"all removed", 4, 4, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			dir := filepath.Join(t.TempDir(), "data")
+
+			w := NewWAL(dir, walSyncNever, 0)
+			if _, err := w.Open(); err != nil {
+				t.Fatalf("open failed: %s", err.Error())
+			}
+			for i := 0; i < tt.appends; i++ {
+				if err := w.Append(&Message{DeviceID: "device"}); err != nil {
+					t.Fatalf("append failed: %s", err.Error())
+				}
+			}
+			if tt.removes > 0 {
+				if err := w.Remove(tt.removes); err != nil {
+					t.Fatalf("remove failed: %s", err.Error())
+				}
+			}
+			w.Close()
+
+			reopened := NewWAL(dir, walSyncNever, 0)
+			messages, err := reopened.Open()
+			if err != nil {
+				t.Fatalf("reopen failed: %s", err.Error())
+			}
+			defer reopened.Close()
+
+			if len(messages) != len(tt.wantSeqs) {
+				t.Fatalf("recovered %d messages, want %d", len(messages), len(tt.wantSeqs))
+			}
+			for i, seq := range reopened.seqs {
+				if seq != tt.wantSeqs[i] {
+					t.Errorf("recovered sequences %v, want %v", reopened.seqs, tt.wantSeqs)
+				}
+			}
+			if reopened.LastSequence() != uint64(tt.appends) {
+				t.Errorf("last sequence is %d, want %d", reopened.LastSequence(), tt.appends)
+			}
+		})
+	}
+}
+
+func TestWALCompaction(t *testing.T) {
+
+	tests := []struct {
+		name         string
+		appends      int
+		removes      int
+		wantSegments int
+	}{
+		// every append fills a segment so each message gets its own segment
+		{"nothing removed", 4, 0, 5},
+		{"oldest removed", 4, 2, 3},
+		{"all removed", 4, 4, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			dir := filepath.Join(t.TempDir(), "data")
+
+			w := NewWAL(dir, walSyncNever, 1)
+			if _, err := w.Open(); err != nil {
+				t.Fatalf("open failed: %s", err.Error())
+			}
+			defer w.Close()
+
+			for i := 0; i < tt.appends; i++ {
+				if err := w.Append(&Message{DeviceID: "device"}); err != nil {
+					t.Fatalf("append failed: %s", err.Error())
+				}
+			}
+			if err := w.Remove(tt.removes); err != nil {
+				t.Fatalf("remove failed: %s", err.Error())
+			}
+
+			segments, err := w.listSegments()
+			if err != nil {
+				t.Fatalf("list segments failed: %s", err.Error())
+			}
+			if len(segments) != tt.wantSegments {
+				t.Errorf("%d segments on disk, want %d", len(segments), tt.wantSegments)
+			}
+		})
+	}
+}
+
+func TestWALMigrate(t *testing.T) {
+
+	tests := []struct {
+		name  string
+		setup func(t *testing.T, dir string)
+	}{
+		{
+			name: "data file",
+			setup: func(t *testing.T, dir string) {
+				writeDataFile(t, dir)
+			},
+		},
+		{
+			name: "crash while writing the log",
+			setup: func(t *testing.T, dir string) {
+				writeDataFile(t, dir)
+				if err := os.MkdirAll(dir+walMigrateExt, os.ModePerm); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(filepath.Join(dir+walMigrateExt, "00000000000000000001.wal"), []byte{1, 2, 3}, os.ModePerm); err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+		{
+			name: "crash after moving the data file",
+			setup: func(t *testing.T, dir string) {
+				writeDataFile(t, dir)
+				migrateUntilBackup(t, dir)
+				if err := os.Rename(dir, dir+walBackupExt); err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+		{
+			name: "crash after moving the log",
+			setup: func(t *testing.T, dir string) {
+				writeDataFile(t, dir)
+				migrateUntilBackup(t, dir)
+				if err := os.Rename(dir, dir+walBackupExt); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.Rename(dir+walMigrateExt, dir); err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			dir := filepath.Join(t.TempDir(), "data")
+			tt.setup(t, dir)
+
+			w := NewWAL(dir, walSyncNever, 0)
+			messages, err := w.Open()
+			if err != nil {
+				t.Fatalf("open failed: %s", err.Error())
+			}
+			defer w.Close()
+
+			if len(messages) != 2 || messages[0].Sequence != 1 || messages[1].Sequence != 2 {
+				t.Fatalf("recovered %d messages, want the 2 migrated messages", len(messages))
+			}
+			for _, leftover := range []string{dir + walMigrateExt, dir + walBackupExt} {
+				if _, err := os.Stat(leftover); !os.IsNotExist(err) {
+					t.Errorf("%s was left behind", leftover)
+				}
+			}
+		})
+	}
+}
+
+// writeDataFile writes a JSON data file of previous versions
+func writeDataFile(t *testing.T, path string) {
+
+	data, err := json.Marshal([]*Message{{DeviceID: "device", Sequence: 1}, {DeviceID: "device", Sequence: 2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(path, data, os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// migrateUntilBackup writes the migrated log of a data file
+// without touching the data file
+func migrateUntilBackup(t *testing.T, path string) {
+
+	tmp := NewWAL(path+walMigrateExt, walSyncNever, 0)
+	if _, err := tmp.Open(); err != nil {
+		t.Fatal(err)
+	}
+
+	for seq := uint64(1); seq <= 2; seq++ {
+		if err := tmp.Append(&Message{DeviceID: "device", Sequence: seq}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := tmp.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
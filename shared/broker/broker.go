@@ -0,0 +1,137 @@
+package broker
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// Endpoint describes how to reach the MQTT Broker
+type Endpoint struct {
+	Transport string
+	Host      string
+	Port      int
+	Path      string
+	Headers   map[string]string
+	Proxy     string
+	Tls       bool
+}
+
+const (
+	TransportTCP = "tcp"
+	TransportSSL = "ssl"
+	TransportWS  = "ws"
+	TransportWSS = "wss"
+
+	defaultWebsocketPath = "/mqtt"
+)
+
+// Scheme returns the transport used to connect. Without a transport set
+// it's tcp or ssl if TLS is enabled, enabling TLS also upgrades tcp to ssl
+// and ws to wss.
+func (e *Endpoint) Scheme() (string, error) {
+
+	transport := strings.ToLower(e.Transport)
+
+	switch transport {
+	case "", TransportTCP:
+		if e.Tls {
+			return TransportSSL, nil
+		}
+		return TransportTCP, nil
+	case TransportWS:
+		if e.Tls {
+			return TransportWSS, nil
+		}
+		return TransportWS, nil
+	case TransportSSL, TransportWSS:
+		return transport, nil
+	}
+
+	return "", fmt.Errorf("ERROR: [BROKER] invalid transport %s, available transports: [tcp ssl ws wss]", e.Transport)
+}
+
+// IsSecure returns true if the transport uses TLS
+func (e *Endpoint) IsSecure() bool {
+
+	scheme, err := e.Scheme()
+
+	return err == nil && (scheme == TransportSSL || scheme == TransportWSS)
+}
+
+// IsWebsocket returns true if the transport uses WebSockets
+func (e *Endpoint) IsWebsocket() bool {
+
+	scheme, err := e.Scheme()
+
+	return err == nil && (scheme == TransportWS || scheme == TransportWSS)
+}
+
+// URL returns the MQTT Broker url
+func (e *Endpoint) URL() (string, error) {
+
+	scheme, err := e.Scheme()
+	if err != nil {
+		return "", err
+	}
+
+	brokerUrl := url.URL{
+		Scheme: scheme,
+		Host:   net.JoinHostPort(e.Host, strconv.Itoa(e.Port)),
+	}
+
+	if e.IsWebsocket() {
+		brokerUrl.Path = e.Path
+		if brokerUrl.Path == "" {
+			brokerUrl.Path = defaultWebsocketPath
+		}
+		if !strings.HasPrefix(brokerUrl.Path, "/") {
+			brokerUrl.Path = "/" + brokerUrl.Path
+		}
+	}
+
+	return brokerUrl.String(), nil
+}
+
+// Apply adds the MQTT Broker to the client options with the WebSocket
+// headers and proxy if any and returns the broker url. The TLS configuration
+// is set by the caller when the transport is secure.
+func (e *Endpoint) Apply(options *mqtt.ClientOptions) (string, error) {
+
+	brokerUrl, err := e.URL()
+	if err != nil {
+		return "", err
+	}
+
+	options.AddBroker(brokerUrl)
+
+	if !e.IsWebsocket() {
+		return brokerUrl, nil
+	}
+
+	if len(e.Headers) > 0 {
+		headers := http.Header{}
+		for key, value := range e.Headers {
+			headers.Set(key, value)
+		}
+		options.SetHTTPHeaders(headers)
+	}
+
+	// without a proxy set the proxy environment variables are used
+	websocketOptions := &mqtt.WebsocketOptions{}
+	if e.Proxy != "" {
+		proxyUrl, err := url.Parse(e.Proxy)
+		if err != nil {
+			return "", fmt.Errorf("ERROR: [BROKER] invalid proxy url: %s REASON: %s", e.Proxy, err.Error())
+		}
+		websocketOptions.Proxy = http.ProxyURL(proxyUrl)
+	}
+	options.SetWebsocketOptions(websocketOptions)
+
+	return brokerUrl, nil
+}
@@ -0,0 +1,51 @@
+package broker
+
+import (
+	"testing"
+)
+
+func TestEndpointURL(t *testing.T) {
+
+	tests := []struct {
+		name       string
+		endpoint   Endpoint
+		wantScheme string
+		wantURL    string
+		wantErr    bool
+	}{
+		{"default transport", Endpoint{Host: "localhost", Port: 1883}, TransportTCP, "tcp://localhost:1883", false},
+		{"tcp", Endpoint{Transport: "tcp", Host: "localhost", Port: 1883}, TransportTCP, "tcp://localhost:1883", false},
+		{"tcp with tls", Endpoint{Transport: "tcp", Host: "localhost", Port: 8883, Tls: true}, TransportSSL, "ssl://localhost:8883", false},
+		{"ssl", Endpoint{Transport: "ssl", Host: "localhost", Port: 8883}, TransportSSL, "ssl://localhost:8883", false},
+		{"uppercase transport", Endpoint{Transport: "SSL", Host: "localhost", Port: 8883}, TransportSSL, "ssl://localhost:8883", false},
+		{"websocket default path", Endpoint{Transport: "ws", Host: "localhost", Port: 8080}, TransportWS, "ws://localhost:8080/mqtt", false},
+		{"websocket path", Endpoint{Transport: "ws", Host: "localhost", Port: 8080, Path: "/broker"}, TransportWS, "ws://localhost:8080/broker", false},
+		{"websocket path without a slash", Endpoint{Transport: "ws", Host: "localhost", Port: 8080, Path: "broker"}, TransportWS, "ws://localhost:8080/broker", false},
+		{"websocket with tls", Endpoint{Transport: "ws", Host: "localhost", Port: 8081, Tls: true}, TransportWSS, "wss://localhost:8081/mqtt", false},
+		{"wss", Endpoint{Transport: "wss", Host: "localhost", Port: 8081}, TransportWSS, "wss://localhost:8081/mqtt", false},
+		{"path ignored on tcp", Endpoint{Transport: "tcp", Host: "localhost", Port: 1883, Path: "/mqtt"}, TransportTCP, "tcp://localhost:1883", false},
+		{"ipv6 host", Endpoint{Transport: "tcp", Host: "::1", Port: 1883}, TransportTCP, "tcp://[::1]:1883", false},
+		{"invalid transport", Endpoint{Transport: "udp", Host: "localhost", Port: 1883}, "", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			scheme, err := tt.endpoint.Scheme()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("scheme error is %v, want error %t", err, tt.wantErr)
+			}
+			if scheme != tt.wantScheme {
+				t.Errorf("scheme is %q, want %q", scheme, tt.wantScheme)
+			}
+
+			brokerUrl, err := tt.endpoint.URL()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("url error is %v, want error %t", err, tt.wantErr)
+			}
+			if brokerUrl != tt.wantURL {
+				t.Errorf("url is %q, want %q", brokerUrl, tt.wantURL)
+			}
+		})
+	}
+}
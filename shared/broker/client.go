@@ -0,0 +1,131 @@
+package broker
+
+import (
+	"crypto/tls"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Client is an MQTT client independent of the protocol version
+type Client interface {
+	// Connect connects to the MQTT Broker
+	Connect() error
+	// Disconnect disconnects from the MQTT Broker
+	Disconnect()
+	// IsConnectionOpen returns true if the connection is open
+	IsConnectionOpen() bool
+	// Subscribe subscribes a topic filter, the handler receives its messages
+	Subscribe(topic string, qos byte, handler MessageHandler) error
+	// Unsubscribe unsubscribes a topic filter
+	Unsubscribe(topic string) error
+	// Publish publishes a message and waits for its acknowledgement
+	Publish(topic string, payload []byte, options PublishOptions) error
+}
+
+// Message is a message received from the MQTT Broker, the properties
+// are only set by MQTT 5 clients
+type Message struct {
+	Topic           string
+	Payload         []byte
+	ContentType     string
+	ResponseTopic   string
+	CorrelationData []byte
+	UserProperties  map[string]string
+}
+
+// MessageHandler handles the messages received from the MQTT Broker
+type MessageHandler func(msg *Message)
+
+// PublishOptions are the options of a published message, the properties
+// are ignored by MQTT 3 clients
+type PublishOptions struct {
+	Qos             byte
+	Retain          bool
+	MessageExpiry   uint32
+	ContentType     string
+	ResponseTopic   string
+	CorrelationData []byte
+	UserProperties  map[string]string
+}
+
+// ClientOptions are the options used to create a Client
+type ClientOptions struct {
+	Endpoint      *Endpoint
+	ClientID      string
+	Username      string
+	Password      string
+	CleanSession  bool
+	SessionExpiry uint32
+	KeepAlive     time.Duration
+	ConnectWait   time.Duration
+	TLSConfig     *tls.Config
+	// DefaultHandler receives the messages not matching any subscription,
+	// like the ones queued by a persistent session before subscribing again
+	DefaultHandler MessageHandler
+	// OnConnectionLost is called when an open connection is lost
+	OnConnectionLost func(err error)
+}
+
+const (
+	ProtocolV3 = 3
+	ProtocolV5 = 5
+
+	defaultConnectWait = 30 * time.Second
+)
+
+// NewClient creates a Client for the protocol version, 0, 3 and 4 (3.1.1)
+// create an MQTT 3 client and 5 an MQTT 5 client
+func NewClient(version int, options ClientOptions) (Client, error) {
+
+	if options.ConnectWait <= 0 {
+		options.ConnectWait = defaultConnectWait
+	}
+
+	switch version {
+	case 0, ProtocolV3, 4:
+		return newV3Client(options)
+	case ProtocolV5:
+		return newV5Client(options)
+	}
+
+	return nil, fmt.Errorf("ERROR: [BROKER] invalid MQTT protocol version %d, available versions: [3 4 5]", version)
+}
+
+// MatchTopic returns true if a topic matches a subscription topic filter,
+// shared subscriptions ($share/group/filter) match the topics of their filter
+func MatchTopic(filter string, topic string) bool {
+
+	if strings.HasPrefix(filter, "$share/") {
+		parts := strings.SplitN(filter, "/", 3)
+		if len(parts) < 3 {
+			return false
+		}
+		filter = parts[2]
+	}
+
+	filterLevels := strings.Split(filter, "/")
+	topicLevels := strings.Split(topic, "/")
+
+	// topics starting with $ don't match wildcards at the first level
+	if strings.HasPrefix(topic, "$") && (filterLevels[0] == "#" || filterLevels[0] == "+") {
+		return false
+	}
+
+	for i, level := range filterLevels {
+
+		if level == "#" {
+			return true
+		}
+
+		if i >= len(topicLevels) {
+			return false
+		}
+
+		if level != "+" && level != topicLevels[i] {
+			return false
+		}
+	}
+
+	return len(filterLevels) == len(topicLevels)
+}
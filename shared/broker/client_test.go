@@ -0,0 +1,41 @@
+package broker
+
+import (
+	"testing"
+)
+
+func TestMatchTopic(t *testing.T) {
+
+	tests := []struct {
+		name   string
+		filter string
+		topic  string
+		want   bool
+	}{
+		{"exact", "mqttcourse/freezer/1", "mqttcourse/freezer/1", true},
+		{"other topic", "mqttcourse/freezer/1", "mqttcourse/freezer/2", false},
+		{"single level wildcard", "mqttcourse/+/1", "mqttcourse/freezer/1", true},
+		{"single level wildcard at the end", "mqttcourse/freezer/+", "mqttcourse/freezer/1", true},
+		{"single level wildcard and more levels", "mqttcourse/+", "mqttcourse/freezer/1", false},
+		{"multi level wildcard", "mqttcourse/#", "mqttcourse/freezer/1", true},
+		{"multi level wildcard and parent level", "mqttcourse/freezer/#", "mqttcourse/freezer", true},
+		{"multi level wildcard only", "#", "mqttcourse/freezer/1", true},
+		{"fewer topic levels", "mqttcourse/freezer/1", "mqttcourse/freezer", false},
+		{"more topic levels", "mqttcourse/freezer", "mqttcourse/freezer/1", false},
+		{"shared subscription", "$share/consumers/mqttcourse/+/1", "mqttcourse/freezer/1", true},
+		{"shared subscription other topic", "$share/consumers/mqttcourse/freezer/1", "mqttcourse/freezer/2", false},
+		{"shared subscription without a filter", "$share/consumers", "consumers", false},
+		{"system topic and multi level wildcard", "#", "$SYS/broker/uptime", false},
+		{"system topic and single level wildcard", "+/broker/uptime", "$SYS/broker/uptime", false},
+		{"system topic filter", "$SYS/#", "$SYS/broker/uptime", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			if got := MatchTopic(tt.filter, tt.topic); got != tt.want {
+				t.Errorf("filter %s matches topic %s is %t, want %t", tt.filter, tt.topic, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,116 @@
+package broker
+
+import (
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// v3Client is the MQTT 3 Client using the paho v3 library
+type v3Client struct {
+	options ClientOptions
+	client  mqtt.Client
+}
+
+func newV3Client(options ClientOptions) (Client, error) {
+
+	c := &v3Client{}
+
+	c.options = options
+
+	clientOptions := mqtt.NewClientOptions()
+
+	if _, err := options.Endpoint.Apply(clientOptions); err != nil {
+		return nil, err
+	}
+
+	clientOptions.SetClientID(options.ClientID)
+	clientOptions.SetDefaultPublishHandler(c.onDefaultMessage)
+	clientOptions.OnConnectionLost = c.onConnectionLost
+
+	if options.Username != "" {
+		clientOptions.SetUsername(options.Username)
+		clientOptions.SetPassword(options.Password)
+	}
+
+	clientOptions.SetCleanSession(options.CleanSession)
+	clientOptions.SetKeepAlive(options.KeepAlive)
+	clientOptions.SetConnectTimeout(options.ConnectWait)
+
+	// the callers reconnect with their own policies
+	clientOptions.SetAutoReconnect(false)
+	clientOptions.SetConnectRetry(false)
+
+	if options.TLSConfig != nil {
+		clientOptions.SetTLSConfig(options.TLSConfig)
+	}
+
+	c.client = mqtt.NewClient(clientOptions)
+
+	return c, nil
+}
+
+func (c *v3Client) Connect() error {
+
+	token := c.client.Connect()
+	token.Wait()
+
+	return token.Error()
+}
+
+func (c *v3Client) Disconnect() {
+
+	c.client.Disconnect(250)
+}
+
+func (c *v3Client) IsConnectionOpen() bool {
+
+	return c.client.IsConnectionOpen()
+}
+
+func (c *v3Client) Subscribe(topic string, qos byte, handler MessageHandler) error {
+
+	token := c.client.Subscribe(topic, qos, func(client mqtt.Client, message mqtt.Message) {
+		handler(v3Message(message))
+	})
+	token.Wait()
+
+	return token.Error()
+}
+
+func (c *v3Client) Unsubscribe(topic string) error {
+
+	token := c.client.Unsubscribe(topic)
+	token.Wait()
+
+	return token.Error()
+}
+
+func (c *v3Client) Publish(topic string, payload []byte, options PublishOptions) error {
+
+	token := c.client.Publish(topic, options.Qos, options.Retain, payload)
+	token.Wait()
+
+	return token.Error()
+}
+
+func (c *v3Client) onDefaultMessage(client mqtt.Client, message mqtt.Message) {
+
+	if c.options.DefaultHandler != nil {
+		c.options.DefaultHandler(v3Message(message))
+	}
+}
+
+func (c *v3Client) onConnectionLost(client mqtt.Client, err error) {
+
+	if c.options.OnConnectionLost != nil {
+		c.options.OnConnectionLost(err)
+	}
+}
+
+// v3Message converts a paho v3 message
+func v3Message(message mqtt.Message) *Message {
+
+	return &Message{
+		Topic:   message.Topic(),
+		Payload: message.Payload(),
+	}
+}
@@ -0,0 +1,337 @@
+package broker
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+
+	"github.com/eclipse/paho.golang/packets"
+	"github.com/eclipse/paho.golang/paho"
+	"github.com/eclipse/paho.golang/paho/session/state"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// v5Subscription is a topic filter subscribed by the v5Client
+type v5Subscription struct {
+	topic   string
+	handler MessageHandler
+}
+
+// v5Client is the MQTT 5 Client using the paho.golang library. The paho
+// client only handles one connection so a new one is created on each
+// connect reusing the session state, this way the in-flight messages of
+// a persistent session survive reconnects.
+type v5Client struct {
+	options       ClientOptions
+	mu            sync.Mutex
+	client        *paho.Client
+	session       *state.State
+	subscriptions []v5Subscription
+}
+
+func newV5Client(options ClientOptions) (Client, error) {
+
+	c := &v5Client{}
+
+	c.options = options
+	c.session = state.NewInMemory()
+
+	if _, err := options.Endpoint.Scheme(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func (c *v5Client) Connect() error {
+
+	// the previous connection is closed without holding the lock because
+	// closing waits for the message handlers to return
+	c.Disconnect()
+
+	conn, err := c.dial()
+	if err != nil {
+		return err
+	}
+
+	client := paho.NewClient(paho.ClientConfig{
+		ClientID:          c.options.ClientID,
+		Conn:              packets.NewThreadSafeConn(conn),
+		Session:           c.session,
+		OnPublishReceived: []func(paho.PublishReceived) (bool, error){c.onPublishReceived},
+		PacketTimeout:     c.options.ConnectWait,
+		OnClientError:     c.onConnectionLost,
+		OnServerDisconnect: func(d *paho.Disconnect) {
+			c.onConnectionLost(fmt.Errorf("disconnected by the server with reason code %d", d.ReasonCode))
+		},
+	})
+
+	connect := &paho.Connect{
+		ClientID:   c.options.ClientID,
+		KeepAlive:  uint16(c.options.KeepAlive.Seconds()),
+		CleanStart: c.options.CleanSession,
+	}
+
+	if c.options.Username != "" {
+		connect.Username = c.options.Username
+		connect.UsernameFlag = true
+		connect.Password = []byte(c.options.Password)
+		connect.PasswordFlag = true
+	}
+
+	// without a session expiry the broker discards the session on disconnect
+	if c.options.SessionExpiry > 0 {
+		connect.Properties = &paho.ConnectProperties{
+			SessionExpiryInterval: &c.options.SessionExpiry,
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.options.ConnectWait)
+	defer cancel()
+
+	if _, err := client.Connect(ctx, connect); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	c.client = client
+	c.mu.Unlock()
+
+	return nil
+}
+
+func (c *v5Client) Disconnect() {
+
+	c.mu.Lock()
+	client := c.client
+	c.client = nil
+	c.mu.Unlock()
+
+	if client != nil {
+		client.Disconnect(&paho.Disconnect{})
+	}
+}
+
+func (c *v5Client) IsConnectionOpen() bool {
+
+	client := c.current()
+	if client == nil {
+		return false
+	}
+
+	select {
+	case <-client.Done():
+		return false
+	default:
+		return true
+	}
+}
+
+func (c *v5Client) Subscribe(topic string, qos byte, handler MessageHandler) error {
+
+	client := c.current()
+	if client == nil {
+		return fmt.Errorf("not connected")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.options.ConnectWait)
+	defer cancel()
+
+	_, err := client.Subscribe(ctx, &paho.Subscribe{
+		Subscriptions: []paho.SubscribeOptions{{Topic: topic, QoS: qos}},
+	})
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for i := range c.subscriptions {
+		if c.subscriptions[i].topic == topic {
+			c.subscriptions[i].handler = handler
+			return nil
+		}
+	}
+	c.subscriptions = append(c.subscriptions, v5Subscription{topic: topic, handler: handler})
+
+	return nil
+}
+
+func (c *v5Client) Unsubscribe(topic string) error {
+
+	client := c.current()
+	if client == nil {
+		return fmt.Errorf("not connected")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.options.ConnectWait)
+	defer cancel()
+
+	if _, err := client.Unsubscribe(ctx, &paho.Unsubscribe{Topics: []string{topic}}); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for i := range c.subscriptions {
+		if c.subscriptions[i].topic == topic {
+			c.subscriptions = append(c.subscriptions[:i], c.subscriptions[i+1:]...)
+			break
+		}
+	}
+
+	return nil
+}
+
+func (c *v5Client) Publish(topic string, payload []byte, options PublishOptions) error {
+
+	client := c.current()
+	if client == nil {
+		return fmt.Errorf("not connected")
+	}
+
+	publish := &paho.Publish{
+		QoS:     options.Qos,
+		Retain:  options.Retain,
+		Topic:   topic,
+		Payload: payload,
+		Properties: &paho.PublishProperties{
+			ContentType:     options.ContentType,
+			ResponseTopic:   options.ResponseTopic,
+			CorrelationData: options.CorrelationData,
+		},
+	}
+
+	if options.MessageExpiry > 0 {
+		expiry := options.MessageExpiry
+		publish.Properties.MessageExpiry = &expiry
+	}
+
+	for key, value := range options.UserProperties {
+		publish.Properties.User.Add(key, value)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.options.ConnectWait)
+	defer cancel()
+
+	_, err := client.Publish(ctx, publish)
+
+	return err
+}
+
+// current returns the client of the current connection
+func (c *v5Client) current() *paho.Client {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.client
+}
+
+// dial opens the network connection to the MQTT Broker
+func (c *v5Client) dial() (net.Conn, error) {
+
+	endpoint := c.options.Endpoint
+
+	scheme, err := endpoint.Scheme()
+	if err != nil {
+		return nil, err
+	}
+
+	address := net.JoinHostPort(endpoint.Host, strconv.Itoa(endpoint.Port))
+	dialer := &net.Dialer{Timeout: c.options.ConnectWait}
+
+	tlsConfig := c.options.TLSConfig
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{}
+	}
+	if tlsConfig.ServerName == "" {
+		tlsConfig = tlsConfig.Clone()
+		tlsConfig.ServerName = endpoint.Host
+	}
+
+	switch scheme {
+	case TransportTCP:
+		return dialer.Dial("tcp", address)
+	case TransportSSL:
+		return tls.DialWithDialer(dialer, "tcp", address, tlsConfig)
+	}
+
+	// the WebSocket connection reuses the paho v3 implementation
+	brokerUrl, err := endpoint.URL()
+	if err != nil {
+		return nil, err
+	}
+
+	headers := http.Header{}
+	for key, value := range endpoint.Headers {
+		headers.Set(key, value)
+	}
+
+	websocketOptions := &mqtt.WebsocketOptions{}
+	if endpoint.Proxy != "" {
+		proxyUrl, err := url.Parse(endpoint.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("ERROR: [BROKER] invalid proxy url: %s REASON: %s", endpoint.Proxy, err.Error())
+		}
+		websocketOptions.Proxy = http.ProxyURL(proxyUrl)
+	}
+
+	return mqtt.NewWebsocket(brokerUrl, tlsConfig, c.options.ConnectWait, headers, websocketOptions)
+}
+
+func (c *v5Client) onPublishReceived(received paho.PublishReceived) (bool, error) {
+
+	publish := received.Packet
+
+	message := &Message{
+		Topic:   publish.Topic,
+		Payload: publish.Payload,
+	}
+
+	if publish.Properties != nil {
+		message.ContentType = publish.Properties.ContentType
+		message.ResponseTopic = publish.Properties.ResponseTopic
+		message.CorrelationData = publish.Properties.CorrelationData
+		if len(publish.Properties.User) > 0 {
+			message.UserProperties = make(map[string]string)
+			for _, property := range publish.Properties.User {
+				message.UserProperties[property.Key] = property.Value
+			}
+		}
+	}
+
+	c.mu.Lock()
+	var handler MessageHandler
+	for _, subscription := range c.subscriptions {
+		if MatchTopic(subscription.topic, message.Topic) {
+			handler = subscription.handler
+			break
+		}
+	}
+	c.mu.Unlock()
+
+	if handler == nil {
+		handler = c.options.DefaultHandler
+	}
+
+	if handler != nil {
+		handler(message)
+	}
+
+	return true, nil
+}
+
+func (c *v5Client) onConnectionLost(err error) {
+
+	if c.options.OnConnectionLost != nil {
+		c.options.OnConnectionLost(err)
+	}
+}
@@ -0,0 +1,228 @@
+package timeseries
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Conf is the configuration of a time series collection. The granularity
+// is seconds, minutes or hours and should be close to the interval between
+// the readings of a device, the documents older than retention days are
+// deleted by the server, zero keeps them forever.
+type Conf struct {
+	Granularity   string `json:"granularity"`
+	RetentionDays int64  `json:"retentionDays"`
+}
+
+const (
+	// TimeField is the time of the reading
+	TimeField = "collectedAt"
+	// ReceivedField is the time the reading was received by a consumer
+	ReceivedField = "received"
+	// MetaField holds the device and user of the reading
+	MetaField = "meta"
+	// HourlyRollups and DailyRollups hold the hourly and daily
+	// statistics of the readings of each device
+	HourlyRollups = "metrics_1h"
+	DailyRollups  = "metrics_1d"
+	// LegacySuffix is appended to the name of a regular collection
+	// replaced by a time series collection
+	LegacySuffix = "_legacy"
+
+	defaultGranularity = "seconds"
+
+	errNamespaceExists   = 48
+	errNamespaceNotFound = 26
+)
+
+// Retention returns the retention in seconds
+func (c Conf) Retention() int64 {
+
+	if c.RetentionDays <= 0 {
+		return 0
+	}
+
+	return c.RetentionDays * 24 * 60 * 60
+}
+
+// Setup creates the collection as a time series collection or updates
+// its granularity and retention. An existing regular collection is renamed
+// with the legacy suffix so its documents can be migrated, every service
+// sharing the database runs the setup on startup so it tolerates running
+// at the same time on other services.
+func Setup(db *mongo.Database, name string, conf Conf) error {
+
+	granularity := conf.Granularity
+	if granularity == "" {
+		granularity = defaultGranularity
+	}
+
+	spec, err := collectionSpec(db, name)
+	if err != nil {
+		return err
+	}
+
+	if spec != nil && spec.Type != "timeseries" {
+
+		if err := renameLegacy(db, name); err != nil {
+			return err
+		}
+
+		spec = nil
+	}
+
+	if spec == nil {
+
+		timeSeries := options.TimeSeries().
+			SetTimeField(TimeField).
+			SetMetaField(MetaField).
+			SetGranularity(granularity)
+
+		createOptions := options.CreateCollection().SetTimeSeriesOptions(timeSeries)
+		if retention := conf.Retention(); retention > 0 {
+			createOptions.SetExpireAfterSeconds(retention)
+		}
+
+		err := db.CreateCollection(context.TODO(), name, createOptions)
+		if err == nil {
+			log.Printf("INFO: [TIME SERIES] created time series collection %s with granularity %s", name, granularity)
+			return createIndexes(db, name)
+		}
+
+		// created by another service in the meantime
+		if !hasErrorCode(err, errNamespaceExists) {
+			return fmt.Errorf("ERROR: [TIME SERIES] failed to create time series collection %s REASON: %s", name, err.Error())
+		}
+
+		if spec, err = collectionSpec(db, name); err != nil {
+			return err
+		}
+		if spec == nil || spec.Type != "timeseries" {
+			return fmt.Errorf("ERROR: [TIME SERIES] collection %s isn't a time series collection", name)
+		}
+	}
+
+	// the granularity can only be increased, a failure isn't fatal
+	current, _ := spec.Options.Lookup("timeseries", "granularity").StringValueOK()
+	if current != granularity {
+
+		command := bson.D{
+			{Key: "collMod", Value: name},
+			{Key: "timeseries", Value: bson.D{{Key: "granularity", Value: granularity}}},
+		}
+
+		if err := db.RunCommand(context.TODO(), command).Err(); err != nil {
+			log.Printf("WARNING: [TIME SERIES] failed to change the granularity of %s from %s to %s REASON: %s", name, current, granularity, err.Error())
+		} else {
+			log.Printf("INFO: [TIME SERIES] changed the granularity of %s from %s to %s", name, current, granularity)
+		}
+	}
+
+	currentRetention, _ := spec.Options.Lookup("expireAfterSeconds").AsInt64OK()
+	if retention := conf.Retention(); currentRetention != retention {
+
+		var expire interface{} = retention
+		if retention == 0 {
+			expire = "off"
+		}
+
+		command := bson.D{
+			{Key: "collMod", Value: name},
+			{Key: "expireAfterSeconds", Value: expire},
+		}
+
+		if err := db.RunCommand(context.TODO(), command).Err(); err != nil {
+			return fmt.Errorf("ERROR: [TIME SERIES] failed to change the retention of %s REASON: %s", name, err.Error())
+		}
+
+		log.Printf("INFO: [TIME SERIES] changed the retention of %s to %d days", name, conf.RetentionDays)
+	}
+
+	return createIndexes(db, name)
+}
+
+// HasLegacy returns true if the collection has a legacy collection
+// with documents not migrated yet
+func HasLegacy(db *mongo.Database, name string) (bool, error) {
+
+	spec, err := collectionSpec(db, name+LegacySuffix)
+	if err != nil {
+		return false, err
+	}
+
+	return spec != nil, nil
+}
+
+// createIndexes creates the indexes used by the range queries of a device
+// on the collection and receive times
+func createIndexes(db *mongo.Database, name string) error {
+
+	indexes := []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: MetaField + ".deviceId", Value: 1}, {Key: TimeField, Value: 1}},
+			Options: options.Index().SetName("deviceId_collectedAt"),
+		},
+		{
+			Keys:    bson.D{{Key: MetaField + ".deviceId", Value: 1}, {Key: ReceivedField, Value: 1}},
+			Options: options.Index().SetName("deviceId_received"),
+		},
+	}
+
+	if _, err := db.Collection(name).Indexes().CreateMany(context.TODO(), indexes); err != nil {
+		return fmt.Errorf("ERROR: [TIME SERIES] failed to create %s index REASON: %s", name, err.Error())
+	}
+
+	return nil
+}
+
+// collectionSpec returns the specification of a collection, nil if it doesn't exist
+func collectionSpec(db *mongo.Database, name string) (*mongo.CollectionSpecification, error) {
+
+	specs, err := db.ListCollectionSpecifications(context.TODO(), bson.D{{Key: "name", Value: name}})
+	if err != nil {
+		return nil, fmt.Errorf("ERROR: [TIME SERIES] failed to read collection %s REASON: %s", name, err.Error())
+	}
+
+	if len(specs) == 0 {
+		return nil, nil
+	}
+
+	return specs[0], nil
+}
+
+// renameLegacy renames a regular collection with the legacy suffix
+func renameLegacy(db *mongo.Database, name string) error {
+
+	legacy := name + LegacySuffix
+
+	command := bson.D{
+		{Key: "renameCollection", Value: db.Name() + "." + name},
+		{Key: "to", Value: db.Name() + "." + legacy},
+	}
+
+	err := db.Client().Database("admin").RunCommand(context.TODO(), command).Err()
+	if err == nil {
+		log.Printf("WARNING: [TIME SERIES] regular collection %s renamed to %s, its documents must be migrated", name, legacy)
+		return nil
+	}
+
+	// renamed by another service in the meantime
+	if hasErrorCode(err, errNamespaceNotFound) {
+		return nil
+	}
+
+	return fmt.Errorf("ERROR: [TIME SERIES] failed to rename collection %s to %s REASON: %s", name, legacy, err.Error())
+}
+
+// hasErrorCode returns true if err is a server error with the code
+func hasErrorCode(err error, code int) bool {
+
+	serverErr, ok := err.(mongo.ServerError)
+
+	return ok && serverErr.HasErrorCode(code)
+}
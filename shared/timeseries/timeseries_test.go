@@ -0,0 +1,27 @@
+package timeseries
+
+import "testing"
+
+func TestRetention(t *testing.T) {
+
+	tests := []struct {
+		name          string
+		retentionDays int64
+		want          int64
+	}{
+		{"forever", 0, 0},
+		{"negative", -1, 0},
+		{"one day", 1, 86400},
+		{"one year", 365, 31536000},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			conf := Conf{RetentionDays: tt.retentionDays}
+			if got := conf.Retention(); got != tt.want {
+				t.Errorf("retention is %d seconds, want %d", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,78 @@
+package tls
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+)
+
+type TlsConfig struct {
+	caRootFile string
+	certFile   string
+	keyFile    string
+	insecure   bool
+	Config     *tls.Config
+}
+
+func NewTlsConfig(certFile string, keyFile string, caRootFile string, insecure bool) *TlsConfig {
+
+	t := &TlsConfig{}
+
+	t.caRootFile = caRootFile
+	t.certFile = certFile
+	t.keyFile = keyFile
+	t.insecure = insecure
+
+	return t
+}
+
+// Create creates the TLS configuration. The server certificate is verified
+// with the CA root certificate if set or with the system root certificates
+// otherwise, the client certificate is only sent (mutual TLS) if both the
+// certificate and key files are set.
+func (t *TlsConfig) Create() error {
+
+	// instantiate the TLS configuration
+	t.Config = &tls.Config{
+		InsecureSkipVerify: t.insecure,
+	}
+
+	// if a CA root certificate file is set
+	if t.caRootFile != "" {
+
+		// read CA root file
+		caRoot, err := os.ReadFile(t.caRootFile)
+		if err != nil {
+			return fmt.Errorf("ERROR: [TLS] failed to read CA root certificate: %s REASON: %s", t.caRootFile, err.Error())
+		}
+
+		// create a new certificate pool with the CA root certificate
+		// and check if it is valid
+		caCertPool := x509.NewCertPool()
+		if ok := caCertPool.AppendCertsFromPEM(caRoot); !ok {
+			return fmt.Errorf("ERROR: [TLS] failed to parse CA root certificate: %s REASON: no PEM certificate found", t.caRootFile)
+		}
+
+		t.Config.RootCAs = caCertPool
+	}
+
+	// the client certificate is optional
+	if t.certFile == "" && t.keyFile == "" {
+		return nil
+	}
+
+	if t.certFile == "" || t.keyFile == "" {
+		return fmt.Errorf("ERROR: [TLS] both the client certificate and key files are required")
+	}
+
+	// load the public and private certificate files
+	certs, err := tls.LoadX509KeyPair(t.certFile, t.keyFile)
+	if err != nil {
+		return fmt.Errorf("ERROR: [TLS] failed to load client certificate: %s REASON: %s", t.certFile, err.Error())
+	}
+
+	t.Config.Certificates = []tls.Certificate{certs}
+
+	return nil
+}